@@ -0,0 +1,147 @@
+package mqtt
+
+import (
+	"errors"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// Authenticator implements a method of MQTT 5 enhanced authentication. The
+// client calls Start when it connects or re-authenticates, Continue for each
+// challenge sent by the server and Complete once the server has accepted the
+// authentication. The calls of a single exchange are never concurrent.
+type Authenticator interface {
+	// Method returns the name of the authentication method, such as
+	// "SCRAM-SHA-256".
+	Method() string
+	// Start begins a new exchange and returns the authentication data sent
+	// with the CONNECT packet, or with the AUTH packet when re-authenticating.
+	Start() ([]byte, error)
+	// Continue returns the response to the authentication data of a
+	// challenge sent by the server.
+	Continue(challenge []byte) ([]byte, error)
+	// Complete is called with the authentication data of the CONNACK, or of
+	// the AUTH packet which ends a re-authentication. An error fails the
+	// authentication, for example when the server could not be verified.
+	Complete(data []byte) error
+}
+
+// ErrNoAuthenticator is the error returned by Reauthenticate when the client
+// is not connected using MQTT 5 enhanced authentication.
+var ErrNoAuthenticator = errors.New("no MQTT 5 authenticator is in use")
+
+// ErrReauthInProgress is the error returned by Reauthenticate when an
+// earlier re-authentication has not finished yet.
+var ErrReauthInProgress = errors.New("re-authentication is already in progress")
+
+func newAuthPacket(reasonCode byte, method string, data []byte) *packets.AuthPacket {
+	ap := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+	ap.ReasonCode = reasonCode
+	ap.Properties = &packets.Properties{AuthMethod: method, AuthData: data}
+	return ap
+}
+
+// authFailed is returned from connect when the authenticator has failed,
+// the error is passed on as the reason string of the connect token error.
+func authFailed(err error) (byte, bool, *packets.Properties) {
+	ERROR.Println(NET, "authentication failed", err)
+	return packets.ReasonNotAuthorized, false, &packets.Properties{ReasonString: err.Error()}
+}
+
+// Reauthenticate will start a new MQTT 5 enhanced authentication exchange
+// with the server on the current connection, using the authenticator from
+// the options.
+// Returns a token to track the result of the authentication
+func (c *client) Reauthenticate() Token {
+	token := c.newToken(packets.Auth).(*AuthToken)
+	DEBUG.Println(CLI, "enter Reauthenticate")
+	auth := c.options.Authenticator
+	switch {
+	case !c.IsConnected():
+		token.setError(ErrNotConnected)
+		return token
+	case auth == nil || c.options.ProtocolVersion != 5:
+		token.setError(ErrNoAuthenticator)
+		return token
+	}
+
+	c.Lock()
+	if c.reauth != nil {
+		c.Unlock()
+		token.setError(ErrReauthInProgress)
+		return token
+	}
+	c.reauth = token
+	c.Unlock()
+
+	data, err := auth.Start()
+	if err != nil {
+		c.finishReauth(err)
+		return token
+	}
+	select {
+	case c.oboundP <- &PacketAndToken{p: newAuthPacket(packets.ReasonReauthenticate, auth.Method(), data), t: token}:
+	case <-c.stop:
+		c.finishReauth(ErrNotConnected)
+	}
+	return token
+}
+
+// finishReauth will complete the token of the re-authentication in
+// progress, if any.
+func (c *client) finishReauth(err error) {
+	c.Lock()
+	token := c.reauth
+	c.reauth = nil
+	c.Unlock()
+
+	if token == nil {
+		return
+	}
+	if err != nil {
+		token.setError(err)
+		return
+	}
+	token.flowComplete()
+}
+
+// handleAuth will handle an AUTH packet received after the connection was
+// accepted. A failed re-authentication drops the connection, as the server
+// would otherwise wait for the response.
+func (c *client) handleAuth(ap *packets.AuthPacket) {
+	c.RLock()
+	inProgress := c.reauth != nil
+	c.RUnlock()
+	auth := c.options.Authenticator
+	if !inProgress || auth == nil {
+		WARN.Println(NET, "received unexpected auth, reason:", ap.ReasonCode)
+		return
+	}
+
+	var err error
+	switch ap.ReasonCode {
+	case packets.ReasonContinueAuthentication:
+		var data []byte
+		if data, err = auth.Continue(ap.Properties.AuthData); err == nil {
+			select {
+			case c.oboundP <- &PacketAndToken{p: newAuthPacket(packets.ReasonContinueAuthentication, auth.Method(), data), t: nil}:
+			case <-c.stop:
+			}
+			return
+		}
+	case packets.ReasonSuccess:
+		if err = auth.Complete(ap.Properties.AuthData); err == nil {
+			c.finishReauth(nil)
+			return
+		}
+	default:
+		err = packets.NewReasonCodeError(ap.ReasonCode, ap.Properties)
+		if err == nil {
+			err = &packets.ReasonCodeError{Code: packets.ReasonProtocolError, Reason: "unexpected auth reason code"}
+		}
+	}
+
+	ERROR.Println(NET, "re-authentication failed", err)
+	c.finishReauth(err)
+	signalError(c.errors, err)
+}
@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrMaxConnectAttempts is the error of a connection which has been given
+// up after the maximum number of attempts set with SetMaxConnectAttempts.
+var ErrMaxConnectAttempts = errors.New("gave up connecting after the maximum number of attempts")
+
+// BackoffStrategy computes the time to wait between the attempts to
+// connect. Backoff is called after each failed attempt, counted from 1,
+// with the wait it returned for the previous attempt (0 for the first).
+type BackoffStrategy interface {
+	Backoff(attempt int, previous time.Duration) time.Duration
+}
+
+type constantBackoff struct {
+	d time.Duration
+}
+
+// NewConstantBackoff returns a BackoffStrategy which always waits for the
+// same duration.
+func NewConstantBackoff(d time.Duration) BackoffStrategy {
+	return &constantBackoff{d: d}
+}
+
+func (b *constantBackoff) Backoff(attempt int, previous time.Duration) time.Duration {
+	return b.d
+}
+
+type exponentialBackoff struct {
+	base, max time.Duration
+}
+
+// NewExponentialBackoff returns a BackoffStrategy which waits for base
+// after the first failed attempt and doubles the wait for each further
+// attempt, up to max.
+func NewExponentialBackoff(base, max time.Duration) BackoffStrategy {
+	return &exponentialBackoff{base: base, max: max}
+}
+
+func (b *exponentialBackoff) Backoff(attempt int, previous time.Duration) time.Duration {
+	return exponential(b.base, b.max, attempt)
+}
+
+type fullJitterBackoff struct {
+	base, max time.Duration
+	rand      *lockedRand
+}
+
+// NewFullJitterBackoff returns a BackoffStrategy which waits for a random
+// duration between 0 and the wait of NewExponentialBackoff, so a fleet of
+// clients does not reconnect in step.
+func NewFullJitterBackoff(base, max time.Duration) BackoffStrategy {
+	return &fullJitterBackoff{base: base, max: max, rand: newLockedRand()}
+}
+
+func (b *fullJitterBackoff) Backoff(attempt int, previous time.Duration) time.Duration {
+	return b.rand.between(0, exponential(b.base, b.max, attempt))
+}
+
+type decorrelatedJitterBackoff struct {
+	base, max time.Duration
+	rand      *lockedRand
+}
+
+// NewDecorrelatedJitterBackoff returns a BackoffStrategy which waits for a
+// random duration between base and three times the previous wait, up to
+// max.
+func NewDecorrelatedJitterBackoff(base, max time.Duration) BackoffStrategy {
+	return &decorrelatedJitterBackoff{base: base, max: max, rand: newLockedRand()}
+}
+
+func (b *decorrelatedJitterBackoff) Backoff(attempt int, previous time.Duration) time.Duration {
+	if previous < b.base {
+		previous = b.base
+	}
+	d := b.rand.between(b.base, 3*previous)
+	if d > b.max {
+		d = b.max
+	}
+	return d
+}
+
+// exponential returns base doubled for each attempt after the first, up to
+// max.
+func exponential(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// lockedRand is a source of random numbers seeded with the time, so the
+// clients of a fleet do not share the sequence of the default source. It
+// can be used from several goroutines.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// between returns a random duration in [min, max].
+func (l *lockedRand) between(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return min + time.Duration(l.r.Int63n(int64(max-min)+1))
+}
+
+// intn returns a random number in [0, n).
+func (l *lockedRand) intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+// perm returns a random permutation of the numbers in [0, n).
+func (l *lockedRand) perm(n int) []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Perm(n)
+}
+
+// backoffState counts the failed attempts to connect and computes the
+// waits between them.
+type backoffState struct {
+	strategy    BackoffStrategy
+	maxAttempts int
+	attempt     int
+	previous    time.Duration
+}
+
+// next returns the wait after a failed attempt, false is returned if the
+// maximum number of attempts has been reached.
+func (b *backoffState) next() (time.Duration, bool) {
+	b.attempt++
+	if b.maxAttempts > 0 && b.attempt >= b.maxAttempts {
+		return 0, false
+	}
+	b.previous = b.strategy.Backoff(b.attempt, b.previous)
+	return b.previous, true
+}
+
+// reset will start counting the attempts again.
+func (b *backoffState) reset() {
+	b.attempt = 0
+	b.previous = 0
+}
+
+// connectBackoff returns the backoff of the ConnectRetry path of Connect,
+// by default a constant ConnectRetryInterval.
+func connectBackoff(o *ClientOptions) *backoffState {
+	s := o.BackoffStrategy
+	if s == nil {
+		s = NewConstantBackoff(o.ConnectRetryInterval)
+	}
+	return &backoffState{strategy: s, maxAttempts: o.MaxConnectAttempts}
+}
+
+// reconnectBackoff returns the backoff of reconnect, by default doubling
+// from 1 second up to MaxReconnectInterval.
+func reconnectBackoff(o *ClientOptions) *backoffState {
+	s := o.BackoffStrategy
+	if s == nil {
+		s = NewExponentialBackoff(time.Second, o.MaxReconnectInterval)
+	}
+	return &backoffState{strategy: s, maxAttempts: o.MaxConnectAttempts}
+}
@@ -0,0 +1,366 @@
+// Package broker implements an in-process MQTT 3.1.1 broker for tests. It
+// supports QoS 0, 1 and 2, retained messages, wills, persistent sessions,
+// wildcards and $share subscriptions. It is served on any net.Listener,
+// such as a loopback TCP listener or the mem:// transport of the client.
+package broker
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// ErrClosed is returned by Serve when the broker has been closed.
+var ErrClosed = errors.New("broker closed")
+
+// Broker is an in-process MQTT broker, the zero value is not usable, use
+// New.
+type Broker struct {
+	mu        sync.Mutex
+	sessions  map[string]*session
+	retained  map[string]*packets.PublishPacket
+	shared    map[string]int
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool
+	nextID    int
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New returns a broker which is not serving yet.
+func New() *Broker {
+	return &Broker{
+		sessions:  make(map[string]*session),
+		retained:  make(map[string]*packets.PublishPacket),
+		shared:    make(map[string]int),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[*conn]bool),
+	}
+}
+
+// Listen will serve the broker on a TCP listener at the address, such as
+// 127.0.0.1:0, in the background. The listener is returned for its address.
+func (b *Broker) Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go b.Serve(l)
+	return l, nil
+}
+
+// Serve will accept the connections on the listener and serve each of them
+// until the listener or the broker is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	b.listeners[l] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.listeners, l)
+		b.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.ServeConn(nc)
+		}()
+	}
+}
+
+// Close will close the listeners and the connections of the broker and
+// wait for the connections to end.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	for l := range b.listeners {
+		l.Close()
+	}
+	for c := range b.conns {
+		c.close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+// ServeConn will serve a single client connection until it ends.
+func (b *Broker) ServeConn(nc net.Conn) {
+	defer nc.Close()
+	cp, err := packets.ReadPacket(nc)
+	if err != nil {
+		return
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	c := newConn(nc)
+	go c.writeLoop()
+	defer c.close()
+
+	rc := connect.Validate()
+	if rc == packets.Accepted && connect.ProtocolVersion == 5 {
+		rc = packets.ErrRefusedBadProtocolVersion
+	}
+	if rc != packets.Accepted {
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.ReturnCode = rc
+		c.send(ca)
+		c.flush()
+		return
+	}
+
+	s := b.connect(c, connect)
+	if s == nil {
+		return
+	}
+	graceful := b.serve(c, s, time.Duration(connect.Keepalive)*time.Second)
+	b.disconnect(c, s, graceful)
+}
+
+// connect will attach the connection to the session of the client, taking
+// over the session from another connection, and send the CONNACK followed
+// by the messages kept by the session.
+func (b *Broker) connect(c *conn, cp *packets.ConnectPacket) *session {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.conns[c] = true
+
+	id := cp.ClientIdentifier
+	if id == "" {
+		b.nextID++
+		id = "broker-" + strconv.Itoa(b.nextID)
+	}
+	if cp.WillFlag {
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = cp.WillTopic
+		will.Payload = cp.WillMessage
+		will.Qos = cp.WillQos
+		will.Retain = cp.WillRetain
+		c.will = will
+	}
+
+	s, present := b.sessions[id]
+	if present && s.conn != nil {
+		// the new connection takes over from the old one.
+		s.conn.close()
+		s.conn = nil
+	}
+	if !present || cp.CleanSession {
+		s = newSession(id)
+		b.sessions[id] = s
+		present = false
+	}
+	s.clean = cp.CleanSession
+	s.conn = c
+
+	ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ca.SessionPresent = present
+	c.send(ca)
+	s.resume()
+	return s
+}
+
+// serve will handle the packets of the client, true is returned if the
+// client has ended the connection with a DISCONNECT.
+func (b *Broker) serve(c *conn, s *session, keepAlive time.Duration) bool {
+	for {
+		if keepAlive > 0 {
+			c.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		cp, err := packets.ReadPacket(c)
+		if err != nil {
+			return false
+		}
+		switch p := cp.(type) {
+		case *packets.PublishPacket:
+			if !validTopic(p.TopicName) {
+				return false
+			}
+			b.receive(c, s, p)
+		case *packets.PubrelPacket:
+			b.mu.Lock()
+			delete(s.received, p.MessageID)
+			b.mu.Unlock()
+			pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pc.MessageID = p.MessageID
+			c.send(pc)
+		case *packets.PubackPacket:
+			b.mu.Lock()
+			s.acked(p.MessageID)
+			b.mu.Unlock()
+		case *packets.PubrecPacket:
+			b.mu.Lock()
+			s.released(p.MessageID)
+			b.mu.Unlock()
+		case *packets.PubcompPacket:
+			b.mu.Lock()
+			s.acked(p.MessageID)
+			b.mu.Unlock()
+		case *packets.SubscribePacket:
+			b.subscribe(c, s, p)
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, filter := range p.Topics {
+				delete(s.subs, filter)
+			}
+			b.mu.Unlock()
+			ua := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ua.MessageID = p.MessageID
+			c.send(ua)
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// disconnect will detach the connection from the session and publish the
+// will unless the client disconnected gracefully.
+func (b *Broker) disconnect(c *conn, s *session, graceful bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, c)
+	if s.conn == c {
+		s.conn = nil
+		if s.clean {
+			delete(b.sessions, s.id)
+		}
+	}
+	if !graceful && c.will != nil {
+		b.publish(c.will)
+	}
+}
+
+// receive will handle a publish from a client.
+func (b *Broker) receive(c *conn, s *session, p *packets.PublishPacket) {
+	b.mu.Lock()
+	switch p.Qos {
+	case 0, 1:
+		b.publish(p)
+	case 2:
+		// the message is published when it is first received, a resent
+		// PUBLISH before the PUBREL is not published again.
+		if !s.received[p.MessageID] {
+			s.received[p.MessageID] = true
+			b.publish(p)
+		}
+	}
+	b.mu.Unlock()
+
+	switch p.Qos {
+	case 1:
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = p.MessageID
+		c.send(pa)
+	case 2:
+		pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pr.MessageID = p.MessageID
+		c.send(pr)
+	}
+}
+
+// publish will keep a retained message and deliver the message to the
+// sessions which are subscribed to its topic, the broker must be locked.
+func (b *Broker) publish(p *packets.PublishPacket) {
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			r := p.Copy()
+			r.Qos = p.Qos
+			b.retained[p.TopicName] = r
+		}
+	}
+
+	groups := make(map[string][]*session)
+	for _, s := range b.sessions {
+		qos, matched := s.matches(p.TopicName)
+		if matched {
+			s.deliver(p, qos, false)
+		}
+		for _, key := range s.sharedMatches(p.TopicName) {
+			groups[key] = append(groups[key], s)
+		}
+	}
+	for key, members := range groups {
+		b.deliverShared(key, members, p)
+	}
+}
+
+// deliverShared will deliver the message to one of the members of the
+// shared subscription in turn, preferring those which are connected.
+func (b *Broker) deliverShared(key string, members []*session, p *packets.PublishPacket) {
+	// the sessions come from a map, they are put in a stable order.
+	sortSessions(members)
+	var online []*session
+	for _, s := range members {
+		if s.conn != nil {
+			online = append(online, s)
+		}
+	}
+	if len(online) > 0 {
+		members = online
+	}
+	n := b.shared[key]
+	b.shared[key] = n + 1
+	s := members[n%len(members)]
+	s.deliver(p, s.subs[key], false)
+}
+
+// subscribe will add the subscriptions and send the retained messages
+// which match them.
+func (b *Broker) subscribe(c *conn, s *session, p *packets.SubscribePacket) {
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = p.MessageID
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var added []string
+	for i, filter := range p.Topics {
+		_, rest, _ := splitShared(filter)
+		qos := p.Qoss[i]
+		if !validFilter(rest) || qos > 2 {
+			sa.ReturnCodes = append(sa.ReturnCodes, 0x80)
+			continue
+		}
+		s.subs[filter] = qos
+		sa.ReturnCodes = append(sa.ReturnCodes, qos)
+		added = append(added, filter)
+	}
+	c.send(sa)
+
+	for _, filter := range added {
+		if _, _, shared := splitShared(filter); shared {
+			continue
+		}
+		for _, r := range sortedRetained(b.retained) {
+			if match(filter, r.TopicName) {
+				s.deliver(r, s.subs[filter], true)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// dial will connect a client to the broker over a pipe and return it with
+// the session present flag of the CONNACK.
+func dial(t *testing.T, b *Broker, id string, clean bool, will *packets.PublishPacket) (*testClient, bool) {
+	client, server := net.Pipe()
+	go b.ServeConn(server)
+	c := &testClient{t: t, conn: client}
+
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName, cp.ProtocolVersion = "MQTT", 4
+	cp.ClientIdentifier, cp.CleanSession = id, clean
+	if will != nil {
+		cp.WillFlag, cp.WillTopic, cp.WillMessage, cp.WillQos = true, will.TopicName, will.Payload, will.Qos
+	}
+	c.send(cp)
+	ca, ok := c.read().(*packets.ConnackPacket)
+	if !ok || ca.ReturnCode != packets.Accepted {
+		t.Fatalf("%s was not connected: %v", id, ca)
+	}
+	return c, ca.SessionPresent
+}
+
+func (c *testClient) send(p packets.ControlPacket) {
+	if err := p.Write(c.conn); err != nil {
+		c.t.Fatalf("write failed: %v", err)
+	}
+}
+
+func (c *testClient) read() packets.ControlPacket {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cp, err := packets.ReadPacket(c.conn)
+	if err != nil {
+		c.t.Fatalf("read failed: %v", err)
+	}
+	return cp
+}
+
+func (c *testClient) subscribe(filter string, qos byte) {
+	sp := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sp.MessageID, sp.Topics, sp.Qoss = 1, []string{filter}, []byte{qos}
+	c.send(sp)
+	if sa, ok := c.read().(*packets.SubackPacket); !ok || sa.ReturnCodes[0] != qos {
+		c.t.Fatalf("subscribe to %s failed: %v", filter, sa)
+	}
+}
+
+func (c *testClient) publish(topic, payload string, qos byte, retain bool) {
+	pp := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName, pp.Payload, pp.Qos, pp.Retain, pp.MessageID = topic, []byte(payload), qos, retain, 1
+	c.send(pp)
+	switch qos {
+	case 1:
+		c.read()
+	case 2:
+		c.read()
+		pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pr.MessageID = 1
+		c.send(pr)
+		c.read()
+	}
+}
+
+// expect will read a publish and check its payload, acknowledging it.
+func (c *testClient) expect(payload string, qos byte, retain bool) *packets.PublishPacket {
+	p, ok := c.read().(*packets.PublishPacket)
+	if !ok || string(p.Payload) != payload || p.Qos != qos || p.Retain != retain {
+		c.t.Fatalf("received %v, should be %q qos %d retain %v", p, payload, qos, retain)
+	}
+	switch qos {
+	case 1:
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = p.MessageID
+		c.send(pa)
+	case 2:
+		pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pr.MessageID = p.MessageID
+		c.send(pr)
+		if _, ok := c.read().(*packets.PubrelPacket); !ok {
+			c.t.Fatalf("no pubrel for %q", payload)
+		}
+		pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pc.MessageID = p.MessageID
+		c.send(pc)
+	}
+	return p
+}
+
+func Test_Match(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		matched       bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"+/+", "/b", true},
+		{"#", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+	}
+	for _, test := range tests {
+		if matched := match(test.filter, test.topic); matched != test.matched {
+			t.Errorf("match(%q, %q) is %v", test.filter, test.topic, matched)
+		}
+	}
+	for filter, valid := range map[string]bool{"a/#": true, "a/#/b": false, "a+/b": false, "+": true, "": false} {
+		if validFilter(filter) != valid {
+			t.Errorf("validFilter(%q) should be %v", filter, valid)
+		}
+	}
+}
+
+func Test_PublishSubscribe(t *testing.T) {
+	b := New()
+	defer b.Close()
+	sub, _ := dial(t, b, "sub", true, nil)
+	pub, _ := dial(t, b, "pub", true, nil)
+
+	sub.subscribe("a/+", 2)
+	for qos := byte(0); qos <= 2; qos++ {
+		pub.publish("a/b", "message", qos, false)
+		sub.expect("message", qos, false)
+	}
+
+	// the QoS is lowered to the granted one.
+	sub.subscribe("x/#", 1)
+	pub.publish("x/y", "lowered", 2, false)
+	sub.expect("lowered", 1, false)
+}
+
+func Test_Retained(t *testing.T) {
+	b := New()
+	defer b.Close()
+	pub, _ := dial(t, b, "pub", true, nil)
+	pub.publish("a/b", "kept", 1, true)
+	pub.publish("a/c", "dropped", 1, true)
+	pub.publish("a/c", "", 1, true)
+
+	sub, _ := dial(t, b, "sub", true, nil)
+	sub.subscribe("a/#", 1)
+	sub.expect("kept", 1, true)
+	pub.publish("a/b", "live", 0, false)
+	sub.expect("live", 0, false)
+}
+
+func Test_Will(t *testing.T) {
+	b := New()
+	defer b.Close()
+	sub, _ := dial(t, b, "sub", true, nil)
+	sub.subscribe("will", 0)
+
+	will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	will.TopicName, will.Payload = "will", []byte("gone")
+	graceful, _ := dial(t, b, "graceful", true, will)
+	graceful.send(packets.NewControlPacket(packets.Disconnect))
+	lost, _ := dial(t, b, "lost", true, will)
+	lost.conn.Close()
+
+	// only the connection which was lost publishes its will.
+	sub.expect("gone", 0, false)
+	sub.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if cp, err := packets.ReadPacket(sub.conn); err == nil {
+		t.Errorf("received %v after the will", cp)
+	}
+}
+
+func Test_PersistentSession(t *testing.T) {
+	b := New()
+	defer b.Close()
+	sub, present := dial(t, b, "sub", false, nil)
+	if present {
+		t.Errorf("session is present on the first connection")
+	}
+	sub.subscribe("a/b", 1)
+	sub.send(packets.NewControlPacket(packets.Disconnect))
+	sub.conn.Close()
+
+	pub, _ := dial(t, b, "pub", true, nil)
+	pub.publish("a/b", "queued", 1, false)
+	pub.publish("a/b", "not queued", 0, false)
+
+	sub, present = dial(t, b, "sub", false, nil)
+	if !present {
+		t.Errorf("session is not present on the second connection")
+	}
+	sub.expect("queued", 1, false)
+	pub.publish("a/b", "live", 1, false)
+	sub.expect("live", 1, false)
+}
+
+func Test_SharedSubscription(t *testing.T) {
+	b := New()
+	defer b.Close()
+	first, _ := dial(t, b, "first", true, nil)
+	second, _ := dial(t, b, "second", true, nil)
+	first.subscribe("$share/group/a/#", 0)
+	second.subscribe("$share/group/a/#", 0)
+
+	pub, _ := dial(t, b, "pub", true, nil)
+	pub.publish("a/b", "1", 0, false)
+	pub.publish("a/b", "2", 0, false)
+
+	// each member of the group receives one of the messages.
+	first.expect("1", 0, false)
+	second.expect("2", 0, false)
+}
@@ -0,0 +1,240 @@
+package broker
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// conn is a client connection, the packets are written in order by a
+// goroutine of its own so the broker never waits for a slow client.
+type conn struct {
+	net.Conn
+	will *packets.PublishPacket
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []packets.ControlPacket
+	closed bool
+	done   chan struct{}
+}
+
+func newConn(nc net.Conn) *conn {
+	c := &conn{Conn: nc, done: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// send will queue the packet to be written.
+func (c *conn) send(p packets.ControlPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.queue = append(c.queue, p)
+		c.cond.Signal()
+	}
+}
+
+func (c *conn) writeLoop() {
+	defer close(c.done)
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		p := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+		if err := p.Write(c.Conn); err != nil {
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+// flush will wait for the queued packets to be written and close the
+// connection.
+func (c *conn) flush() {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Signal()
+	c.mu.Unlock()
+	<-c.done
+}
+
+// close will close the connection, dropping the queued packets.
+func (c *conn) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	c.cond.Signal()
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+// outbound is a QoS 1 or 2 message sent to a client and not yet
+// acknowledged.
+type outbound struct {
+	p        *packets.PublishPacket
+	sent     bool
+	released bool
+}
+
+// session is the state of a client kept by the broker, across connections
+// for a persistent session. It is guarded by the lock of the broker.
+type session struct {
+	id       string
+	clean    bool
+	conn     *conn
+	subs     map[string]byte
+	nextID   uint16
+	inflight map[uint16]*outbound
+	order    []uint16
+	received map[uint16]bool
+}
+
+func newSession(id string) *session {
+	return &session{
+		id:       id,
+		subs:     make(map[string]byte),
+		inflight: make(map[uint16]*outbound),
+		received: make(map[uint16]bool),
+	}
+}
+
+// matches returns the highest QoS of the subscriptions which match the
+// topic, shared subscriptions aside.
+func (s *session) matches(topic string) (byte, bool) {
+	var qos byte
+	matched := false
+	for filter, q := range s.subs {
+		if _, _, shared := splitShared(filter); shared || !match(filter, topic) {
+			continue
+		}
+		if !matched || q > qos {
+			qos = q
+		}
+		matched = true
+	}
+	return qos, matched
+}
+
+// sharedMatches returns the shared subscriptions which match the topic.
+func (s *session) sharedMatches(topic string) []string {
+	var keys []string
+	for filter := range s.subs {
+		if _, rest, shared := splitShared(filter); shared && match(rest, topic) {
+			keys = append(keys, filter)
+		}
+	}
+	return keys
+}
+
+// deliver will send a copy of the message with the QoS lowered to the
+// granted QoS. The QoS 1 and 2 messages are kept until acknowledged, and
+// for a persistent session while the client is not connected.
+func (s *session) deliver(p *packets.PublishPacket, granted byte, retain bool) {
+	m := p.Copy()
+	m.Qos = p.Qos
+	if granted < m.Qos {
+		m.Qos = granted
+	}
+	m.Retain = retain
+	if m.Qos == 0 {
+		if s.conn != nil {
+			s.conn.send(m)
+		}
+		return
+	}
+	if s.conn == nil && s.clean {
+		return
+	}
+
+	m.MessageID = s.newID()
+	o := &outbound{p: m}
+	s.inflight[m.MessageID] = o
+	s.order = append(s.order, m.MessageID)
+	if s.conn != nil {
+		o.sent = true
+		s.conn.send(m)
+	}
+}
+
+// newID returns a message ID which is not in flight.
+func (s *session) newID() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		if _, used := s.inflight[s.nextID]; !used {
+			return s.nextID
+		}
+	}
+}
+
+// resume will send the messages kept by the session in order, the ones
+// which were sent before are marked as duplicates.
+func (s *session) resume() {
+	for _, id := range s.order {
+		o := s.inflight[id]
+		if o.released {
+			pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pr.MessageID = id
+			s.conn.send(pr)
+			continue
+		}
+		// a copy is sent as the old connection may still be writing it
+		m := o.p.Copy()
+		m.Qos, m.Retain, m.MessageID, m.Dup = o.p.Qos, o.p.Retain, id, o.sent
+		o.sent = true
+		s.conn.send(m)
+	}
+}
+
+// acked will forget the message once the client has acknowledged it.
+func (s *session) acked(id uint16) {
+	if _, ok := s.inflight[id]; !ok {
+		return
+	}
+	delete(s.inflight, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// released will answer the PUBREC of a QoS 2 message with a PUBREL.
+func (s *session) released(id uint16) {
+	if o, ok := s.inflight[id]; ok {
+		o.released = true
+	}
+	if s.conn != nil {
+		pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pr.MessageID = id
+		s.conn.send(pr)
+	}
+}
+
+func sortSessions(sessions []*session) {
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+}
+
+// sortedRetained returns the retained messages in the order of their
+// topics.
+func sortedRetained(retained map[string]*packets.PublishPacket) []*packets.PublishPacket {
+	messages := make([]*packets.PublishPacket, 0, len(retained))
+	for _, r := range retained {
+		messages = append(messages, r)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].TopicName < messages[j].TopicName })
+	return messages
+}
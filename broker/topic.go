@@ -0,0 +1,59 @@
+package broker
+
+import "strings"
+
+// validFilter reports whether the topic filter of a subscription is valid,
+// a multi-level wildcard must be the last level and the wildcards must take
+// up a whole level.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// validTopic reports whether the topic of a publish is valid, it must not
+// contain wildcards.
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// splitShared returns the group and the filter of a shared subscription
+// such as $share/group/a/b, ok is false if the filter is not shared.
+func splitShared(filter string) (group, rest string, ok bool) {
+	if !strings.HasPrefix(filter, "$share/") {
+		return "", filter, false
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) != 3 || parts[1] == "" {
+		return "", filter, false
+	}
+	return parts[1], parts[2], true
+}
+
+// match reports whether the topic matches the filter. The topics starting
+// with $ are not matched by a wildcard in the first level.
+func match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
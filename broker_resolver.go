@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BrokerResolver returns the servers to connect to, it is consulted before
+// each attempt to connect or reconnect so the brokers can change while the
+// client runs. The servers added with AddBroker are used if the resolver
+// fails or returns none.
+type BrokerResolver interface {
+	Resolve(ctx context.Context) ([]*url.URL, error)
+}
+
+type srvResolver struct {
+	domain string
+	secure bool
+	lookup func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// NewSRVResolver returns a BrokerResolver which looks up the DNS SRV
+// records of the domain, _mqtt._tcp or _secure-mqtt._tcp when secure is
+// set. The servers are returned in the order of the priority and weight of
+// the records.
+func NewSRVResolver(domain string, secure bool) BrokerResolver {
+	return &srvResolver{domain: domain, secure: secure, lookup: net.DefaultResolver.LookupSRV}
+}
+
+func (r *srvResolver) Resolve(ctx context.Context) ([]*url.URL, error) {
+	service, scheme := "mqtt", "tcp"
+	if r.secure {
+		service, scheme = "secure-mqtt", "ssl"
+	}
+	_, records, err := r.lookup(ctx, service, "tcp", r.domain)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]*url.URL, 0, len(records))
+	for _, srv := range records {
+		host := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		servers = append(servers, &url.URL{Scheme: scheme, Host: host})
+	}
+	return servers, nil
+}
+
+type fileResolver struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	servers []*url.URL
+}
+
+// NewFileResolver returns a BrokerResolver which reads the servers from a
+// file with one URL per line, as passed to AddBroker. Blank lines and lines
+// starting with # are skipped. The file is read again when it is modified.
+func NewFileResolver(path string) BrokerResolver {
+	return &fileResolver{path: path}
+}
+
+func (r *fileResolver) Resolve(ctx context.Context) ([]*url.URL, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.servers != nil && fi.ModTime().Equal(r.modTime) && fi.Size() == r.size {
+		return r.servers, nil
+	}
+
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	servers := []*url.URL{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := parseBrokerURI(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", r.path, n, err)
+		}
+		servers = append(servers, u)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	r.servers, r.modTime, r.size = servers, fi.ModTime(), fi.Size()
+	return servers, nil
+}
+
+// brokers returns the servers to try for an attempt to connect, from the
+// BrokerResolver if there is one, in the order of the ServerSelector.
+func (c *client) brokers(ctx context.Context) []*url.URL {
+	c.optionsMu.Lock() // Protect c.options.Servers so that servers can be added in test cases
+	servers := c.options.Servers
+	c.optionsMu.Unlock()
+
+	if r := c.options.BrokerResolver; r != nil {
+		if c.options.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.options.ConnectTimeout)
+			defer cancel()
+		}
+		resolved, err := r.Resolve(ctx)
+		switch {
+		case err != nil:
+			WARN.Println(CLI, "failed to resolve brokers, using the added ones:", err)
+		case len(resolved) == 0:
+			WARN.Println(CLI, "resolved no brokers, using the added ones")
+		default:
+			servers = resolved
+		}
+	}
+	return c.orderServers(servers)
+}
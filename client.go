@@ -19,15 +19,17 @@ package mqtt
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 const (
@@ -38,7 +40,8 @@ const (
 )
 
 // Client is the interface definition for a Client as used by this
-// library, the interface is primarily to allow mocking tests.
+// library, the interface is primarily to allow mocking tests. The mqtttest
+// package provides a fake Client for them.
 //
 // It is an MQTT v3.1.1 client for communicating
 // with an MQTT server using non-blocking methods that allow work
@@ -74,9 +77,15 @@ type Client interface {
 	// to the specified topic.
 	// Returns a token to track delivery of the message to the broker
 	Publish(topic string, qos byte, retained bool, payload interface{}) Token
+	// PublishWithOptions will publish a message like Publish, the options
+	// are sent as the MQTT 5 properties of the message.
+	PublishWithOptions(topic string, qos byte, retained bool, payload interface{}, opts PublishOptions) Token
 	// Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 	// a message is published on the topic provided, or nil for the default handler
 	Subscribe(topic string, qos byte, callback MessageHandler) Token
+	// SubscribeWithOptions starts a new subscription like Subscribe, using
+	// the MQTT 5 subscription options.
+	SubscribeWithOptions(topic string, opts SubscribeOptions, callback MessageHandler) Token
 	// SubscribeMultiple starts a new subscription for multiple topics. Provide a MessageHandler to
 	// be executed when a message is published on one of the topics provided, or nil for the
 	// default handler
@@ -85,6 +94,17 @@ type Client interface {
 	// Messages published to those topics from other clients will no longer be
 	// received.
 	Unsubscribe(topics ...string) Token
+	// ConnectContext, PublishContext, SubscribeContext and
+	// UnsubscribeContext are like their counterparts without a context, but
+	// they wait for the operation to complete and give up when the context
+	// is done.
+	ConnectContext(ctx context.Context) error
+	PublishContext(ctx context.Context, topic string, qos byte, retained bool, payload interface{}) error
+	SubscribeContext(ctx context.Context, topic string, qos byte, callback MessageHandler) error
+	UnsubscribeContext(ctx context.Context, topics ...string) error
+	// Reauthenticate will start a new MQTT 5 enhanced authentication
+	// exchange with the server using the authenticator from the options.
+	Reauthenticate() Token
 	// AddRoute allows you to add a handler for messages on a specific topic
 	// without making a subscription. For example having a different handler
 	// for parts of a wildcard subscription
@@ -115,6 +135,14 @@ type client struct {
 	errors          chan error
 	stop            chan struct{}
 	persist         Store
+	reauth          *AuthToken
+	inflight        *inflightWindow
+	offline         *offlineQueue
+	acks            *ackQueue
+	stateEvents     stateNotifier
+	backoff         *backoffState
+	connectedAt     time.Time
+	aliases         *topicAliases
 	options         ClientOptions
 	optionsMu       sync.Mutex // Protects the options in a few limited cases where needed for testing
 	workers         sync.WaitGroup
@@ -133,8 +161,9 @@ func NewClient(o *ClientOptions) Client {
 	if c.options.Store == nil {
 		c.options.Store = NewMemoryStore()
 	}
+	c.options.Clock = clockOr(c.options.Clock)
 	switch c.options.ProtocolVersion {
-	case 3, 4:
+	case 3, 4, 5:
 		c.options.protocolVersionExplicit = true
 	case 0x83, 0x84:
 		c.options.protocolVersionExplicit = true
@@ -145,6 +174,13 @@ func NewClient(o *ClientOptions) Client {
 	c.persist = c.options.Store
 	c.status = disconnected
 	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor)}
+	c.inflight = newInflightWindow()
+	c.offline = newOfflineQueue(&c.options)
+	c.acks = newAckQueue(&c.options)
+	c.backoff = reconnectBackoff(&c.options)
+	if s, ok := c.options.ServerSelector.(clockSetter); ok {
+		s.setClock(c.options.Clock)
+	}
 	c.msgRouter, c.stopRouter = newRouter()
 	c.msgRouter.setDefaultHandler(c.options.DefaultPublishHandler)
 
@@ -156,9 +192,23 @@ func NewClient(o *ClientOptions) Client {
 
 	WARN.Printf("useHermes = %t", c.useHermes)
 	if c.useHermes {
-		c.hermes = &hermes{}
+		c.hermes = &hermes{clock: c.options.Clock}
 		c.hermes.batteryLeftMah = o.HermesOptions.BatteryLeftMah
 		c.hermes.totalBatteryMah = o.HermesOptions.TotalBatteryMah
+		c.hermes.sendEnergyMah = o.HermesOptions.SendEnergyMah
+		c.hermes.byteEnergyMah = o.HermesOptions.ByteEnergyMah
+		c.hermes.priorities = o.HermesOptions.Priorities
+		c.hermes.alarmResetsWindow = o.HermesOptions.AlarmResetsWindow
+		c.hermes.bulkBatteryThreshold = o.HermesOptions.BulkBatteryThreshold
+
+		if o.HermesOptions.CaptureSamples {
+			c.hermes.capture = newSampleRing(o.HermesOptions.CaptureDir,
+				o.HermesOptions.CaptureMaxSamples)
+			c.hermes.captureBatchSize = o.HermesOptions.CaptureBatchSize
+			if c.hermes.captureBatchSize <= 0 {
+				c.hermes.captureBatchSize = defaultCaptureBatchSize
+			}
+		}
 	}
 
 	return c
@@ -215,21 +265,37 @@ func (c *client) connectionStatus() uint32 {
 }
 
 func (c *client) setConnected(status uint32) {
-	c.Lock()
-	defer c.Unlock()
-	atomic.StoreUint32(&c.status, uint32(status))
+	c.changeState(status, ConnectionEvent{})
 }
 
 //ErrNotConnected is the error returned from function calls that are
 //made when the client is not connected to a broker
 var ErrNotConnected = errors.New("Not Connected")
 
+//ErrServerDisconnect is the error passed to the connection lost handler
+//when an MQTT 5 broker has closed the connection with a DISCONNECT packet
+//without a failure reason code
+var ErrServerDisconnect = errors.New("Disconnected by server")
+
 // Connect will create a connection to the message broker, by default
 // it will attempt to connect at v3.1.1 and auto retry at v3.1 if that
 // fails
 func (c *client) Connect() Token {
+	return c.connectContext(context.Background())
+}
+
+// ConnectContext will connect to the message broker like Connect, but it
+// gives up as soon as the context is done. It returns the error of the
+// connect token once the attempt has ended.
+func (c *client) ConnectContext(ctx context.Context) error {
+	t := c.connectContext(ctx).(*ConnectToken)
+	<-t.complete
+	return t.Error()
+}
+
+func (c *client) connectContext(ctx context.Context) Token {
 	var err error
-	t := newToken(packets.Connect).(*ConnectToken)
+	t := c.newToken(packets.Connect).(*ConnectToken)
 	DEBUG.Println(CLI, "Connect()")
 
 	if c.options.ConnectRetry && atomic.LoadUint32(&c.status) != disconnected {
@@ -256,31 +322,49 @@ func (c *client) Connect() Token {
 		c.errors = make(chan error, 1)
 		c.stop = make(chan struct{})
 
-		var rc byte
+		var (
+			rc          byte
+			attempt     int
+			connectedTo *url.URL
+			gaveUp      bool
+			retry       = connectBackoff(&c.options)
+		)
 		protocolVersion := c.options.ProtocolVersion
 
-		if len(c.options.Servers) == 0 {
+		if len(c.options.Servers) == 0 && c.options.BrokerResolver == nil {
 			t.setError(fmt.Errorf("No servers defined to connect to"))
 			return
 		}
 
 	RETRYCONN:
-		c.optionsMu.Lock() // Protect c.options.Servers so that servers can be added in test cases
-		brokers := c.options.Servers
-		c.optionsMu.Unlock()
+		brokers := c.brokers(ctx)
+		if len(brokers) == 0 {
+			// the connection of an earlier Connect must not pass for a new one
+			c.Lock()
+			c.conn = nil
+			c.Unlock()
+			rc, err = packets.ErrNetworkError, fmt.Errorf("No servers resolved to connect to")
+		}
 
 		for _, broker := range brokers {
 			cm := newConnectMsgFromOptions(&c.options, broker)
 			c.options.ProtocolVersion = protocolVersion
 		CONN:
 			DEBUG.Println(CLI, "about to write new connect msg")
+			if ctx.Err() != nil {
+				break
+			}
+			attempt++
 			c.Lock()
-			c.conn, err = openConnection(broker, c.options.TLSConfig, c.options.ConnectTimeout,
-				c.options.HTTPHeaders)
+			c.conn, err = c.openConnection(broker, contextTimeout(ctx, c.options.ConnectTimeout))
 			c.Unlock()
 			if err == nil {
 				DEBUG.Println(CLI, "socket connected to broker")
 				switch c.options.ProtocolVersion {
+				case 5:
+					DEBUG.Println(CLI, "Using MQTT 5 protocol")
+					cm.ProtocolName = "MQTT"
+					cm.ProtocolVersion = 5
 				case 3:
 					DEBUG.Println(CLI, "Using MQTT 3.1 protocol")
 					cm.ProtocolName = "MQIsdp"
@@ -299,16 +383,35 @@ func (c *client) Connect() Token {
 					cm.ProtocolName = "MQTT"
 					cm.ProtocolVersion = 4
 				}
-				cm.Write(c.conn)
-
-				rc, t.sessionPresent = c.connect()
+				stopWatch := c.closeOnDone(ctx)
+				rc, t.sessionPresent, t.properties = c.connect(cm)
+				stopWatch()
+				if ctx.Err() != nil {
+					// the connection may have been closed by the context
+					rc = packets.ErrNetworkError
+				}
+				// a refused protocol version is not a fault of the server
+				// while the client falls back to an older version.
+				fallback := versionRefused(rc) && (c.options.ProtocolVersion == 5 ||
+					c.options.ProtocolVersion == 4 && !c.options.protocolVersionExplicit)
+				if !fallback {
+					c.serverResult(broker, rc, connackError(rc, t.properties))
+				}
 				if rc != packets.Accepted {
+					c.reportAttempt(ConnectionEvent{Cause: connackError(rc, t.properties), Broker: broker,
+						Attempt: attempt, ReturnCode: rc})
 					c.Lock()
 					if c.conn != nil {
 						c.conn.Close()
 						c.conn = nil
 					}
 					c.Unlock()
+					//a broker without MQTT 5 support refuses the protocol version
+					if c.options.ProtocolVersion == 5 && versionRefused(rc) {
+						WARN.Println(CLI, "Broker does not support MQTT 5, trying reconnect using MQTT 3.1.1 protocol")
+						c.options.ProtocolVersion = 4
+						goto CONN
+					}
 					//if the protocol version was explicitly set don't do any fallback
 					if c.options.protocolVersionExplicit {
 						ERROR.Println(CLI, "Connecting to", broker, "CONNACK was not CONN_ACCEPTED, but rather", packets.ConnackReturnCodes[rc])
@@ -320,32 +423,50 @@ func (c *client) Connect() Token {
 						goto CONN
 					}
 				}
+				if rc == packets.Accepted {
+					connectedTo = broker
+				}
 				break
 			} else {
 				ERROR.Println(CLI, err.Error())
 				WARN.Println(CLI, "failed to connect to broker, trying next")
 				rc = packets.ErrNetworkError
+				c.serverResult(broker, rc, err)
+				c.reportAttempt(ConnectionEvent{Cause: err, Broker: broker, Attempt: attempt})
 			}
 		}
 
 		if c.conn == nil {
 			if c.options.ConnectRetry {
-				DEBUG.Println(CLI, "Connect failed, sleeping for", int(c.options.ConnectRetryInterval.Seconds()), "seconds and will then retry")
-				time.Sleep(c.options.ConnectRetryInterval)
+				if sleep, ok := retry.next(); ok {
+					DEBUG.Println(CLI, "Connect failed, sleeping for", sleep, "and will then retry")
+					select {
+					case <-c.options.Clock.After(sleep):
+					case <-ctx.Done():
+					}
 
-				if atomic.LoadUint32(&c.status) == connecting {
-					goto RETRYCONN
+					if atomic.LoadUint32(&c.status) == connecting && ctx.Err() == nil {
+						goto RETRYCONN
+					}
+				} else {
+					gaveUp = true
 				}
 			}
 			ERROR.Println(CLI, "Failed to connect to a broker")
-			c.setConnected(disconnected)
-			c.persist.Close()
-			t.returnCode = rc
-			if rc != packets.ErrNetworkError {
-				t.setError(packets.ConnErrors[rc])
+			var cerr error
+			if ctx.Err() != nil {
+				cerr = ctx.Err()
+			} else if gaveUp {
+				cerr = ErrMaxConnectAttempts
+			} else if rc != packets.ErrNetworkError {
+				cerr = connackError(rc, t.properties)
 			} else {
-				t.setError(fmt.Errorf("%s : %s", packets.ConnErrors[rc], err))
+				cerr = fmt.Errorf("%s : %s", packets.ConnErrors[rc], err)
 			}
+			c.changeState(disconnected, ConnectionEvent{Cause: cerr, Attempt: attempt, ReturnCode: rc})
+			c.persist.Close()
+			t.returnCode = rc
+			t.setError(cerr)
 			return
 		}
 
@@ -353,8 +474,8 @@ func (c *client) Connect() Token {
 
 		if c.options.KeepAlive != 0 {
 			atomic.StoreInt32(&c.pingOutstanding, 0)
-			c.lastReceived.Store(time.Now())
-			c.lastSent.Store(time.Now())
+			c.lastReceived.Store(c.options.Clock.Now())
+			c.lastSent.Store(c.options.Clock.Now())
 			c.workers.Add(1)
 			go keepalive(c)
 		}
@@ -362,12 +483,14 @@ func (c *client) Connect() Token {
 		c.incomingPubChan = make(chan *packets.PublishPacket)
 		c.msgRouter.matchAndDispatch(c.incomingPubChan, c.options.Order, c)
 
-		c.setConnected(connected)
+		c.connectedAt = c.options.Clock.Now()
+		c.changeState(connected, ConnectionEvent{Broker: connectedTo, Attempt: attempt, SessionPresent: t.sessionPresent})
 		DEBUG.Println(CLI, "client is connected")
 		if c.options.OnConnect != nil {
 			go c.options.OnConnect(c)
 		}
 
+		c.startAcks()
 		c.workers.Add(4)
 		go errorWatch(c)
 		go alllogic(c)
@@ -381,6 +504,8 @@ func (c *client) Connect() Token {
 		} else {
 			c.persist.Reset()
 		}
+		// the offline queue may hold messages from an earlier run.
+		go c.flushOffline()
 
 		if c.useHermes {
 			c.hermes.Initialize()
@@ -407,26 +532,42 @@ func (c *client) reconnect() {
 	var (
 		err error
 
-		rc    = byte(1)
-		sleep = time.Duration(1 * time.Second)
+		rc = byte(1)
+
+		attempt        int
+		connectedTo    *url.URL
+		sessionPresent bool
+		props          *packets.Properties
 	)
 
+	// the backoff carries on from the previous reconnect unless the lost
+	// connection was up for BackoffResetAfter, so a flapping connection is
+	// retried less and less often.
+	if c.options.Clock.Now().Sub(c.connectedAt) >= c.options.BackoffResetAfter {
+		c.backoff.reset()
+	} else if !c.reconnectWait() {
+		return
+	}
+
 	for rc != 0 && atomic.LoadUint32(&c.status) != disconnected {
 		if nil != c.options.OnReconnecting {
 			c.options.OnReconnecting(c, &c.options)
 		}
-		c.optionsMu.Lock() // Protect c.options.Servers so that servers can be added in test cases
-		brokers := c.options.Servers
-		c.optionsMu.Unlock()
+		brokers := c.brokers(context.Background())
 		for _, broker := range brokers {
 			cm := newConnectMsgFromOptions(&c.options, broker)
 			DEBUG.Println(CLI, "about to write new connect msg")
+			attempt++
 			c.Lock()
-			c.conn, err = openConnection(broker, c.options.TLSConfig, c.options.ConnectTimeout, c.options.HTTPHeaders)
+			c.conn, err = c.openConnection(broker, c.options.ConnectTimeout)
 			c.Unlock()
 			if err == nil {
 				DEBUG.Println(CLI, "socket connected to broker")
 				switch c.options.ProtocolVersion {
+				case 5:
+					DEBUG.Println(CLI, "Using MQTT 5 protocol")
+					cm.ProtocolName = "MQTT"
+					cm.ProtocolVersion = 5
 				case 0x83:
 					DEBUG.Println(CLI, "Using MQTT 3.1b protocol")
 					cm.ProtocolName = "MQIsdp"
@@ -444,10 +585,11 @@ func (c *client) reconnect() {
 					cm.ProtocolName = "MQTT"
 					cm.ProtocolVersion = 4
 				}
-				cm.Write(c.conn)
-
-				rc, _ = c.connect()
+				rc, sessionPresent, props = c.connect(cm)
+				c.serverResult(broker, rc, connackError(rc, props))
 				if rc != packets.Accepted {
+					c.reportAttempt(ConnectionEvent{Cause: connackError(rc, props), Broker: broker,
+						Attempt: attempt, ReturnCode: rc})
 					if c.conn != nil {
 						c.conn.Close()
 						c.conn = nil
@@ -458,23 +600,20 @@ func (c *client) reconnect() {
 						continue
 					}
 				}
+				if rc == packets.Accepted {
+					connectedTo = broker
+				}
 				break
 			} else {
 				ERROR.Println(CLI, err.Error())
 				WARN.Println(CLI, "failed to connect to broker, trying next")
 				rc = packets.ErrNetworkError
+				c.serverResult(broker, rc, err)
+				c.reportAttempt(ConnectionEvent{Cause: err, Broker: broker, Attempt: attempt})
 			}
 		}
-		if rc != 0 {
-			DEBUG.Println(CLI, "Reconnect failed, sleeping for", int(sleep.Seconds()), "seconds")
-			time.Sleep(sleep)
-			if sleep < c.options.MaxReconnectInterval {
-				sleep *= 2
-			}
-
-			if sleep > c.options.MaxReconnectInterval {
-				sleep = c.options.MaxReconnectInterval
-			}
+		if rc != 0 && !c.reconnectWait() {
+			return
 		}
 	}
 	// Disconnect() must have been called while we were trying to reconnect.
@@ -484,21 +623,29 @@ func (c *client) reconnect() {
 	}
 
 	c.stop = make(chan struct{})
+	// The error of a second worker of the lost connection, signalled after
+	// errorWatch had stopped, must not end the new connection.
+	select {
+	case <-c.errors:
+	default:
+	}
 
 	if c.options.KeepAlive != 0 {
 		atomic.StoreInt32(&c.pingOutstanding, 0)
-		c.lastReceived.Store(time.Now())
-		c.lastSent.Store(time.Now())
+		c.lastReceived.Store(c.options.Clock.Now())
+		c.lastSent.Store(c.options.Clock.Now())
 		c.workers.Add(1)
 		go keepalive(c)
 	}
 
-	c.setConnected(connected)
+	c.connectedAt = c.options.Clock.Now()
+	c.changeState(connected, ConnectionEvent{Broker: connectedTo, Attempt: attempt, SessionPresent: sessionPresent})
 	DEBUG.Println(CLI, "client is reconnected")
 	if c.options.OnConnect != nil {
 		go c.options.OnConnect(c)
 	}
 
+	c.startAcks()
 	c.workers.Add(4)
 	go errorWatch(c)
 	go alllogic(c)
@@ -507,33 +654,119 @@ func (c *client) reconnect() {
 
 	c.workers.Add(1) // disconnect during resume can lead to reconnect being called before resume completes
 	c.resume(c.options.ResumeSubs)
+	c.flushOffline()
+}
+
+// reconnectWait will sleep for the backoff after a failed attempt to
+// reconnect, false is returned if the client has given up reconnecting
+// after the maximum number of attempts and is now disconnected.
+func (c *client) reconnectWait() bool {
+	sleep, ok := c.backoff.next()
+	if !ok {
+		ERROR.Println(CLI, "Reconnect failed, giving up after", c.backoff.attempt, "attempts")
+		if c.options.CleanSession {
+			c.messageIds.cleanUp()
+		}
+		if c.offline != nil {
+			c.offline.clear(ErrMaxConnectAttempts)
+		}
+		c.changeState(disconnected, ConnectionEvent{Cause: ErrMaxConnectAttempts, Attempt: c.backoff.attempt})
+		return false
+	}
+	DEBUG.Println(CLI, "Reconnect failed, sleeping for", sleep)
+	<-c.options.Clock.After(sleep)
+	return true
 }
 
-// This function is only used for receiving a connack
-// when the connection is first started.
+// This function is only used for sending the connect and
+// receiving a connack when the connection is first started.
 // This prevents receiving incoming data while resume
 // is in progress if clean session is false.
-func (c *client) connect() (byte, bool) {
+func (c *client) connect(cm *packets.ConnectPacket) (byte, bool, *packets.Properties) {
 	DEBUG.Println(NET, "connect started")
 
-	ca, err := packets.ReadPacket(c.conn)
-	if err != nil {
-		ERROR.Println(NET, "connect got error", err)
-		return packets.ErrNetworkError, false
+	var auth Authenticator
+	if cm.ProtocolVersion == 5 && c.options.Authenticator != nil {
+		auth = c.options.Authenticator
+		data, err := auth.Start()
+		if err != nil {
+			return authFailed(err)
+		}
+		if cm.Properties == nil {
+			cm.Properties = &packets.Properties{}
+		}
+		cm.Properties.AuthMethod = auth.Method()
+		cm.Properties.AuthData = data
 	}
-	if ca == nil {
-		ERROR.Println(NET, "received nil packet")
-		return packets.ErrNetworkError, false
+	if err := cm.Write(c.conn); err != nil {
+		ERROR.Println(NET, "connect got error", err)
+		return packets.ErrNetworkError, false, nil
 	}
 
-	msg, ok := ca.(*packets.ConnackPacket)
-	if !ok {
-		ERROR.Println(NET, "received msg that was not CONNACK")
-		return packets.ErrNetworkError, false
-	}
+	for {
+		ca, err := packets.ReadPacketWithVersion(c.conn, byte(c.options.ProtocolVersion))
+		if err != nil {
+			ERROR.Println(NET, "connect got error", err)
+			return packets.ErrNetworkError, false, nil
+		}
+		if ca == nil {
+			ERROR.Println(NET, "received nil packet")
+			return packets.ErrNetworkError, false, nil
+		}
 
-	DEBUG.Println(NET, "received connack")
-	return msg.ReturnCode, msg.SessionPresent
+		// the server may challenge the client before sending the connack
+		if ap, ok := ca.(*packets.AuthPacket); ok && auth != nil && ap.ReasonCode == packets.ReasonContinueAuthentication {
+			DEBUG.Println(NET, "received auth challenge")
+			data, err := auth.Continue(ap.Properties.AuthData)
+			if err != nil {
+				return authFailed(err)
+			}
+			if err = newAuthPacket(packets.ReasonContinueAuthentication, auth.Method(), data).Write(c.conn); err != nil {
+				ERROR.Println(NET, "connect got error", err)
+				return packets.ErrNetworkError, false, nil
+			}
+			continue
+		}
+
+		msg, ok := ca.(*packets.ConnackPacket)
+		if !ok {
+			ERROR.Println(NET, "received msg that was not CONNACK")
+			return packets.ErrNetworkError, false, nil
+		}
+
+		DEBUG.Println(NET, "received connack")
+		if msg.ReturnCode != packets.Accepted {
+			return msg.ReturnCode, msg.SessionPresent, msg.Properties
+		}
+		if auth != nil {
+			var data []byte
+			if msg.Properties != nil {
+				data = msg.Properties.AuthData
+			}
+			if err := auth.Complete(data); err != nil {
+				return authFailed(err)
+			}
+		}
+
+		// topic aliases are only valid for a single connection
+		var inMax uint16
+		if c.options.ProtocolVersion == 5 {
+			inMax = c.options.TopicAliasMaximum
+		}
+		c.aliases = newTopicAliases(msg.Properties, inMax)
+		c.inflight.reset(inflightMax(&c.options, msg.Properties))
+
+		if msg.Properties != nil {
+			// the broker can override the keepalive and assign the client ID
+			if msg.Properties.ServerKeepAlive != nil {
+				c.options.KeepAlive = int64(*msg.Properties.ServerKeepAlive)
+			}
+			if msg.Properties.AssignedClientID != "" {
+				c.options.ClientID = msg.Properties.AssignedClientID
+			}
+		}
+		return msg.ReturnCode, msg.SessionPresent, msg.Properties
+	}
 }
 
 // Disconnect will end the connection with the server, but not before waiting
@@ -546,7 +779,7 @@ func (c *client) Disconnect(quiesce uint) {
 		c.setConnected(disconnected)
 
 		dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
-		dt := newToken(packets.Disconnect)
+		dt := c.newToken(packets.Disconnect)
 		c.oboundP <- &PacketAndToken{p: dm, t: dt}
 
 		// wait for work to finish, or quiesce time consumed
@@ -579,14 +812,15 @@ func (c *client) internalConnLost(err error) {
 		c.closeStop()
 		c.conn.Close()
 		c.workers.Wait()
+		c.finishReauth(err)
 		if c.options.CleanSession && !c.options.AutoReconnect {
 			c.messageIds.cleanUp()
 		}
 		if c.options.AutoReconnect {
-			c.setConnected(reconnecting)
+			c.changeState(reconnecting, ConnectionEvent{Cause: err})
 			go c.reconnect()
 		} else {
-			c.setConnected(disconnected)
+			c.changeState(disconnected, ConnectionEvent{Cause: err})
 		}
 		if c.options.OnConnectionLost != nil {
 			go c.options.OnConnectionLost(c, err)
@@ -633,6 +867,10 @@ func (c *client) disconnect() {
 	c.closeConn()
 	c.workers.Wait()
 	c.messageIds.cleanUp()
+	c.finishReauth(ErrNotConnected)
+	if c.offline != nil {
+		c.offline.clear(ErrNotConnected)
+	}
 	c.closeStopRouter()
 	DEBUG.Println(CLI, "disconnected")
 	c.persist.Close()
@@ -642,32 +880,54 @@ func (c *client) disconnect() {
 // to the specified topic.
 // Returns a token to track delivery of the message to the broker
 func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
-	token := newToken(packets.Publish).(*PublishToken)
+	return c.publish(context.Background(), topic, qos, retained, payload, nil)
+}
+
+// PublishWithOptions will publish a message with the specified QoS and
+// content to the specified topic. The options are sent as properties of the
+// message when connected with MQTT 5 and are dropped otherwise.
+// Returns a token to track delivery of the message to the broker
+func (c *client) PublishWithOptions(topic string, qos byte, retained bool, payload interface{}, opts PublishOptions) Token {
+	return c.publish(context.Background(), topic, qos, retained, payload, opts.properties())
+}
+
+// PublishContext will publish a message like Publish and wait for it to be
+// delivered to the broker. When the context is done before the message was
+// sent it is forgotten, its message ID is released and it is removed from
+// the store. Otherwise the delivery goes on and the context error is returned.
+func (c *client) PublishContext(ctx context.Context, topic string, qos byte, retained bool, payload interface{}) error {
+	token := c.publish(ctx, topic, qos, retained, payload, nil).(*PublishToken)
+	select {
+	case <-token.complete:
+		return token.Error()
+	case <-ctx.Done():
+	}
+
+	// a publish waiting in the in-flight window was not sent yet
+	if c.inflight.remove(token) {
+		c.cancelUnsent(token.messageID, token, ctx.Err())
+	}
+	return ctx.Err()
+}
+
+func (c *client) publish(ctx context.Context, topic string, qos byte, retained bool, payload interface{}, props *packets.Properties) Token {
+	token := c.newToken(packets.Publish).(*PublishToken)
 	DEBUG.Println(CLI, "enter Publish")
+	status := c.connectionStatus()
 	switch {
 	case !c.IsConnected():
 		token.setError(ErrNotConnected)
 		return token
-	case c.connectionStatus() == reconnecting && qos == 0:
+	case status == reconnecting && qos == 0 && c.offline == nil:
 		token.flowComplete()
 		return token
 	}
 
-	mac := parseTopicMac(topic)
-	DEBUG.Println(CLI, "parsed MAC = "+mac)
-
-	// for QoS >= 1 we can bypass the Hermes timer algorithm, otherwise -
-	// drop the packet if the timer for a particular MAC device does not allow
-	// publishing packets.
-	if c.useHermes && qos < 1 && !c.hermes.GetCanSend(c, mac) {
-		token.setError(fmt.Errorf("QoS too small or send disabled"))
-		return token
-	}
-
 	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
 	pub.Qos = qos
 	pub.TopicName = topic
 	pub.Retain = retained
+	pub.Properties = props
 	switch p := payload.(type) {
 	case string:
 		pub.Payload = []byte(p)
@@ -680,26 +940,70 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		return token
 	}
 
+	// requests and uploads to Hades are sent by hermes itself and are not
+	// a part of the device traffic.
+	if c.useHermes && !strings.HasPrefix(topic, hadesPrefix) {
+		mac := parseTopicMac(topic)
+		DEBUG.Println(CLI, "parsed MAC = "+mac)
+
+		// drop the packet if the timer for a particular MAC device does not
+		// allow publishing packets, the priority class of the topic (or a
+		// QoS >= 1 when no priorities are set) can bypass the timer.
+		err := c.hermes.allowPublish(c, topic, mac, qos)
+		c.hermes.recordPublish(mac, len(pub.Payload), err == nil)
+		if err != nil {
+			token.setError(err)
+			return token
+		}
+	}
+
 	if pub.Qos != 0 && pub.MessageID == 0 {
 		pub.MessageID = c.getID(token)
 		token.messageID = pub.MessageID
 	}
 	persistOutbound(c.persist, pub)
-	switch c.connectionStatus() {
+	switch status {
 	case connecting:
 		DEBUG.Println(CLI, "storing publish message (connecting), topic:", topic)
 	case reconnecting:
+		if pub.Qos == 0 {
+			if c.offline == nil {
+				token.flowComplete()
+				break
+			}
+			c.offline.push(pub, token)
+			// the connection may have come back before the message was
+			// queued, it is then sent right away.
+			if c.connectionStatus() == connected {
+				go c.flushOffline()
+			}
+			break
+		}
 		DEBUG.Println(CLI, "storing publish message (reconnecting), topic:", topic)
 	default:
+		// the messages queued while offline are sent first.
+		if pub.Qos == 0 && c.offline != nil && c.offline.pushIfDraining(pub, token) {
+			go c.flushOffline()
+			break
+		}
 		DEBUG.Println(CLI, "sending publish message, topic:", topic)
-		publishWaitTimeout := c.options.WriteTimeout
-		if publishWaitTimeout == 0 {
-			publishWaitTimeout = time.Second * 30
+		pt := &PacketAndToken{p: pub, t: token}
+		if pub.Qos != 0 && !c.inflight.acquire(pt) {
+			DEBUG.Println(CLI, "in-flight window is full, queued publish, id:", pub.MessageID)
+			break
 		}
 		select {
-		case c.obound <- &PacketAndToken{p: pub, t: token}:
-		case <-time.After(publishWaitTimeout):
+		case c.obound <- pt:
+		case <-c.sendTimeout(ctx):
+			if pub.Qos != 0 {
+				go c.releaseInflight()
+			}
 			token.setError(errors.New("publish was broken by timeout"))
+		case <-ctx.Done():
+			if pub.Qos != 0 {
+				go c.releaseInflight()
+			}
+			c.cancelUnsent(pub.MessageID, token, ctx.Err())
 		}
 	}
 	return token
@@ -708,7 +1012,34 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 // Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 // a message is published on the topic provided.
 func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Token {
-	token := newToken(packets.Subscribe).(*SubscribeToken)
+	return c.subscribe(context.Background(), topic, SubscribeOptions{QoS: qos}, callback)
+}
+
+// SubscribeWithOptions starts a new subscription using the MQTT 5
+// subscription options, only the QoS is used with older protocol versions.
+// Messages carrying subscription identifiers are passed to this callback
+// only if one of them is the identifier of the options, the callbacks of
+// subscriptions without an identifier still match them by their topic.
+func (c *client) SubscribeWithOptions(topic string, opts SubscribeOptions, callback MessageHandler) Token {
+	return c.subscribe(context.Background(), topic, opts, callback)
+}
+
+// SubscribeContext starts a new subscription like Subscribe and waits for
+// the broker to acknowledge it. When the context is done before the
+// subscribe was sent it is forgotten, otherwise the context error is
+// returned while the subscription goes on.
+func (c *client) SubscribeContext(ctx context.Context, topic string, qos byte, callback MessageHandler) error {
+	token := c.subscribe(ctx, topic, SubscribeOptions{QoS: qos}, callback).(*SubscribeToken)
+	select {
+	case <-token.complete:
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *client) subscribe(ctx context.Context, topic string, opts SubscribeOptions, callback MessageHandler) Token {
+	token := c.newToken(packets.Subscribe).(*SubscribeToken)
 	DEBUG.Println(CLI, "enter Subscribe")
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
@@ -727,12 +1058,19 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		}
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if err := validateTopicAndQos(topic, qos); err != nil {
+	if err := validateTopicAndQos(topic, opts.QoS); err != nil {
+		token.setError(err)
+		return token
+	}
+	if err := opts.validate(); err != nil {
 		token.setError(err)
 		return token
 	}
 	sub.Topics = append(sub.Topics, topic)
-	sub.Qoss = append(sub.Qoss, qos)
+	sub.Qoss = append(sub.Qoss, opts.options())
+	if opts.SubscriptionIdentifier != 0 {
+		sub.Properties = &packets.Properties{SubscriptionIdentifier: []int{opts.SubscriptionIdentifier}}
+	}
 
 	if strings.HasPrefix(topic, "$share/") {
 		topic = strings.Join(strings.Split(topic, "/")[2:], "/")
@@ -744,13 +1082,14 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 
 	// will check whether the subscribe came from the client using the library
 	// or an internal call.
+	var added, replaced *route
 	if strings.HasPrefix(topic, hermesPrefix) {
 		if callback != nil && c.useHermes {
 			c.msgRouter.addHermesRoute(topic, callback)
 		}
 	} else {
 		if callback != nil {
-			c.msgRouter.addRoute(topic, callback)
+			added, replaced = c.msgRouter.putRoute(topic, opts.SubscriptionIdentifier, callback)
 		}
 	}
 
@@ -770,14 +1109,16 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		DEBUG.Println(CLI, "storing subscribe message (reconnecting), topic:", topic)
 	default:
 		DEBUG.Println(CLI, "sending subscribe message, topic:", topic)
-		subscribeWaitTimeout := c.options.WriteTimeout
-		if subscribeWaitTimeout == 0 {
-			subscribeWaitTimeout = time.Second * 30
-		}
 		select {
 		case c.oboundP <- &PacketAndToken{p: sub, t: token}:
-		case <-time.After(subscribeWaitTimeout):
+		case <-c.sendTimeout(ctx):
 			token.setError(errors.New("subscribe was broken by timeout"))
+		case <-ctx.Done():
+			// the handler of an earlier subscription to the topic is kept.
+			if added != nil {
+				c.msgRouter.undoRoute(added, replaced)
+			}
+			c.cancelUnsent(sub.MessageID, token, ctx.Err())
 		}
 	}
 	DEBUG.Println(CLI, "exit Subscribe")
@@ -786,9 +1127,11 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 
 // SubscribeMultiple starts a new subscription for multiple topics. Provide a MessageHandler to
 // be executed when a message is published on one of the topics provided.
+// It sends no subscription options, SubscribeWithOptions is used for each
+// topic which needs them.
 func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHandler) Token {
 	var err error
-	token := newToken(packets.Subscribe).(*SubscribeToken)
+	token := c.newToken(packets.Subscribe).(*SubscribeToken)
 	DEBUG.Println(CLI, "enter SubscribeMultiple")
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
@@ -838,7 +1181,7 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		}
 		select {
 		case c.oboundP <- &PacketAndToken{p: sub, t: token}:
-		case <-time.After(subscribeWaitTimeout):
+		case <-c.options.Clock.After(subscribeWaitTimeout):
 			token.setError(errors.New("subscribe was broken by timeout"))
 		}
 	}
@@ -886,7 +1229,7 @@ func (c *client) resume(subscription bool) {
 				if subscription {
 					DEBUG.Println(STR, fmt.Sprintf("loaded pending subscribe (%d)", details.MessageID))
 					subPacket := packet.(*packets.SubscribePacket)
-					token := newToken(packets.Subscribe).(*SubscribeToken)
+					token := c.newToken(packets.Subscribe).(*SubscribeToken)
 					token.messageID = details.MessageID
 					token.subs = append(token.subs, subPacket.Topics...)
 					c.claimID(token, details.MessageID)
@@ -899,7 +1242,7 @@ func (c *client) resume(subscription bool) {
 			case *packets.UnsubscribePacket:
 				if subscription {
 					DEBUG.Println(STR, fmt.Sprintf("loaded pending unsubscribe (%d)", details.MessageID))
-					token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
+					token := c.newToken(packets.Unsubscribe).(*UnsubscribeToken)
 					select {
 					case c.oboundP <- &PacketAndToken{p: packet, t: token}:
 					case <-c.stop:
@@ -908,19 +1251,25 @@ func (c *client) resume(subscription bool) {
 				}
 			case *packets.PubrelPacket:
 				DEBUG.Println(STR, fmt.Sprintf("loaded pending pubrel (%d)", details.MessageID))
+				c.inflight.track()
 				select {
 				case c.oboundP <- &PacketAndToken{p: packet, t: nil}:
 				case <-c.stop:
 					return
 				}
 			case *packets.PublishPacket:
-				token := newToken(packets.Publish).(*PublishToken)
+				token := c.newToken(packets.Publish).(*PublishToken)
 				token.messageID = details.MessageID
 				c.claimID(token, details.MessageID)
 				DEBUG.Println(STR, fmt.Sprintf("loaded pending publish (%d)", details.MessageID))
 				DEBUG.Println(STR, details)
+				pt := &PacketAndToken{p: packet, t: token}
+				if !c.inflight.acquire(pt) {
+					DEBUG.Println(STR, "in-flight window is full, queued publish")
+					break
+				}
 				select {
-				case c.obound <- &PacketAndToken{p: packet, t: token}:
+				case c.obound <- pt:
 				case <-c.stop:
 					return
 				}
@@ -949,7 +1298,25 @@ func (c *client) resume(subscription bool) {
 // Messages published to those topics from other clients will no longer be
 // received.
 func (c *client) Unsubscribe(topics ...string) Token {
-	token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
+	return c.unsubscribe(context.Background(), topics...)
+}
+
+// UnsubscribeContext will end the subscriptions like Unsubscribe and wait
+// for the broker to acknowledge it. When the context is done before the
+// unsubscribe was sent it is forgotten, otherwise the context error is
+// returned while the unsubscribe goes on.
+func (c *client) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	token := c.unsubscribe(ctx, topics...).(*UnsubscribeToken)
+	select {
+	case <-token.complete:
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *client) unsubscribe(ctx context.Context, topics ...string) Token {
+	token := c.newToken(packets.Unsubscribe).(*UnsubscribeToken)
 	DEBUG.Println(CLI, "enter Unsubscribe")
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
@@ -985,17 +1352,15 @@ func (c *client) Unsubscribe(topics ...string) Token {
 		DEBUG.Println(CLI, "storing unsubscribe message (reconnecting), topics:", topics)
 	default:
 		DEBUG.Println(CLI, "sending unsubscribe message, topics:", topics)
-		subscribeWaitTimeout := c.options.WriteTimeout
-		if subscribeWaitTimeout == 0 {
-			subscribeWaitTimeout = time.Second * 30
-		}
 		select {
 		case c.oboundP <- &PacketAndToken{p: unsub, t: token}:
 			for _, topic := range topics {
 				c.msgRouter.deleteRoute(topic)
 			}
-		case <-time.After(subscribeWaitTimeout):
+		case <-c.sendTimeout(ctx):
 			token.setError(errors.New("unsubscribe was broken by timeout"))
+		case <-ctx.Done():
+			c.cancelUnsent(unsub.MessageID, token, ctx.Err())
 		}
 	}
 
@@ -1020,3 +1385,68 @@ func (c *client) HermesReader() *ClientHermesReader {
 func DefaultConnectionLostHandler(client Client, reason error) {
 	DEBUG.Println("Connection lost:", reason.Error())
 }
+
+// sendTimeout returns the channel of the timeout for handing a packet to
+// the outgoing routine. Only the calls without a context use a timeout,
+// context.Background has a nil Done channel.
+func (c *client) sendTimeout(ctx context.Context) <-chan time.Time {
+	if ctx.Done() != nil {
+		return nil
+	}
+	timeout := c.options.WriteTimeout
+	if timeout == 0 {
+		timeout = time.Second * 30
+	}
+	return c.options.Clock.After(timeout)
+}
+
+// newToken returns a token which uses the Clock of the client.
+func (c *client) newToken(tType byte) tokenCompletor {
+	return newClockToken(tType, c.options.Clock)
+}
+
+// cancelUnsent will forget a packet which was not sent because its context
+// was done, the message ID is released and the packet is removed from the
+// store.
+func (c *client) cancelUnsent(id uint16, token tokenCompletor, err error) {
+	if id != 0 {
+		c.persist.Del(outboundKeyFromMID(id))
+		c.freeID(id)
+	}
+	token.setError(err)
+}
+
+// closeOnDone will close the connection if the context is done before the
+// returned function is called, which unblocks the connect handshake.
+func (c *client) closeOnDone(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.closeConn()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// contextTimeout returns the timeout shortened to the deadline of the
+// context, if it has an earlier one.
+func contextTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	if until := time.Until(deadline); timeout == 0 || until < timeout {
+		if until <= 0 {
+			// a zero timeout would mean no timeout at all
+			return time.Nanosecond
+		}
+		return until
+	}
+	return timeout
+}
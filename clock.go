@@ -0,0 +1,62 @@
+package mqtt
+
+import "time"
+
+// Clock is the source of time of a client. The keepalive, the connect and
+// reconnect backoff, the timeouts of the tokens and the send windows of
+// hermes all use it, so a fake clock such as the one of the mqtttest package
+// can drive them in tests. The deadlines of the network connection always
+// use the system clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+	NewTicker(d time.Duration) ClockTicker
+	After(d time.Duration) <-chan time.Time
+}
+
+// ClockTimer is a timer created by a Clock, it behaves like a time.Timer.
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// ClockTicker is a ticker created by a Clock, it behaves like a
+// time.Ticker.
+type ClockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of the time package, it is used when no other
+// Clock is set.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (systemClock) NewTimer(d time.Duration) ClockTimer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) ClockTicker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// clockOr returns the clock, or the SystemClock if it is nil.
+func clockOr(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
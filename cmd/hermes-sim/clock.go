@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	MQTT "github.com/aretas77/paho.mqtt.golang"
+	"github.com/aretas77/paho.mqtt.golang/mqtttest"
+)
+
+// virtualClock is the Clock of the devices. Its time only moves once every
+// device is asleep and no answer of Hades is being sent, it then jumps to the
+// earliest wake up, so a day of device traffic is simulated as fast as the
+// devices can run. The hermes send windows of the devices run on it as well.
+type virtualClock struct {
+	*mqtttest.FakeClock
+	start time.Time
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// running is the number of devices and Hades answers which are not
+	// asleep, the time waits for them.
+	running  int
+	sleepers []time.Time
+	tickers  int
+}
+
+// newVirtualClock will create a virtual clock started at the current time.
+func newVirtualClock() *virtualClock {
+	now := time.Now()
+	c := &virtualClock{FakeClock: mqtttest.NewFakeClock(now), start: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// NewTicker will count the tickers created, hermes creates one for each
+// send interval it receives.
+func (c *virtualClock) NewTicker(d time.Duration) MQTT.ClockTicker {
+	t := c.FakeClock.NewTicker(d)
+	c.mu.Lock()
+	c.tickers++
+	c.mu.Unlock()
+	return t
+}
+
+// waitTickers will wait until n tickers were created, or fail after the
+// given real time.
+func (c *virtualClock) waitTickers(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		created := c.tickers
+		c.mu.Unlock()
+		if created >= n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// now will return the virtual time passed since the start of the simulation.
+func (c *virtualClock) now() time.Duration {
+	return c.FakeClock.Now().Sub(c.start)
+}
+
+// join will hold the time until leave is called.
+func (c *virtualClock) join() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running++
+}
+
+func (c *virtualClock) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	c.cond.Broadcast()
+}
+
+// sleep will block until the time has moved by the given virtual duration,
+// the caller must have joined.
+func (c *virtualClock) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until := c.FakeClock.Now().Add(d)
+	c.sleepers = append(c.sleepers, until)
+	c.running--
+	c.cond.Broadcast()
+	for c.FakeClock.Now().Before(until) {
+		c.cond.Wait()
+	}
+}
+
+// run will move the time from one wake up to the next, until nobody has
+// joined and nobody sleeps.
+func (c *virtualClock) run() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for c.running > 0 {
+			c.cond.Wait()
+		}
+		if len(c.sleepers) == 0 {
+			return
+		}
+
+		next := c.sleepers[0]
+		for _, until := range c.sleepers[1:] {
+			if until.Before(next) {
+				next = until
+			}
+		}
+		c.FakeClock.Advance(next.Sub(c.FakeClock.Now()))
+
+		// the sleepers which wake up are running again.
+		asleep := c.sleepers[:0]
+		for _, until := range c.sleepers {
+			if until.After(next) {
+				asleep = append(asleep, until)
+			} else {
+				c.running++
+			}
+		}
+		c.sleepers = asleep
+		c.cond.Broadcast()
+	}
+}
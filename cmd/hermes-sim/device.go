@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	MQTT "github.com/aretas77/paho.mqtt.golang"
+)
+
+// device is a virtual battery powered device which produces readings from
+// its trace and publishes them through hermes. Readings which are dropped by
+// hermes are kept and sent with the next allowed publish.
+type device struct {
+	sync.Mutex
+	id          int
+	mac         string
+	client      MQTT.Client
+	hermes      *MQTT.ClientHermesReader
+	trace       trace
+	rng         *rand.Rand
+	capacityMah float64
+	leftMah     float64
+	pending     []time.Duration
+	readings    int
+	sends       int
+	drops       int
+	latencies   []time.Duration
+	died        time.Duration
+}
+
+// newDevice will create a virtual device with the given battery capacity.
+func newDevice(id int, t trace, capacityMah float64, seed int64) *device {
+	return &device{
+		id:          id,
+		mac:         fmt.Sprintf("02:00:00:00:%02X:%02X", id>>8&0xff, id&0xff),
+		trace:       t,
+		rng:         rand.New(rand.NewSource(seed)),
+		capacityMah: capacityMah,
+		leftMah:     capacityMah,
+	}
+}
+
+// connect will connect the device to the broker with hermes enabled. The
+// client runs on the virtual clock without a keepalive, the pings would
+// follow the virtual time while the broker answers in real time.
+func (d *device) connect(broker string, clock *virtualClock) error {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(d.clientID())
+	opts.SetAutoReconnect(false)
+	opts.SetClock(clock)
+	opts.SetKeepAlive(0)
+	opts.SetUseHermes(true)
+	opts.SetDeviceMac(d.mac)
+	opts.SetTotalBatteryMah(float32(d.capacityMah))
+	opts.SetBatteryLeftMah(float32(d.leftMah))
+
+	d.client = MQTT.NewClient(opts)
+	if token := d.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	d.hermes = d.client.HermesReader()
+
+	return nil
+}
+
+func (d *device) clientID() string {
+	return fmt.Sprintf("hermes-sim-%d", d.id)
+}
+
+// batteryLeft will return the part of the battery that is left.
+func (d *device) batteryLeft() float64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.leftMah / d.capacityMah
+}
+
+// run will produce readings until the simulation ends or the battery of the
+// device is empty.
+func (d *device) run(clock *virtualClock, cfg *config, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer clock.leave()
+
+	last := clock.now()
+	for {
+		clock.sleep(d.trace.next(d.rng))
+		now := clock.now()
+		if now >= cfg.duration {
+			d.use(cfg.idleEnergy * (cfg.duration - last).Hours())
+			return
+		}
+
+		d.use(cfg.idleEnergy * (now - last).Hours())
+		last = now
+		if d.empty(now) {
+			return
+		}
+
+		d.Lock()
+		d.pending = append(d.pending, now)
+		d.readings++
+		d.Unlock()
+
+		d.flush(clock, cfg)
+	}
+}
+
+// flush will try to publish all of the pending readings at once.
+func (d *device) flush(clock *virtualClock, cfg *config) {
+	d.Lock()
+	size := len(d.pending) * cfg.readingSize
+	d.Unlock()
+
+	topic := fmt.Sprintf("sim/%s/data", d.mac)
+	token := d.client.Publish(topic, 0, false, make([]byte, size))
+	token.Wait()
+	now := clock.now()
+
+	d.Lock()
+	defer d.Unlock()
+
+	if token.Error() != nil {
+		d.drops++
+		return
+	}
+
+	d.sends++
+	for _, produced := range d.pending {
+		d.latencies = append(d.latencies, now-produced)
+	}
+	d.pending = d.pending[:0]
+	d.leftMah -= cfg.sendEnergy + float64(size)*cfg.byteEnergy
+	d.hermes.CallSetBatteryLeftMah(float32(d.leftMah))
+}
+
+// use will drain the given energy from the battery.
+func (d *device) use(mah float64) {
+	d.Lock()
+	defer d.Unlock()
+	d.leftMah -= mah
+}
+
+// empty will check whether the battery of the device is empty and record
+// the time at which it died.
+func (d *device) empty(now time.Duration) bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.leftMah > 0 {
+		return false
+	}
+	if d.died == 0 {
+		d.died = now
+	}
+	return true
+}
+
+func (d *device) disconnect() {
+	if d.client != nil {
+		d.client.Disconnect(250)
+	}
+}
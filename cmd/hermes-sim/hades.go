@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	MQTT "github.com/aretas77/paho.mqtt.golang"
+)
+
+// hades is a stand-in for the Hades server. It answers the interval and model
+// requests of the devices using the configured policy.
+type hades struct {
+	client   MQTT.Client
+	clock    *virtualClock
+	policy   string
+	interval time.Duration
+	model    []byte
+	manifest []byte
+	devices  map[string]*device
+}
+
+// connect will connect Hades to the broker and subscribe to the requests.
+func (h *hades) connect(broker string) error {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID("hermes-sim-hades")
+	opts.SetAutoReconnect(false)
+
+	h.client = MQTT.NewClient(opts)
+	if token := h.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	subs := map[string]MQTT.MessageHandler{
+		"hades/global/+/interval/request": h.handleRequest,
+		"hades/global/+/model/request":    h.handleRequest,
+	}
+	for topic, handler := range subs {
+		if token := h.client.Subscribe(topic, 1, handler); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+
+	return nil
+}
+
+// start will send the first interval or model to the device. The answers
+// are retained, so a device which has not subscribed yet receives them as
+// soon as it does.
+func (h *hades) start(d *device) error {
+	if h.policy == "model" {
+		return h.sendModel(d.mac)
+	}
+	return h.sendInterval(d.mac)
+}
+
+// receiveTopic will return the topic on which the device receives the
+// answers of Hades.
+func (h *hades) receiveTopic(mac string) string {
+	if h.policy == "model" {
+		return fmt.Sprintf("hermes/node/global/%s/hades/model/receive", mac)
+	}
+	return fmt.Sprintf("hermes/node/global/%s/hades/interval/receive", mac)
+}
+
+func (h *hades) handleRequest(c MQTT.Client, msg MQTT.Message) {
+	tok := strings.Split(msg.Topic(), "/")
+	if len(tok) < 3 {
+		return
+	}
+	d, ok := h.devices[tok[2]]
+	if !ok {
+		return
+	}
+
+	// waiting for the answer to be sent inside of a handler would block the
+	// client from receiving the acknowledgement. The virtual time waits for
+	// the answer.
+	h.clock.join()
+	go func() {
+		defer h.clock.leave()
+		if err := h.start(d); err != nil {
+			fmt.Println("hades failed to answer request:", err)
+		}
+	}()
+}
+
+// intervalFor will return the virtual send interval of the device under the
+// configured policy.
+func (h *hades) intervalFor(d *device) time.Duration {
+	switch h.policy {
+	case "battery":
+		// send less often as the battery drains, up to ten times slower.
+		left := d.batteryLeft()
+		if left < 0.1 {
+			left = 0.1
+		}
+		return time.Duration(float64(h.interval) / left)
+	default:
+		return h.interval
+	}
+}
+
+func (h *hades) sendInterval(mac string) error {
+	d, ok := h.devices[mac]
+	if !ok {
+		return fmt.Errorf("unknown device %s", mac)
+	}
+
+	payload, err := json.Marshal(MQTT.SendIntervalPayload{
+		MAC:          mac,
+		SendInterval: float32(h.intervalFor(d).Minutes()),
+	})
+	if err != nil {
+		return err
+	}
+
+	token := h.client.Publish(h.receiveTopic(mac), 1, true, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (h *hades) sendModel(mac string) error {
+	topic := fmt.Sprintf("hermes/node/global/%s/hades/manifest/receive", mac)
+	if token := h.client.Publish(topic, 1, true, h.manifest); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	token := h.client.Publish(h.receiveTopic(mac), 1, true, h.model)
+	token.Wait()
+	return token.Error()
+}
+
+func (h *hades) disconnect() {
+	if h.client != nil {
+		h.client.Disconnect(250)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	MQTT "github.com/aretas77/paho.mqtt.golang"
+	"github.com/aretas77/paho.mqtt.golang/broker"
+)
+
+/*
+hermes-sim runs a fleet of virtual devices against an in-process broker and
+a Hades stand-in to compare hermes send interval policies offline.
+
+Options:
+ [-help]                          Display help
+ [-devices <number>]              Number of virtual devices
+ [-duration <duration>]           Simulated (virtual) time
+ [-trace periodic|poisson|burst]  Sensor trace of the devices
+ [-period <duration>]             Mean time between readings
+ [-size <bytes>]                  Size of a single reading
+ [-battery <mAh>]                 Battery capacity of a device
+ [-battery-spread <part>]         Random spread of battery capacities
+ [-send-energy <mAh>]             Energy used by a single publish
+ [-byte-energy <mAh>]             Energy used by each byte of a publish
+ [-idle-energy <mAh>]             Energy used per hour while idle
+ [-policy fixed|battery|model]    Send interval policy used by Hades
+ [-interval <duration>]           Send interval of the fixed and battery policies
+ [-model <path>]                  Model sent by the model policy
+ [-manifest <path>]               Manifest of the model
+ [-seed <number>]                 Seed of the random generator
+ [-json]                          Write the report as JSON
+*/
+
+// config contains the settings of a simulation.
+type config struct {
+	devices       int
+	duration      time.Duration
+	trace         string
+	period        time.Duration
+	readingSize   int
+	battery       float64
+	batterySpread float64
+	sendEnergy    float64
+	byteEnergy    float64
+	idleEnergy    float64
+	policy        string
+	interval      time.Duration
+	model         string
+	manifest      string
+	seed          int64
+	json          bool
+}
+
+func main() {
+	cfg := &config{}
+	flag.IntVar(&cfg.devices, "devices", 10, "The number of virtual devices")
+	flag.DurationVar(&cfg.duration, "duration", 24*time.Hour, "The simulated time")
+	flag.StringVar(&cfg.trace, "trace", "periodic", "The sensor trace: periodic, poisson or burst")
+	flag.DurationVar(&cfg.period, "period", time.Minute, "The mean time between readings")
+	flag.IntVar(&cfg.readingSize, "size", 32, "The size of a single reading in bytes")
+	flag.Float64Var(&cfg.battery, "battery", 2000, "The battery capacity of a device in mAh")
+	flag.Float64Var(&cfg.batterySpread, "battery-spread", 0.2, "The random spread of battery capacities")
+	flag.Float64Var(&cfg.sendEnergy, "send-energy", 0.05, "The energy used by a single publish in mAh")
+	flag.Float64Var(&cfg.byteEnergy, "byte-energy", 0.0001, "The energy used by each published byte in mAh")
+	flag.Float64Var(&cfg.idleEnergy, "idle-energy", 0.5, "The energy used per hour while idle in mAh")
+	flag.StringVar(&cfg.policy, "policy", "fixed", "The send interval policy: fixed, battery or model")
+	flag.DurationVar(&cfg.interval, "interval", 5*time.Minute, "The send interval of the fixed and battery policies")
+	flag.StringVar(&cfg.model, "model", "", "The model sent to the devices by the model policy")
+	flag.StringVar(&cfg.manifest, "manifest", "", "The manifest of the model")
+	flag.Int64Var(&cfg.seed, "seed", 1, "The seed of the random generator")
+	flag.BoolVar(&cfg.json, "json", false, "Write the report as JSON")
+	flag.Parse()
+
+	if err := run(cfg); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// brokerAddr is the address of the in-process broker of the simulation.
+const brokerAddr = "mem://hermes-sim"
+
+func run(cfg *config) error {
+	if cfg.devices <= 0 {
+		return fmt.Errorf("invalid setting for -devices, must be positive")
+	}
+
+	rng := rand.New(rand.NewSource(cfg.seed))
+	clock := newVirtualClock()
+
+	h := &hades{
+		clock:    clock,
+		policy:   cfg.policy,
+		interval: cfg.interval,
+		devices:  make(map[string]*device),
+	}
+	switch cfg.policy {
+	case "fixed", "battery":
+	case "model":
+		if cfg.model == "" || cfg.manifest == "" {
+			return fmt.Errorf("the model policy requires -model and -manifest")
+		}
+		model, err := ioutil.ReadFile(cfg.model)
+		if err != nil {
+			return err
+		}
+		manifest, err := ioutil.ReadFile(cfg.manifest)
+		if err != nil {
+			return err
+		}
+		h.model, h.manifest = model, manifest
+	default:
+		return fmt.Errorf("invalid setting for -policy, must be fixed, battery or model")
+	}
+
+	b := broker.New()
+	defer b.Close()
+	l, err := MQTT.ListenMem("hermes-sim")
+	if err != nil {
+		return err
+	}
+	go b.Serve(l)
+
+	devices := make([]*device, cfg.devices)
+	for i := range devices {
+		t, err := newTrace(cfg.trace, cfg.period)
+		if err != nil {
+			return err
+		}
+		capacity := cfg.battery * (1 + cfg.batterySpread*(2*rng.Float64()-1))
+		devices[i] = newDevice(i, t, capacity, rng.Int63())
+		h.devices[devices[i].mac] = devices[i]
+	}
+
+	if err := h.connect(brokerAddr); err != nil {
+		return err
+	}
+	defer h.disconnect()
+
+	for i, d := range devices {
+		if err := h.start(d); err != nil {
+			return err
+		}
+		if err := d.connect(brokerAddr, clock); err != nil {
+			return err
+		}
+		defer d.disconnect()
+
+		// hermes starts a ticker for the send interval of the device.
+		if !clock.waitTickers(i+1, 5*time.Second) {
+			return fmt.Errorf("device %s did not receive its first interval", d.mac)
+		}
+	}
+
+	// start the simulation only once every device has its first interval.
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		wg.Add(1)
+		clock.join()
+		go d.run(clock, cfg, &wg)
+	}
+	clock.run()
+	wg.Wait()
+
+	r := newReport(cfg, devices)
+	if cfg.json {
+		return r.writeJSON(os.Stdout)
+	}
+	r.writeText(os.Stdout)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// deviceReport contains the results of the simulation for a single device.
+type deviceReport struct {
+	MAC            string        `json:"mac"`
+	Readings       int           `json:"readings"`
+	Sends          int           `json:"sends"`
+	Drops          int           `json:"drops"`
+	MeanLatency    time.Duration `json:"mean_latency"`
+	P95Latency     time.Duration `json:"p95_latency"`
+	UsedMah        float64       `json:"used_mah"`
+	ProjectedLife  time.Duration `json:"projected_life"`
+	BatteryDiedAt  time.Duration `json:"battery_died_at,omitempty"`
+	PendingOnClose int           `json:"pending_on_close"`
+}
+
+// report contains the results of the whole simulation.
+type report struct {
+	Policy   string          `json:"policy"`
+	Duration time.Duration   `json:"duration"`
+	Devices  []*deviceReport `json:"devices"`
+	Total    deviceReport    `json:"total"`
+}
+
+// newReport will gather the results of all of the devices.
+func newReport(cfg *config, devices []*device) *report {
+	r := &report{Policy: cfg.policy, Duration: cfg.duration}
+
+	var all []time.Duration
+	for _, d := range devices {
+		d.Lock()
+		dr := &deviceReport{
+			MAC:            d.mac,
+			Readings:       d.readings,
+			Sends:          d.sends,
+			Drops:          d.drops,
+			MeanLatency:    mean(d.latencies),
+			P95Latency:     percentile(d.latencies, 0.95),
+			UsedMah:        d.capacityMah - d.leftMah,
+			ProjectedLife:  projectedLife(d.capacityMah, d.capacityMah-d.leftMah, cfg.duration),
+			BatteryDiedAt:  d.died,
+			PendingOnClose: len(d.pending),
+		}
+		all = append(all, d.latencies...)
+		d.Unlock()
+
+		r.Devices = append(r.Devices, dr)
+		r.Total.Readings += dr.Readings
+		r.Total.Sends += dr.Sends
+		r.Total.Drops += dr.Drops
+		r.Total.UsedMah += dr.UsedMah
+		r.Total.PendingOnClose += dr.PendingOnClose
+	}
+
+	r.Total.MAC = "total"
+	r.Total.MeanLatency = mean(all)
+	r.Total.P95Latency = percentile(all, 0.95)
+	if len(devices) > 0 {
+		var capacity float64
+		for _, d := range devices {
+			capacity += d.capacityMah
+		}
+		r.Total.ProjectedLife = projectedLife(capacity, r.Total.UsedMah, cfg.duration)
+	}
+
+	return r
+}
+
+// projectedLife will project how long a battery lasts if the energy keeps
+// being used at the same rate as during the simulation.
+func projectedLife(capacityMah float64, usedMah float64, d time.Duration) time.Duration {
+	if usedMah <= 0 {
+		return 0
+	}
+	return time.Duration(capacityMah / usedMah * float64(d))
+}
+
+func mean(values []time.Duration) time.Duration {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, v := range values {
+		sum += v
+	}
+	return sum / time.Duration(len(values))
+}
+
+func percentile(values []time.Duration, p float64) time.Duration {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// writeText will write the report as a table.
+func (r *report) writeText(w io.Writer) {
+	fmt.Fprintf(w, "policy: %s, simulated: %s\n\n", r.Policy, r.Duration)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "device\treadings\tsends\tdrops\tmean latency\tp95 latency\tused mAh\tprojected life\tdied at")
+	for _, d := range append(r.Devices, &r.Total) {
+		died := "-"
+		if d.BatteryDiedAt != 0 {
+			died = d.BatteryDiedAt.Round(time.Minute).String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%.2f\t%s\t%s\n", d.MAC, d.Readings,
+			d.Sends, d.Drops, d.MeanLatency.Round(time.Second), d.P95Latency.Round(time.Second),
+			d.UsedMah, d.ProjectedLife.Round(time.Hour), died)
+	}
+	tw.Flush()
+}
+
+// writeJSON will write the report as JSON.
+func (r *report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
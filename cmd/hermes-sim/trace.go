@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// trace generates the times at which a virtual device produces a reading.
+type trace interface {
+	// next will return the virtual time until the next reading.
+	next(rng *rand.Rand) time.Duration
+}
+
+// periodicTrace produces a reading every period.
+type periodicTrace struct {
+	period time.Duration
+}
+
+func (t periodicTrace) next(rng *rand.Rand) time.Duration {
+	return t.period
+}
+
+// poissonTrace produces readings at random with the given mean period.
+type poissonTrace struct {
+	period time.Duration
+}
+
+func (t poissonTrace) next(rng *rand.Rand) time.Duration {
+	return time.Duration(rng.ExpFloat64() * float64(t.period))
+}
+
+// burstTrace produces bursts of readings separated by long pauses, like a
+// sensor reporting only while something is happening.
+type burstTrace struct {
+	period time.Duration
+	burst  int
+	left   int
+}
+
+func (t *burstTrace) next(rng *rand.Rand) time.Duration {
+	if t.left > 0 {
+		t.left--
+		return t.period / 10
+	}
+	t.left = rng.Intn(t.burst) + 1
+	return time.Duration(rng.ExpFloat64() * float64(t.period) * float64(t.burst))
+}
+
+// newTrace will create a trace of the given kind.
+func newTrace(kind string, period time.Duration) (trace, error) {
+	switch kind {
+	case "periodic":
+		return periodicTrace{period: period}, nil
+	case "poisson":
+		return poissonTrace{period: period}, nil
+	case "burst":
+		return &burstTrace{period: period, burst: 10}, nil
+	}
+	return nil, fmt.Errorf("unknown trace %q, must be periodic, poisson or burst", kind)
+}
@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// ConnectionState is the state of the connection of a client to the broker.
+type ConnectionState uint32
+
+// The states of the connection of a client.
+const (
+	StateDisconnected = ConnectionState(disconnected)
+	StateConnecting   = ConnectionState(connecting)
+	StateReconnecting = ConnectionState(reconnecting)
+	StateConnected    = ConnectionState(connected)
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateConnected:
+		return "connected"
+	}
+	return "unknown"
+}
+
+// ConnectionEvent describes a change of the connection state of a client.
+// A failed attempt to connect is reported as an event which keeps the state
+// connecting or reconnecting, From and To are then the same.
+type ConnectionEvent struct {
+	From ConnectionState
+	To   ConnectionState
+	Time time.Time
+	// Cause is the error which ended the connection or failed the attempt,
+	// it is nil for a connection and for a call to Disconnect
+	Cause error
+	// Broker is the broker of the connection or the attempt
+	Broker *url.URL
+	// Attempt is the number of the attempt to connect, counted from 1 by
+	// each call to Connect and by each reconnect
+	Attempt int
+	// ReturnCode is the return code of the CONNACK, if one was received
+	ReturnCode byte
+	// SessionPresent is the session present flag of the CONNACK
+	SessionPresent bool
+}
+
+// ConnectionStateListener is a callback type which can be set to be
+// executed upon every change of the connection state of the client. The
+// events are passed in order from a goroutine of their own, so a slow
+// listener does not hold up the client.
+type ConnectionStateListener func(Client, ConnectionEvent)
+
+// stateNotifier passes the connection events to the listener in order.
+type stateNotifier struct {
+	sync.Mutex
+	queue   []ConnectionEvent
+	running bool
+}
+
+// notifyState will queue the event for the listener, starting the goroutine
+// which calls the listener if it is not running.
+func (c *client) notifyState(ev ConnectionEvent) {
+	listener := c.options.OnConnectionStateChange
+	if listener == nil {
+		return
+	}
+	n := &c.stateEvents
+	n.Lock()
+	n.queue = append(n.queue, ev)
+	if n.running {
+		n.Unlock()
+		return
+	}
+	n.running = true
+	n.Unlock()
+
+	go func() {
+		for {
+			n.Lock()
+			if len(n.queue) == 0 {
+				n.running = false
+				n.Unlock()
+				return
+			}
+			ev := n.queue[0]
+			n.queue = n.queue[1:]
+			n.Unlock()
+			listener(c, ev)
+		}
+	}()
+}
+
+// changeState will set the connection status and report the transition,
+// with the details in ev, to the connection state listener.
+func (c *client) changeState(status uint32, ev ConnectionEvent) {
+	c.Lock()
+	from := atomic.SwapUint32(&c.status, status)
+	c.Unlock()
+	if from == status {
+		return
+	}
+	ev.From, ev.To, ev.Time = ConnectionState(from), ConnectionState(status), c.options.Clock.Now()
+	c.notifyState(ev)
+}
+
+// reportAttempt will report a failed attempt to connect to the connection
+// state listener, the state is not changed.
+func (c *client) reportAttempt(ev ConnectionEvent) {
+	state := ConnectionState(c.connectionStatus())
+	ev.From, ev.To, ev.Time = state, state, c.options.Clock.Now()
+	c.notifyState(ev)
+}
+
+// connackError returns the error for a CONNACK which refused the connection.
+func connackError(rc byte, properties *packets.Properties) error {
+	if err, ok := packets.ConnErrors[rc]; ok {
+		return err
+	}
+	return packets.NewReasonCodeError(rc, properties)
+}
@@ -0,0 +1,61 @@
+package mqtt
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// OpenConnectionFunc is a callback type which opens the connection to the
+// broker at the URI. The options are those of the client, the ConnectTimeout
+// is the time left for the attempt.
+type OpenConnectionFunc func(uri *url.URL, options ClientOptions) (net.Conn, error)
+
+var dialers = struct {
+	sync.RWMutex
+	schemes map[string]OpenConnectionFunc
+}{schemes: make(map[string]OpenConnectionFunc)}
+
+// RegisterDialer will make all clients open the connections to the brokers
+// with the scheme using the function, a nil function removes it. A built-in
+// scheme such as tcp may be registered to wrap its connections, the function
+// can then open them with DefaultOpenConnection.
+func RegisterDialer(scheme string, fn OpenConnectionFunc) {
+	dialers.Lock()
+	defer dialers.Unlock()
+	if fn == nil {
+		delete(dialers.schemes, scheme)
+		return
+	}
+	dialers.schemes[scheme] = fn
+}
+
+func registeredDialer(scheme string) OpenConnectionFunc {
+	dialers.RLock()
+	defer dialers.RUnlock()
+	return dialers.schemes[scheme]
+}
+
+// DefaultOpenConnection opens the connection to the broker at the URI with
+// the built-in transports: ws, wss, tcp, unix, ssl, tls, tcps and mem.
+func DefaultOpenConnection(uri *url.URL, options ClientOptions) (net.Conn, error) {
+	return openConnection(uri, options.TLSConfig, options.ConnectTimeout, options.HTTPHeaders)
+}
+
+// openConnection will open the connection to the broker with the
+// CustomOpenConnectionFn of the client, the dialer registered for the
+// scheme or the built-in transports, in that order.
+func (c *client) openConnection(uri *url.URL, timeout time.Duration) (net.Conn, error) {
+	c.optionsMu.Lock() // the Servers may be added to while connecting
+	o := c.options
+	c.optionsMu.Unlock()
+	o.ConnectTimeout = timeout
+	if fn := o.CustomOpenConnectionFn; fn != nil {
+		return fn(uri, o)
+	}
+	if fn := registeredDialer(uri.Scheme); fn != nil {
+		return fn(uri, o)
+	}
+	return DefaultOpenConnection(uri, o)
+}
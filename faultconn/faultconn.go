@@ -0,0 +1,347 @@
+// Package faultconn wraps a net.Conn to inject faults for resilience tests:
+// latency, a bandwidth cap, partial writes, dropped reads, a half-open
+// connection and a reset. Each fault starts at a scripted point of the MQTT
+// packet stream, such as after the Nth PUBLISH written, and stays for the
+// rest of the connection. Dialer plugs the wrapper into a client through
+// the CustomOpenConnectionFn option or RegisterDialer.
+package faultconn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	mqtt "github.com/aretas77/paho.mqtt.golang"
+)
+
+// ErrReset is returned by the reads and writes of a connection once a
+// Reset fault has started.
+var ErrReset = errors.New("connection reset by fault")
+
+// Direction is the direction of the packets counted for a Point.
+type Direction int
+
+// The directions of the packets, Outbound packets are written to the
+// connection and Inbound packets are read from it.
+const (
+	Outbound Direction = iota
+	Inbound
+)
+
+// Point is the point of a connection at which a fault starts.
+type Point struct {
+	dir        Direction
+	packetType byte
+	n          int
+}
+
+// Start is the point at which the connection is opened, the faults start
+// there unless another point is given.
+var Start = Point{}
+
+// AfterWrite is the point after the nth packet of the type, such as
+// packets.Publish, has been written, a type of 0 counts all packets.
+func AfterWrite(packetType byte, n int) Point {
+	return Point{dir: Outbound, packetType: packetType, n: n}
+}
+
+// AfterRead is the point after the nth packet of the type has been read, a
+// type of 0 counts all packets.
+func AfterRead(packetType byte, n int) Point {
+	return Point{dir: Inbound, packetType: packetType, n: n}
+}
+
+type kind int
+
+const (
+	latency kind = iota
+	bandwidth
+	partialWrites
+	dropReads
+	halfOpen
+	reset
+)
+
+// Fault is a fault injected into a connection.
+type Fault struct {
+	kind kind
+	at   Point
+	d    time.Duration
+	n    int
+}
+
+// At returns the fault starting at the point instead.
+func (f Fault) At(p Point) Fault {
+	f.at = p
+	return f
+}
+
+// Latency delays each write and the delivery of each read by d.
+func Latency(d time.Duration) Fault {
+	return Fault{kind: latency, d: d}
+}
+
+// Bandwidth caps the writes to the bytes per second.
+func Bandwidth(bytesPerSecond int) Fault {
+	return Fault{kind: bandwidth, n: bytesPerSecond}
+}
+
+// PartialWrites splits the writes into writes of at most n bytes, so the
+// packets reach the peer in fragments.
+func PartialWrites(n int) Fault {
+	return Fault{kind: partialWrites, n: n}
+}
+
+// DropReads discards the data received from the point on, the writes still
+// reach the peer.
+func DropReads(at Point) Fault {
+	return Fault{kind: dropReads, at: at}
+}
+
+// HalfOpen makes the connection look open while nothing gets through from
+// the point on: the writes are discarded and the reads block until the
+// connection is closed or the read deadline expires.
+func HalfOpen(at Point) Fault {
+	return Fault{kind: halfOpen, at: at}
+}
+
+// Reset closes the underlying connection at the point, the reads and
+// writes then return ErrReset.
+func Reset(at Point) Fault {
+	return Fault{kind: reset, at: at}
+}
+
+// Conn is a net.Conn which injects faults into the connection it wraps.
+type Conn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	faults  []Fault
+	started []bool
+	counts  [2]map[byte]int
+	in, out frames
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Wrap returns the connection with the faults injected.
+func Wrap(conn net.Conn, faults ...Fault) *Conn {
+	c := &Conn{
+		Conn:    conn,
+		faults:  faults,
+		started: make([]bool, len(faults)),
+		counts:  [2]map[byte]int{make(map[byte]int), make(map[byte]int)},
+		closed:  make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.start()
+	c.mu.Unlock()
+	return c
+}
+
+// Dialer returns an OpenConnectionFunc which opens the connections with
+// next, or DefaultOpenConnection if nil, and wraps the nth connection,
+// counting from 1, with the faults returned by script.
+func Dialer(next mqtt.OpenConnectionFunc, script func(n int) []Fault) mqtt.OpenConnectionFunc {
+	if next == nil {
+		next = mqtt.DefaultOpenConnection
+	}
+	var mu sync.Mutex
+	var n int
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		conn, err := next(uri, options)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		n++
+		i := n
+		mu.Unlock()
+		return Wrap(conn, script(i)...), nil
+	}
+}
+
+// Count returns the number of packets of the type which have gone through
+// the connection in the direction, a type of 0 counts all packets.
+func (c *Conn) Count(dir Direction, packetType byte) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[dir][packetType]
+}
+
+// start will start the faults whose point has been reached, the lock must
+// be held.
+func (c *Conn) start() {
+	for i, f := range c.faults {
+		if c.started[i] || c.counts[f.at.dir][f.at.packetType] < f.at.n {
+			continue
+		}
+		c.started[i] = true
+		if f.kind == reset {
+			c.Conn.Close()
+		}
+	}
+}
+
+// packet will count a packet which has gone through the connection.
+func (c *Conn) packet(dir Direction, packetType byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[dir][packetType]++
+	c.counts[dir][0]++
+	c.start()
+}
+
+// fault returns the started fault of the kind, if any.
+func (c *Conn) fault(k kind) (Fault, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, f := range c.faults {
+		if c.started[i] && f.kind == k {
+			return f, true
+		}
+	}
+	return Fault{}, false
+}
+
+func (c *Conn) active(k kind) bool {
+	_, ok := c.fault(k)
+	return ok
+}
+
+// Write writes the data with the faults which have started, a fault whose
+// point is reached in the middle of the data applies to the rest of it.
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		if c.active(reset) {
+			return written, ErrReset
+		}
+		if c.active(halfOpen) {
+			return len(b), nil
+		}
+		if f, ok := c.fault(latency); ok {
+			time.Sleep(f.d)
+		}
+		limit := len(b)
+		if f, ok := c.fault(partialWrites); ok && f.n > 0 && written+f.n < limit {
+			limit = written + f.n
+		}
+		n, packetType, complete := c.out.advance(b[written:limit])
+		if f, ok := c.fault(bandwidth); ok && f.n > 0 {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(f.n))
+		}
+		if _, err := c.Conn.Write(b[written : written+n]); err != nil {
+			return written, c.err(err)
+		}
+		written += n
+		if complete {
+			c.packet(Outbound, packetType)
+		}
+	}
+	return written, nil
+}
+
+// Read reads the data with the faults which have started, the data after a
+// point at which the reads are dropped is discarded.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		if c.active(reset) {
+			return 0, ErrReset
+		}
+		n, err := c.Conn.Read(b)
+		keep := 0
+		for keep < n && !c.dropping() {
+			m, packetType, complete := c.in.advance(b[keep:n])
+			keep += m
+			if complete {
+				c.packet(Inbound, packetType)
+			}
+		}
+		if err != nil {
+			if err == io.EOF && c.active(halfOpen) {
+				<-c.closed
+			}
+			return keep, c.err(err)
+		}
+		if keep > 0 {
+			if f, ok := c.fault(latency); ok {
+				time.Sleep(f.d)
+			}
+			return keep, nil
+		}
+	}
+}
+
+func (c *Conn) dropping() bool {
+	return c.active(dropReads) || c.active(halfOpen) || c.active(reset)
+}
+
+// err returns ErrReset for the errors of the underlying connection once it
+// has been reset.
+func (c *Conn) err(err error) error {
+	if c.active(reset) {
+		return ErrReset
+	}
+	return err
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// frames follows the MQTT packets in a stream of bytes.
+type frames struct {
+	state      int
+	packetType byte
+	remaining  int
+	multiplier int
+}
+
+const (
+	fixedHeader = iota
+	remainingLength
+	body
+)
+
+// advance will consume the bytes up to the end of the current packet,
+// returning the number consumed and whether the packet is complete.
+func (f *frames) advance(b []byte) (int, byte, bool) {
+	for i := 0; i < len(b); {
+		switch f.state {
+		case fixedHeader:
+			f.packetType = b[i] >> 4
+			f.remaining, f.multiplier = 0, 1
+			f.state = remainingLength
+			i++
+		case remainingLength:
+			f.remaining += int(b[i]&127) * f.multiplier
+			f.multiplier *= 128
+			i++
+			if b[i-1]&128 == 0 {
+				if f.remaining == 0 {
+					f.state = fixedHeader
+					return i, f.packetType, true
+				}
+				f.state = body
+			}
+		case body:
+			n := len(b) - i
+			if n > f.remaining {
+				n = f.remaining
+			}
+			i += n
+			f.remaining -= n
+			if f.remaining == 0 {
+				f.state = fixedHeader
+				return i, f.packetType, true
+			}
+		}
+	}
+	return len(b), 0, false
+}
@@ -0,0 +1,208 @@
+package faultconn
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/aretas77/paho.mqtt.golang"
+	"github.com/aretas77/paho.mqtt.golang/broker"
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func newPublish(topic, payload string) *packets.PublishPacket {
+	pp := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName, pp.Payload = topic, []byte(payload)
+	return pp
+}
+
+// readPacket reads a packet from the peer with a deadline.
+func readPacket(conn net.Conn, d time.Duration) (packets.ControlPacket, error) {
+	conn.SetReadDeadline(time.Now().Add(d))
+	return packets.ReadPacket(conn)
+}
+
+func Test_PartialWrites(t *testing.T) {
+	client, peer := net.Pipe()
+	c := Wrap(client, PartialWrites(3))
+	defer c.Close()
+
+	written := make(chan error)
+	go func() { written <- newPublish("a/b", "fragmented").Write(c) }()
+	// a read of the pipe returns at most the data of a single write.
+	buf := make([]byte, 64)
+	n, err := peer.Read(buf)
+	if err != nil || n != 3 {
+		t.Fatalf("first read returned %d bytes, %v", n, err)
+	}
+	rest, err := readRest(peer, buf[:n])
+	if err != nil {
+		t.Fatalf("reading the rest failed: %v", err)
+	}
+	if p, ok := rest.(*packets.PublishPacket); !ok || string(p.Payload) != "fragmented" {
+		t.Errorf("received %v", rest)
+	}
+	if err := <-written; err != nil {
+		t.Errorf("write failed: %v", err)
+	}
+	if n := c.Count(Outbound, packets.Publish); n != 1 {
+		t.Errorf("%d publishes counted", n)
+	}
+}
+
+// readRest reads the packet whose first bytes have been read already.
+func readRest(conn net.Conn, first []byte) (packets.ControlPacket, error) {
+	r, w := net.Pipe()
+	go func() {
+		w.Write(first)
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				w.Close()
+				return
+			}
+			w.Write(buf[:n])
+		}
+	}()
+	return readPacket(r, time.Second)
+}
+
+func Test_Reset(t *testing.T) {
+	client, peer := net.Pipe()
+	c := Wrap(client, Reset(AfterWrite(packets.Publish, 2)))
+	defer c.Close()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := newPublish("a/b", "reset").Write(c); err != nil {
+				if i != 2 || err != ErrReset {
+					t.Errorf("publish %d failed: %v", i, err)
+				}
+				return
+			}
+		}
+		t.Errorf("publish succeeded after the reset")
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := readPacket(peer, time.Second); err != nil {
+			t.Fatalf("publish %d not received: %v", i, err)
+		}
+	}
+	if cp, err := readPacket(peer, time.Second); err == nil {
+		t.Errorf("received %v after the reset", cp)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != ErrReset {
+		t.Errorf("read after the reset returned %v", err)
+	}
+}
+
+func Test_DropReads(t *testing.T) {
+	client, peer := net.Pipe()
+	c := Wrap(client, DropReads(AfterRead(packets.Publish, 1)))
+	defer c.Close()
+
+	go func() {
+		newPublish("a/b", "kept").Write(peer)
+		newPublish("a/b", "dropped").Write(peer)
+	}()
+	cp, err := readPacket(c, time.Second)
+	if p, ok := cp.(*packets.PublishPacket); err != nil || !ok || string(p.Payload) != "kept" {
+		t.Fatalf("received %v, %v", cp, err)
+	}
+	if cp, err := readPacket(c, 100*time.Millisecond); err == nil {
+		t.Errorf("received %v after the reads were dropped", cp)
+	}
+
+	// the writes still reach the peer.
+	go newPublish("a/b", "written").Write(c)
+	if _, err := readPacket(peer, time.Second); err != nil {
+		t.Errorf("write not received: %v", err)
+	}
+}
+
+func Test_HalfOpen(t *testing.T) {
+	client, peer := net.Pipe()
+	c := Wrap(client, HalfOpen(Start))
+	defer c.Close()
+
+	if err := newPublish("a/b", "lost").Write(c); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if cp, err := readPacket(peer, 100*time.Millisecond); err == nil {
+		t.Errorf("peer received %v", cp)
+	}
+	go newPublish("a/b", "lost").Write(peer)
+	if cp, err := readPacket(c, 100*time.Millisecond); err == nil {
+		t.Errorf("received %v", cp)
+	}
+}
+
+func Test_Latency(t *testing.T) {
+	client, peer := net.Pipe()
+	c := Wrap(client, Latency(50*time.Millisecond))
+	defer c.Close()
+
+	start := time.Now()
+	go newPublish("a/b", "late").Write(c)
+	if _, err := readPacket(peer, time.Second); err != nil {
+		t.Fatalf("publish not received: %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("publish received after %v", d)
+	}
+}
+
+// Test_DialerReconnect resets the first connection of a client after its
+// second PUBLISH, the client should reconnect and deliver all the messages.
+func Test_DialerReconnect(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+	l, err := mqtt.ListenMem("faultconn-reconnect")
+	if err != nil {
+		t.Fatalf("ListenMem failed: %v", err)
+	}
+	go b.Serve(l)
+
+	var dials int32
+	ops := mqtt.NewClientOptions().AddBroker("mem://faultconn-reconnect").
+		SetClientID("faultconn").SetCleanSession(false).
+		SetMaxReconnectInterval(100 * time.Millisecond)
+	ops.SetCustomOpenConnectionFn(Dialer(nil, func(n int) []Fault {
+		atomic.StoreInt32(&dials, int32(n))
+		if n == 1 {
+			return []Fault{Reset(AfterWrite(packets.Publish, 2))}
+		}
+		return nil
+	}))
+	received := make(chan string, 10)
+	ops.SetDefaultPublishHandler(func(_ mqtt.Client, m mqtt.Message) { received <- string(m.Payload()) })
+	c := mqtt.NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	if token := c.Subscribe("faultconn", 1, nil); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe failed: %v", token.Error())
+	}
+
+	for _, payload := range []string{"1", "2", "3"} {
+		token := c.Publish("faultconn", 1, false, payload)
+		if !token.WaitTimeout(10 * time.Second) {
+			t.Fatalf("publish %s not completed", payload)
+		}
+	}
+	got := make(map[string]bool)
+	for len(got) < 3 {
+		select {
+		case m := <-received:
+			got[m] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("received only %v", got)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("%d connections opened", n)
+	}
+}
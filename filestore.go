@@ -15,19 +15,24 @@
 package mqtt
 
 import (
+	"bufio"
 	"io/ioutil"
 	"os"
 	"path"
 	"sort"
 	"sync"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 const (
 	msgExt     = ".msg"
 	tmpExt     = ".tmp"
 	corruptExt = ".CORRUPT"
+
+	// v5Marker is written in front of MQTT 5 packets, so they are read back
+	// with their properties. No MQTT packet starts with this byte.
+	v5Marker = 0x05
 )
 
 // FileStore implements the store interface using the filesystem to provide
@@ -110,7 +115,7 @@ func (store *FileStore) Get(key string) packets.ControlPacket {
 	}
 	mfile, oerr := os.Open(filepath)
 	chkerr(oerr)
-	msg, rerr := packets.ReadPacket(mfile)
+	msg, rerr := readPacket(bufio.NewReader(mfile))
 	chkerr(mfile.Close())
 
 	// Message was unreadable, return nil
@@ -222,6 +227,10 @@ func write(store, key string, m packets.ControlPacket) {
 	temppath := tmppath(store, key)
 	f, err := os.Create(temppath)
 	chkerr(err)
+	if packets.PropertiesOf(m) != nil {
+		_, werr := f.Write([]byte{v5Marker})
+		chkerr(werr)
+	}
 	werr := m.Write(f)
 	chkerr(werr)
 	cerr := f.Close()
@@ -230,6 +239,19 @@ func write(store, key string, m packets.ControlPacket) {
 	chkerr(rerr)
 }
 
+// readPacket will read a packet written by write.
+func readPacket(r *bufio.Reader) (packets.ControlPacket, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == v5Marker {
+		r.ReadByte()
+		return packets.ReadPacketWithVersion(r, 5)
+	}
+	return packets.ReadPacket(r)
+}
+
 func exists(file string) bool {
 	if _, err := os.Stat(file); err != nil {
 		if os.IsNotExist(err) {
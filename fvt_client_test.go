@@ -23,7 +23,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 func Test_Start(t *testing.T) {
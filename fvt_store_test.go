@@ -20,7 +20,7 @@ import (
 	"os"
 	"testing"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 /**********************************************
@@ -195,6 +195,34 @@ func Test_FileStore_Get(t *testing.T) {
 	}
 }
 
+func Test_FileStore_Get_v5(t *testing.T) {
+	storedir := "/tmp/TestStore/_get_v5"
+	f := NewFileStore(storedir)
+	f.Open()
+	pm := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pm.Qos = 1
+	pm.TopicName = "/a/b/c"
+	pm.Payload = []byte{0xBE, 0xEF, 0xED}
+	pm.MessageID = 121
+	pm.Properties = &packets.Properties{ContentType: "text/plain"}
+
+	key := outboundKeyFromMID(pm.MessageID)
+	f.Put(key, pm)
+
+	m := f.Get(key)
+	if m == nil {
+		t.Fatalf("message not retreived from store")
+	}
+
+	p := m.(*packets.PublishPacket)
+	if p.Properties == nil || p.Properties.ContentType != "text/plain" {
+		t.Fatalf("properties not retreived from store: %v", p.Properties)
+	}
+	if !bytes.Equal(p.Payload, pm.Payload) {
+		t.Fatal("message from store not same as what went in", p.Payload)
+	}
+}
+
 func Test_FileStore_Get_Corrupted(t *testing.T) {
 	storedir := "/tmp/TestStore/_get_error"
 	f := NewFileStore(storedir)
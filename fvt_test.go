@@ -14,11 +14,16 @@
 
 package mqtt
 
-import "os"
+import (
+	"os"
+
+	"github.com/aretas77/paho.mqtt.golang/broker"
+)
 
 // Use setup_IMA.sh for IBM's MessageSight
 // Use fvt/rsmb.cfg for IBM's Really Small Message Broker
 // Use fvt/mosquitto.cfg for the open source Mosquitto project
+// Use TEST_FVT_BROKER=embedded for the in-process broker of the broker package
 
 var (
 	FVTAddr string
@@ -33,4 +38,12 @@ func init() {
 	}
 	FVTTCP = "tcp://" + FVTAddr + ":1883"
 	FVTSSL = "ssl://" + FVTAddr + ":8883"
+
+	if os.Getenv("TEST_FVT_BROKER") == "embedded" {
+		l, err := broker.New().Listen("127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		FVTTCP = "tcp://" + l.Addr().String()
+	}
 }
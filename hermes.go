@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"sync"
 	"time"
 
@@ -30,21 +31,49 @@ const (
 type hermes struct {
 	interpreter *python3.PyObject
 
-	// not used - should only be used for one device to be aware of its power.
+	// should only be used for one device to be aware of its power.
 	batteryLeftMah    float32
 	totalBatteryMah   float32
 	lastModelUpdate   time.Time
 	initialModel      bool
+	modelDir          string
 	sendLoopOperating bool
 
 	counter             map[string]int
 	currentSendInterval map[string]time.Duration
-	sendTicker          map[string]*time.Ticker
+	sendTicker          map[string]ClockTicker
 	canSend             map[string]bool
 	rwMutex             sync.RWMutex
 
 	handlers []TopicHandler
 
+	// capture holds the samples which are used by Hades to retrain models,
+	// it is nil when sample capturing is disabled.
+	capture          *sampleRing
+	captureBatchSize int
+	windows          map[string]*Sample
+	rssi             map[string]int
+
+	// manifests describe the inputs and outputs of the model of a device.
+	manifests map[string]*ModelManifest
+	features  map[string]map[string]float32
+
+	// experiment is the model experiment the devices take part in, it has
+	// its own mutex as requests to Hades can be made with rwMutex held.
+	experiment    *Experiment
+	cohortStats   map[string]*CohortStats
+	sendEnergyMah float32
+	byteEnergyMah float32
+	experimentMu  sync.RWMutex
+
+	// priorities decide how publishes to matching topics are scheduled.
+	priorities           []TopicPriority
+	alarmResetsWindow    bool
+	bulkBatteryThreshold float32
+
+	// clock is the Clock of the client, the send windows are timed with it.
+	clock Clock
+
 	// these are control channels which are used to control the timer.
 	setTimer   chan *Timer
 	resetTimer chan string
@@ -68,10 +97,14 @@ type TopicHandler struct {
 }
 
 // RequestModelPayload contains data for the hermes to request a new model.
+// Experiment and Cohort are set only when the device takes part in an
+// experiment, the first cohort is 0.
 type RequestModelPayload struct {
 	MAC             string    `json:"mac"`
 	LastModelUpdate time.Time `json:"last_model_update"`
 	Initial         bool      `json:"initial"`
+	Experiment      string    `json:"experiment,omitempty"`
+	Cohort          *uint32   `json:"cohort,omitempty"`
 }
 
 // SendIntervalPayload contains data for the hermes to process the received
@@ -95,9 +128,29 @@ func (h *hermes) Initialize() {
 	// for each device we have a unique canSend flag and a unique timer.
 	h.resetTimer = make(chan string)
 	h.canSend = make(map[string]bool)
-	h.sendTicker = make(map[string]*time.Ticker)
+	h.sendTicker = make(map[string]ClockTicker)
 	h.currentSendInterval = make(map[string]time.Duration)
 	h.counter = make(map[string]int)
+	h.windows = make(map[string]*Sample)
+	if h.rssi == nil {
+		h.rssi = make(map[string]int)
+	}
+	if h.features == nil {
+		h.features = make(map[string]map[string]float32)
+	}
+	h.manifests = make(map[string]*ModelManifest)
+	h.loadManifests()
+
+	h.experimentMu.Lock()
+	h.cohortStats = make(map[string]*CohortStats)
+	h.experimentMu.Unlock()
+
+	if h.capture != nil {
+		if err := h.capture.open(); err != nil {
+			ERROR.Println(HER, "Initialize() failed to open sample ring:", err)
+			h.capture = nil
+		}
+	}
 
 	h.initialModel = true
 	h.interpreter = python3.PyImport_ImportModule("interpreter")
@@ -108,31 +161,96 @@ func (h *hermes) Initialize() {
 	// initialize the topics with their handlers for hermes
 	h.handlers = []TopicHandler{
 		{"node/+/+/hades/model/receive", 1, h.HandleReceiveModel},
+		{"node/+/+/hades/manifest/receive", 1, h.HandleReceiveManifest},
+		{"node/+/+/hades/model/receive/+", 1, h.HandleReceiveCohortModel},
+		{"node/+/+/hades/manifest/receive/+", 1, h.HandleReceiveCohortManifest},
+		{"node/+/+/hades/experiment/receive", 1, h.HandleReceiveExperiment},
 		{"node/+/+/hades/interval/receive", 1, h.HandleReceiveInterval},
 	}
 }
 
+// modelsPath returns the directory of the models, the modelsDir is used
+// when no other directory was set.
+func (h *hermes) modelsPath() string {
+	if h.modelDir == "" {
+		return modelsDir
+	}
+	return h.modelDir
+}
+
+// modelPath returns the path of a file of the model of the device.
+func (h *hermes) modelPath(mac, ext string) string {
+	return fmt.Sprintf("%s/model_%s.%s", h.modelsPath(), mac, ext)
+}
+
 // SaveModel will receive a model in bytes and will save it in the given models
 // directory.
 func (h *hermes) saveModel(model []byte, mac string) {
-	modelName := fmt.Sprintf("%s/model_%s.tflite", modelsDir, mac)
+	modelName := h.modelPath(mac, "tflite")
 	err := ioutil.WriteFile(modelName, model, 0644)
 	if err != nil {
 		ERROR.Println(err)
 	}
 }
 
+// infer will run the saved model of the given device with the given input
+// and return its output.
+func (h *hermes) infer(mac string, input []float32) ([]float32, error) {
+	if h.interpreter == nil {
+		return nil, fmt.Errorf("interpreter is not loaded")
+	}
+
+	list := python3.PyList_New(len(input))
+	defer list.DecRef()
+	for i, value := range input {
+		python3.PyList_SetItem(list, i, python3.PyFloat_FromDouble(float64(value)))
+	}
+
+	callable := python3.PyUnicode_FromString("infer")
+	defer callable.DecRef()
+	pyMac := python3.PyUnicode_FromString(mac)
+	defer pyMac.DecRef()
+
+	result := h.interpreter.CallMethodObjArgs(callable, pyMac, list)
+	if result == nil || !python3.PyList_Check(result) {
+		return nil, fmt.Errorf("inference of model for %s has failed", mac)
+	}
+	defer result.DecRef()
+
+	output := make([]float32, python3.PyList_Size(result))
+	for i := range output {
+		output[i] = float32(python3.PyFloat_AsDouble(python3.PyList_GetItem(result, i)))
+	}
+
+	return output, nil
+}
+
 // checkNeedNewInterval will check whether the counter has reached the required
 // count and request a new interval if it did.
 func (h *hermes) checkNeedNewInterval(c *client, mac string) {
 	if h.counter[mac] >= 4 {
 		if c != nil {
 			h.RequestNewInterval(c, mac)
+			h.publishCohortStats(c, mac)
 		}
 		h.counter[mac] = 0
 	}
 }
 
+// recordPublish will account a publish of the given size for a device, sent
+// is false if the publish was dropped by hermes.
+func (h *hermes) recordPublish(mac string, size int, sent bool) {
+	if mac == "" {
+		return
+	}
+
+	h.rwMutex.Lock()
+	defer h.rwMutex.Unlock()
+
+	h.recordSample(mac, size, sent)
+	h.recordCohort(mac, size, sent)
+}
+
 // SetSendInterval will set the given send interval as the current send
 // interval for the given device.
 func (h *hermes) SetSendInterval(mac string, interval time.Duration) {
@@ -180,11 +298,13 @@ func (h *hermes) GetCanSend(c *client, mac string) bool {
 	}
 
 	select {
-	case <-h.sendTicker[mac].C:
+	case <-h.sendTicker[mac].C():
 		h.canSend[mac] = true
 		h.counter[mac]++
+		h.closeWindow(mac)
 
 		if c != nil {
+			h.startUpload(c)
 			h.checkNeedNewInterval(c, mac)
 		}
 	default:
@@ -194,15 +314,29 @@ func (h *hermes) GetCanSend(c *client, mac string) bool {
 	return h.canSend[mac]
 }
 
-// RequestNewModel should send a request for a model to the Hades server. A handle
-// should receive the requested model.
-func (h *hermes) RequestNewModel(c Client, mac string) error {
+// requestPayload will create the payload of a request to Hades for the given
+// device.
+func (h *hermes) requestPayload(mac string) RequestModelPayload {
 	payload := RequestModelPayload{
 		MAC:             mac,
 		LastModelUpdate: h.lastModelUpdate,
 		Initial:         h.initialModel,
 	}
 
+	if experiment := h.currentExperiment(); experiment != nil {
+		payload.Experiment = experiment.ID
+		cohort := experiment.cohortOf(mac)
+		payload.Cohort = &cohort
+	}
+
+	return payload
+}
+
+// RequestNewModel should send a request for a model to the Hades server. A handle
+// should receive the requested model.
+func (h *hermes) RequestNewModel(c Client, mac string) error {
+	payload := h.requestPayload(mac)
+
 	resp, err := json.Marshal(payload)
 	if err != nil {
 		return err
@@ -222,11 +356,7 @@ func (h *hermes) RequestNewModel(c Client, mac string) error {
 
 // RequestNewInterval ...
 func (h *hermes) RequestNewInterval(c Client, mac string) error {
-	payload := RequestModelPayload{
-		MAC:             mac,
-		LastModelUpdate: h.lastModelUpdate,
-		Initial:         h.initialModel,
-	}
+	payload := h.requestPayload(mac)
 
 	resp, err := json.Marshal(payload)
 	if err != nil {
@@ -243,9 +373,9 @@ func (h *hermes) RequestNewInterval(c Client, mac string) error {
 	return nil
 }
 
-// HandleReceiveModel is called when a model was received. Interpreter should
-// called to parse the received values.
-// TODO: implement interpreter call.
+// HandleReceiveModel is called when a model was received. If a manifest for
+// the model is known, the interpreter is called to get the send interval,
+// otherwise a default send interval is used.
 func (h *hermes) HandleReceiveModel(c Client, msg Message) {
 	// retrieve MAC address so we should know for whom to set the timer.
 	mac := parseTopicMac(msg.Topic())
@@ -254,9 +384,53 @@ func (h *hermes) HandleReceiveModel(c Client, msg Message) {
 	// mark that initial model is received
 	h.initialModel = false
 
+	interval, err := h.modelSendInterval(mac)
+	if err != nil {
+		WARN.Println(HER, "using default send interval:", err)
+		interval = time.Second * 10
+	}
+
 	// read the values from the model and send to the ticker
 	h.setTimer <- &Timer{
-		duration:  time.Second * 10,
+		duration:  interval,
+		timerType: TimerSendInterval,
+		mac:       mac,
+	}
+}
+
+// HandleReceiveManifest is called when a manifest describing the model of a
+// device was received. It is used for every following model inference.
+func (h *hermes) HandleReceiveManifest(c Client, msg Message) {
+	mac := parseTopicMac(msg.Topic())
+	if mac == "" {
+		WARN.Println(HER, "received manifest without MAC")
+		return
+	}
+
+	manifest, err := parseManifest(msg.Payload())
+	if err != nil {
+		WARN.Println(HER, "failed to parse received manifest:", err)
+		return
+	}
+	h.saveManifest(msg.Payload(), mac)
+
+	h.rwMutex.Lock()
+	h.manifests[mac] = manifest
+	h.rwMutex.Unlock()
+
+	// a model which is already loaded gets its interval from the new
+	// manifest.
+	if _, err := os.Stat(h.modelPath(mac, "tflite")); err != nil {
+		return
+	}
+	interval, err := h.modelSendInterval(mac)
+	if err != nil {
+		WARN.Println(HER, "keeping the send interval:", err)
+		return
+	}
+
+	h.setTimer <- &Timer{
+		duration:  interval,
 		timerType: TimerSendInterval,
 		mac:       mac,
 	}
@@ -272,14 +446,14 @@ func (h *hermes) HandleReceiveInterval(c Client, msg Message) {
 		WARN.Println(HER, "failed to parse received interval")
 	}
 
-	if payload.SendInterval == 0 || mac == "" {
+	if payload.SendInterval <= 0 || mac == "" {
 		WARN.Println(HER, "received invalid send interval = ", payload.SendInterval)
 		return
 	}
 
 	WARN.Println(HER, "received new interval = ", payload.SendInterval)
 	h.setTimer <- &Timer{
-		duration:  time.Minute * time.Duration(payload.SendInterval),
+		duration:  time.Duration(float64(payload.SendInterval) * float64(time.Minute)),
 		timerType: TimerSendInterval,
 		mac:       mac,
 	}
@@ -322,6 +496,7 @@ func (h *hermes) sendTimer(c *client) {
 		for _, value := range h.sendTicker {
 			value.Stop()
 		}
+		h.sendLoopOperating = false
 	}()
 
 	for {
@@ -342,7 +517,7 @@ func (h *hermes) sendTimer(c *client) {
 
 				// when initiating a new ticker - we disable sending.
 				h.currentSendInterval[mac] = newTime.duration
-				h.sendTicker[mac] = time.NewTicker(newTime.duration)
+				h.sendTicker[mac] = clockOr(h.clock).NewTicker(newTime.duration)
 				h.canSend[mac] = false
 
 				h.checkNeedNewInterval(c, mac)
@@ -355,10 +530,13 @@ func (h *hermes) sendTimer(c *client) {
 			h.rwMutex.Lock()
 			h.canSend[mac] = false
 			h.sendTicker[mac].Stop()
-			h.sendTicker[mac] = time.NewTicker(h.currentSendInterval[mac])
+			h.sendTicker[mac] = clockOr(h.clock).NewTicker(h.currentSendInterval[mac])
 			h.rwMutex.Unlock()
 		case <-h.stop:
-			break
+			return
+		case <-c.stop:
+			// the client is disconnecting, it waits for all of the workers.
+			return
 		}
 	}
 }
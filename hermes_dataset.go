@@ -0,0 +1,384 @@
+package mqtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sampleExt is the extension used for samples stored in the ring.
+	sampleExt = ".smp"
+	// defaultCaptureDir is used when no capture directory was given.
+	defaultCaptureDir = "./samples"
+	// defaultCaptureMaxSamples is the default capacity of the sample ring.
+	defaultCaptureMaxSamples = 1024
+	// defaultCaptureBatchSize is the default amount of samples in one upload.
+	defaultCaptureBatchSize = 32
+)
+
+// Sample is a single feature vector captured by hermes for one send window
+// of a device. Samples are uploaded to Hades where they are used as training
+// data for new models.
+type Sample struct {
+	MAC             string    `json:"mac"`
+	Time            time.Time `json:"time"`
+	Window          float64   `json:"window"`
+	Publishes       int       `json:"publishes"`
+	Dropped         int       `json:"dropped"`
+	PayloadBytes    int       `json:"payload_bytes"`
+	BatteryLeftMah  float32   `json:"battery_left_mah"`
+	TotalBatteryMah float32   `json:"total_battery_mah"`
+	RSSI            int       `json:"rssi"`
+
+	// key is the key of the sample in the sampleRing it was read from.
+	key uint64
+}
+
+// sampleRing is a bounded on-disk ring of samples. Every sample is kept in
+// its own file named after a sequence number, so the ring survives restarts
+// of the client. When the ring is full the oldest sample is overwritten.
+type sampleRing struct {
+	sync.Mutex
+	directory string
+	capacity  int
+	keys      []uint64
+	next      uint64
+	uploading bool
+	opened    bool
+}
+
+// newSampleRing will create a new sampleRing which stores its samples in the
+// given directory. The ring has to be opened before it can be used.
+func newSampleRing(directory string, capacity int) *sampleRing {
+	if directory == "" {
+		directory = defaultCaptureDir
+	}
+	if capacity <= 0 {
+		capacity = defaultCaptureMaxSamples
+	}
+
+	return &sampleRing{
+		directory: directory,
+		capacity:  capacity,
+	}
+}
+
+// open will create the ring directory if needed and load the sequence numbers
+// of samples that were left from a previous run.
+func (r *sampleRing) open() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := os.MkdirAll(r.directory, os.FileMode(0770)); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(r.directory)
+	if err != nil {
+		return err
+	}
+
+	r.keys = r.keys[:0]
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, sampleExt) {
+			continue
+		}
+		key, err := strconv.ParseUint(strings.TrimSuffix(name, sampleExt), 10, 64)
+		if err != nil {
+			WARN.Println(HER, "skipping unknown file in sample ring:", name)
+			continue
+		}
+		r.keys = append(r.keys, key)
+	}
+	sort.Slice(r.keys, func(i, j int) bool { return r.keys[i] < r.keys[j] })
+
+	r.next = 0
+	if len(r.keys) > 0 {
+		r.next = r.keys[len(r.keys)-1] + 1
+	}
+	r.opened = true
+
+	// the capacity could have been lowered between runs.
+	for len(r.keys) > r.capacity {
+		r.remove(r.keys[0])
+		r.keys = r.keys[1:]
+	}
+
+	return nil
+}
+
+// push will store the given sample as the newest one in the ring, dropping
+// the oldest sample if the ring is full.
+func (r *sampleRing) push(s *Sample) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.opened {
+		return fmt.Errorf("sample ring is not open")
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	key := r.next
+	tmp := r.path(key) + tmpExt
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path(key)); err != nil {
+		return err
+	}
+	r.next++
+	r.keys = append(r.keys, key)
+
+	if len(r.keys) > r.capacity {
+		r.remove(r.keys[0])
+		r.keys = r.keys[1:]
+	}
+
+	return nil
+}
+
+// peek will return up to n of the oldest samples in the ring together with
+// their keys. The samples stay in the ring until they are dropped.
+func (r *sampleRing) peek(n int) ([]uint64, []*Sample, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if n > len(r.keys) {
+		n = len(r.keys)
+	}
+
+	keys := make([]uint64, 0, n)
+	samples := make([]*Sample, 0, n)
+	for _, key := range r.keys[:n] {
+		data, err := ioutil.ReadFile(r.path(key))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		s := &Sample{}
+		if err := json.Unmarshal(data, s); err != nil {
+			WARN.Println(HER, "corrupted sample", key, "will be skipped:", err)
+			keys = append(keys, key)
+			continue
+		}
+		s.key = key
+		keys = append(keys, key)
+		samples = append(samples, s)
+	}
+
+	return keys, samples, nil
+}
+
+// drop will remove the samples with the given keys from the ring.
+func (r *sampleRing) drop(keys []uint64) {
+	r.Lock()
+	defer r.Unlock()
+
+	dropped := make(map[uint64]bool, len(keys))
+	for _, key := range keys {
+		dropped[key] = true
+	}
+
+	left := r.keys[:0]
+	for _, key := range r.keys {
+		if dropped[key] {
+			r.remove(key)
+			continue
+		}
+		left = append(left, key)
+	}
+	r.keys = left
+}
+
+// len will return the number of samples currently held in the ring.
+func (r *sampleRing) len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.keys)
+}
+
+// lockless
+func (r *sampleRing) remove(key uint64) {
+	if err := os.Remove(r.path(key)); err != nil && !os.IsNotExist(err) {
+		ERROR.Println(HER, "failed to remove sample:", err)
+	}
+}
+
+func (r *sampleRing) path(key uint64) string {
+	return path.Join(r.directory, fmt.Sprintf("%020d%s", key, sampleExt))
+}
+
+// encodeSamples will encode the given samples as a gzip compressed JSON array
+// which is the format expected by the Hades dataset topic.
+func encodeSamples(samples []*Sample) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(samples); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// recordSample will account a publish of the given size in the currently
+// open send window of a device. It must be called with the rwMutex held.
+func (h *hermes) recordSample(mac string, size int, sent bool) {
+	if h.capture == nil {
+		return
+	}
+
+	w := h.openWindow(mac)
+	if sent {
+		w.Publishes++
+		w.PayloadBytes += size
+	} else {
+		w.Dropped++
+	}
+}
+
+// SetRSSI will set the last known signal strength of a device, as reported
+// by the application, which is captured in the following samples.
+func (h *hermes) SetRSSI(mac string, rssi int) {
+	h.rwMutex.Lock()
+	defer h.rwMutex.Unlock()
+	if h.rssi == nil {
+		h.rssi = make(map[string]int)
+	}
+	h.rssi[mac] = rssi
+}
+
+// SetBatteryLeftMah will set the battery that is left for the device.
+func (h *hermes) SetBatteryLeftMah(battery float32) {
+	h.rwMutex.Lock()
+	defer h.rwMutex.Unlock()
+	h.batteryLeftMah = battery
+}
+
+// lockless
+func (h *hermes) openWindow(mac string) *Sample {
+	w, ok := h.windows[mac]
+	if !ok {
+		w = &Sample{MAC: mac, Time: clockOr(h.clock).Now()}
+		h.windows[mac] = w
+	}
+	return w
+}
+
+// closeWindow will finish the currently open send window of a device, store
+// it in the sample ring and open a new window. It must be called with the
+// rwMutex held.
+func (h *hermes) closeWindow(mac string) {
+	if h.capture == nil {
+		return
+	}
+
+	w := h.openWindow(mac)
+	w.Window = clockOr(h.clock).Now().Sub(w.Time).Seconds()
+	w.BatteryLeftMah = h.batteryLeftMah
+	w.TotalBatteryMah = h.totalBatteryMah
+	w.RSSI = h.rssi[mac]
+
+	if err := h.capture.push(w); err != nil {
+		ERROR.Println(HER, "failed to capture sample:", err)
+	}
+	h.windows[mac] = &Sample{MAC: mac, Time: clockOr(h.clock).Now()}
+}
+
+// startUpload will start an upload of the captured samples if enough of them
+// were gathered and no upload is running yet. It is called when a send
+// window is closed.
+func (h *hermes) startUpload(c Client) {
+	if h.capture == nil || h.capture.len() < h.captureBatchSize {
+		return
+	}
+
+	h.capture.Lock()
+	defer h.capture.Unlock()
+	if h.capture.uploading {
+		return
+	}
+	h.capture.uploading = true
+	go h.uploadSamples(c)
+}
+
+// uploadSamples will upload a batch of captured samples to the Hades dataset
+// topics, the samples of each device are sent to the topic of that device.
+// The samples are removed from the ring only after the broker has
+// acknowledged the upload. It is started by startUpload.
+func (h *hermes) uploadSamples(c Client) {
+	defer func() {
+		h.capture.Lock()
+		h.capture.uploading = false
+		h.capture.Unlock()
+	}()
+
+	keys, samples, err := h.capture.peek(h.captureBatchSize)
+	if err != nil {
+		ERROR.Println(HER, "failed to read samples:", err)
+		return
+	}
+
+	// group the samples by device, keeping the order in which they were
+	// captured. The keys of corrupted samples are dropped right away.
+	var macs []string
+	batches := make(map[string][]*Sample)
+	valid := make(map[uint64]bool, len(samples))
+	for _, s := range samples {
+		if _, ok := batches[s.MAC]; !ok {
+			macs = append(macs, s.MAC)
+		}
+		batches[s.MAC] = append(batches[s.MAC], s)
+		valid[s.key] = true
+	}
+	var corrupted []uint64
+	for _, key := range keys {
+		if !valid[key] {
+			corrupted = append(corrupted, key)
+		}
+	}
+	h.capture.drop(corrupted)
+
+	uploaded := 0
+	for _, mac := range macs {
+		batch := batches[mac]
+		payload, err := encodeSamples(batch)
+		if err != nil {
+			ERROR.Println(HER, "failed to encode samples:", err)
+			continue
+		}
+
+		uploadTopic := fmt.Sprintf("%s/global/%s/dataset/upload", hadesPrefix, mac)
+		token := c.Publish(uploadTopic, 1, false, payload)
+		if token.Wait() && token.Error() != nil {
+			WARN.Println(HER, "upload of samples has failed:", token.Error())
+			continue
+		}
+
+		batchKeys := make([]uint64, len(batch))
+		for i, s := range batch {
+			batchKeys[i] = s.key
+		}
+		h.capture.drop(batchKeys)
+		uploaded += len(batch)
+	}
+	DEBUG.Println(HER, "uploaded", uploaded, "samples")
+}
@@ -0,0 +1,206 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
+// Experiment is sent by Hades to trial several candidate models on slices of
+// the fleet. Each device is assigned to one of the cohorts by hashing its MAC
+// address and only keeps the model and manifest sent for its own cohort.
+type Experiment struct {
+	ID      string `json:"id"`
+	Cohorts uint32 `json:"cohorts"`
+}
+
+// CohortStats contains the counters of a device taking part in an experiment.
+// They are published to Hades so cohorts can be compared by power usage and
+// data freshness. Energy is estimated from the configured energy costs.
+type CohortStats struct {
+	MAC          string  `json:"mac"`
+	Experiment   string  `json:"experiment"`
+	Cohort       uint32  `json:"cohort"`
+	Sends        int     `json:"sends"`
+	Drops        int     `json:"drops"`
+	PayloadBytes int     `json:"payload_bytes"`
+	EnergyMah    float32 `json:"energy_mah"`
+}
+
+// cohortOf will return the cohort the given device is assigned to.
+func (e *Experiment) cohortOf(mac string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(mac))
+	return hash.Sum32() % e.Cohorts
+}
+
+// parseExperiment will decode and validate an experiment received from Hades.
+// An experiment without an ID ends the current experiment and nil is returned.
+func parseExperiment(data []byte) (*Experiment, error) {
+	e := &Experiment{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+
+	if e.ID == "" {
+		return nil, nil
+	}
+	if e.Cohorts == 0 {
+		return nil, fmt.Errorf("experiment %s has no cohorts", e.ID)
+	}
+
+	return e, nil
+}
+
+// currentExperiment will return the experiment the devices take part in or
+// nil if there is none.
+func (h *hermes) currentExperiment() *Experiment {
+	h.experimentMu.RLock()
+	defer h.experimentMu.RUnlock()
+	return h.experiment
+}
+
+// setExperiment will start the given experiment. The counters are reset only
+// when the experiment changes, so a repeated experiment keeps its counters.
+func (h *hermes) setExperiment(e *Experiment) {
+	h.experimentMu.Lock()
+	defer h.experimentMu.Unlock()
+
+	if e == nil || h.experiment == nil || *e != *h.experiment {
+		h.cohortStats = make(map[string]*CohortStats)
+	}
+	h.experiment = e
+}
+
+// inCohort will check whether the given device belongs to the given cohort
+// of the current experiment.
+func (h *hermes) inCohort(mac string, cohort uint32) bool {
+	experiment := h.currentExperiment()
+	if experiment == nil {
+		return false
+	}
+	return experiment.cohortOf(mac) == cohort
+}
+
+// recordCohort will account a publish of a device in the counters of its
+// cohort.
+func (h *hermes) recordCohort(mac string, size int, sent bool) {
+	h.experimentMu.Lock()
+	defer h.experimentMu.Unlock()
+
+	if h.experiment == nil {
+		return
+	}
+
+	stats, ok := h.cohortStats[mac]
+	if !ok {
+		stats = &CohortStats{
+			MAC:        mac,
+			Experiment: h.experiment.ID,
+			Cohort:     h.experiment.cohortOf(mac),
+		}
+		h.cohortStats[mac] = stats
+	}
+
+	if !sent {
+		stats.Drops++
+		return
+	}
+	stats.Sends++
+	stats.PayloadBytes += size
+	stats.EnergyMah += h.sendEnergyMah + float32(size)*h.byteEnergyMah
+}
+
+// GetCohortStats will return a copy of the counters of a device, false is
+// returned if the device has no counters in the current experiment.
+func (h *hermes) GetCohortStats(mac string) (CohortStats, bool) {
+	h.experimentMu.RLock()
+	defer h.experimentMu.RUnlock()
+
+	stats, ok := h.cohortStats[mac]
+	if !ok {
+		return CohortStats{}, false
+	}
+	return *stats, true
+}
+
+// publishCohortStats will publish the counters of a device to Hades.
+func (h *hermes) publishCohortStats(c Client, mac string) error {
+	stats, ok := h.GetCohortStats(mac)
+	if !ok {
+		return nil
+	}
+
+	resp, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	statsTopic := fmt.Sprintf("%s/global/%s/experiment/stats", hadesPrefix, mac)
+	token := c.Publish(statsTopic, 1, false, resp)
+	if token.Error() != nil {
+		WARN.Println(HER, "publish of cohort stats has failed")
+		return token.Error()
+	}
+
+	return nil
+}
+
+// parseTopicCohort will parse the cohort from the last level of the topic.
+func parseTopicCohort(topic string) (uint32, error) {
+	tok := splitTopicSegments(topic)
+	cohort, err := strconv.ParseUint(tok[len(tok)-1], 10, 32)
+	return uint32(cohort), err
+}
+
+// HandleReceiveExperiment is called when Hades starts or ends an experiment.
+func (h *hermes) HandleReceiveExperiment(c Client, msg Message) {
+	experiment, err := parseExperiment(msg.Payload())
+	if err != nil {
+		WARN.Println(HER, "failed to parse received experiment:", err)
+		return
+	}
+
+	if experiment == nil {
+		DEBUG.Println(HER, "experiment has ended")
+	} else {
+		DEBUG.Println(HER, "received experiment", experiment.ID, "with",
+			experiment.Cohorts, "cohorts")
+	}
+	h.setExperiment(experiment)
+}
+
+// HandleReceiveCohortModel is called when a candidate model for a cohort was
+// received. The model is used only if the device belongs to the cohort.
+func (h *hermes) HandleReceiveCohortModel(c Client, msg Message) {
+	mac := parseTopicMac(msg.Topic())
+	cohort, err := parseTopicCohort(msg.Topic())
+	if err != nil {
+		WARN.Println(HER, "received model for invalid cohort:", err)
+		return
+	}
+
+	if !h.inCohort(mac, cohort) {
+		DEBUG.Println(HER, "ignoring model for cohort", cohort)
+		return
+	}
+	h.HandleReceiveModel(c, msg)
+}
+
+// HandleReceiveCohortManifest is called when a manifest of a candidate model
+// for a cohort was received.
+func (h *hermes) HandleReceiveCohortManifest(c Client, msg Message) {
+	mac := parseTopicMac(msg.Topic())
+	cohort, err := parseTopicCohort(msg.Topic())
+	if err != nil {
+		WARN.Println(HER, "received manifest for invalid cohort:", err)
+		return
+	}
+
+	if !h.inCohort(mac, cohort) {
+		DEBUG.Println(HER, "ignoring manifest for cohort", cohort)
+		return
+	}
+	h.HandleReceiveManifest(c, msg)
+}
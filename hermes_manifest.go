@@ -0,0 +1,285 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// OutputInterval means that the first output of the model is the send
+	// interval itself.
+	OutputInterval = "interval"
+	// OutputClasses means that the model outputs a score for every class and
+	// the class with the highest score is mapped to a send interval.
+	OutputClasses = "classes"
+)
+
+// Features which are always available for a device, values for any other
+// features have to be set by the application.
+const (
+	FeatureBatteryLeftMah  = "battery_left_mah"
+	FeatureTotalBatteryMah = "total_battery_mah"
+	FeatureBatteryLeft     = "battery_left"
+	FeatureRSSI            = "rssi"
+	FeatureSendInterval    = "send_interval"
+	FeatureHourOfDay       = "hour_of_day"
+)
+
+// ModelManifest is delivered by Hades alongside each model and describes
+// how the input tensor of the model is built from the features of a device
+// and how the output of the model is mapped to a send interval.
+type ModelManifest struct {
+	Inputs []ManifestInput `json:"inputs"`
+	Output ManifestOutput  `json:"output"`
+}
+
+// ManifestInput describes a single input of a model. The value of the named
+// feature is normalized as (value - Mean) / Scale before being passed to the
+// model.
+type ManifestInput struct {
+	Name  string  `json:"name"`
+	Mean  float32 `json:"mean"`
+	Scale float32 `json:"scale"`
+}
+
+// ManifestOutput describes the meaning of the model output. Unit is one of
+// "s", "m" or "h" and applies to the interval, the class intervals and the
+// Min/Max clamps. The interval is multiplied by Scale (if set) before it is
+// clamped. A zero Min or Max means that no clamp is applied.
+type ManifestOutput struct {
+	Type    string    `json:"type"`
+	Unit    string    `json:"unit"`
+	Classes []float32 `json:"classes"`
+	Scale   float32   `json:"scale,omitempty"`
+	Min     float32   `json:"min"`
+	Max     float32   `json:"max"`
+}
+
+// parseManifest will decode and validate a manifest received from Hades.
+func parseManifest(data []byte) (*ModelManifest, error) {
+	m := &ModelManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	if len(m.Inputs) == 0 {
+		return nil, fmt.Errorf("manifest has no inputs")
+	}
+
+	names := make(map[string]bool, len(m.Inputs))
+	for _, input := range m.Inputs {
+		if input.Name == "" {
+			return nil, fmt.Errorf("manifest input has no name")
+		}
+		if names[input.Name] {
+			return nil, fmt.Errorf("manifest input %q is duplicated", input.Name)
+		}
+		names[input.Name] = true
+	}
+
+	switch m.Output.Type {
+	case OutputInterval:
+	case OutputClasses:
+		if len(m.Output.Classes) == 0 {
+			return nil, fmt.Errorf("manifest output has no classes")
+		}
+	default:
+		return nil, fmt.Errorf("unknown manifest output type %q", m.Output.Type)
+	}
+
+	if _, err := manifestUnit(m.Output.Unit); err != nil {
+		return nil, err
+	}
+
+	if m.Output.Max != 0 && m.Output.Min > m.Output.Max {
+		return nil, fmt.Errorf("manifest output min is larger than max")
+	}
+
+	return m, nil
+}
+
+// manifestUnit will return the duration of a single unit of the output.
+func manifestUnit(unit string) (time.Duration, error) {
+	switch unit {
+	case "", "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown manifest output unit %q", unit)
+}
+
+// inputVector will build the input of the model from the given features in
+// the order declared by the manifest.
+func (m *ModelManifest) inputVector(features map[string]float32) ([]float32, error) {
+	input := make([]float32, len(m.Inputs))
+	for i, in := range m.Inputs {
+		value, ok := features[in.Name]
+		if !ok {
+			return nil, fmt.Errorf("feature %q is not available", in.Name)
+		}
+
+		scale := in.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		input[i] = (value - in.Mean) / scale
+	}
+
+	return input, nil
+}
+
+// sendInterval will map the output of the model to a send interval.
+func (m *ModelManifest) sendInterval(output []float32) (time.Duration, error) {
+	if len(output) == 0 {
+		return 0, fmt.Errorf("model output is empty")
+	}
+
+	var value float32
+	switch m.Output.Type {
+	case OutputInterval:
+		value = output[0]
+	case OutputClasses:
+		best := 0
+		for i := range output {
+			if output[i] > output[best] {
+				best = i
+			}
+		}
+		if best >= len(m.Output.Classes) {
+			return 0, fmt.Errorf("model output class %d has no interval", best)
+		}
+		value = m.Output.Classes[best]
+	default:
+		return 0, fmt.Errorf("unknown manifest output type %q", m.Output.Type)
+	}
+
+	if m.Output.Scale != 0 {
+		value *= m.Output.Scale
+	}
+	if m.Output.Min != 0 && value < m.Output.Min {
+		value = m.Output.Min
+	}
+	if m.Output.Max != 0 && value > m.Output.Max {
+		value = m.Output.Max
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("model output %f is not a valid interval", value)
+	}
+
+	unit, err := manifestUnit(m.Output.Unit)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(float64(value) * float64(unit)), nil
+}
+
+// SetFeature will set the value of a named feature of a device which can be
+// used as an input of a model.
+func (h *hermes) SetFeature(mac string, name string, value float32) {
+	h.rwMutex.Lock()
+	defer h.rwMutex.Unlock()
+	if h.features == nil {
+		h.features = make(map[string]map[string]float32)
+	}
+	if h.features[mac] == nil {
+		h.features[mac] = make(map[string]float32)
+	}
+	h.features[mac][name] = value
+}
+
+// deviceFeatures will return the features known for a device, including the
+// ones which are tracked by hermes itself.
+func (h *hermes) deviceFeatures(mac string) map[string]float32 {
+	h.rwMutex.RLock()
+	defer h.rwMutex.RUnlock()
+
+	features := map[string]float32{
+		FeatureBatteryLeftMah:  h.batteryLeftMah,
+		FeatureTotalBatteryMah: h.totalBatteryMah,
+		FeatureRSSI:            float32(h.rssi[mac]),
+		FeatureSendInterval:    float32(h.currentSendInterval[mac].Seconds()),
+		FeatureHourOfDay:       float32(clockOr(h.clock).Now().Hour()),
+	}
+	if h.totalBatteryMah != 0 {
+		features[FeatureBatteryLeft] = h.batteryLeftMah / h.totalBatteryMah
+	}
+	for name, value := range h.features[mac] {
+		features[name] = value
+	}
+
+	return features
+}
+
+// saveManifest will save the manifest next to the model of the device.
+func (h *hermes) saveManifest(data []byte, mac string) {
+	manifestName := h.modelPath(mac, "json")
+	err := ioutil.WriteFile(manifestName, data, 0644)
+	if err != nil {
+		ERROR.Println(err)
+	}
+}
+
+// loadManifests will load the manifests saved next to the models, so the
+// models received before a restart are run with them.
+func (h *hermes) loadManifests() {
+	files, err := ioutil.ReadDir(h.modelsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			WARN.Println(HER, "failed to read the saved manifests:", err)
+		}
+		return
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "model_") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		mac := strings.TrimSuffix(strings.TrimPrefix(name, "model_"), ".json")
+
+		data, err := ioutil.ReadFile(filepath.Join(h.modelsPath(), name))
+		if err != nil {
+			WARN.Println(HER, "failed to read the saved manifest:", err)
+			continue
+		}
+		manifest, err := parseManifest(data)
+		if err != nil {
+			WARN.Println(HER, "failed to parse the saved manifest of", mac, err)
+			continue
+		}
+		h.manifests[mac] = manifest
+	}
+}
+
+// modelSendInterval will run the model of the device with the inputs built
+// from the manifest and return the send interval the model suggests.
+func (h *hermes) modelSendInterval(mac string) (time.Duration, error) {
+	h.rwMutex.RLock()
+	manifest := h.manifests[mac]
+	h.rwMutex.RUnlock()
+
+	if manifest == nil {
+		return 0, fmt.Errorf("no manifest for %s", mac)
+	}
+
+	input, err := manifest.inputVector(h.deviceFeatures(mac))
+	if err != nil {
+		return 0, err
+	}
+
+	output, err := h.infer(mac, input)
+	if err != nil {
+		return 0, err
+	}
+
+	return manifest.sendInterval(output)
+}
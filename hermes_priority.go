@@ -0,0 +1,100 @@
+package mqtt
+
+import "errors"
+
+// PriorityClass is used by hermes to decide how a publish to a topic is
+// scheduled.
+type PriorityClass int
+
+const (
+	// PriorityNormal publishes are sent only when the send window allows.
+	PriorityNormal PriorityClass = iota
+	// PriorityAlarm publishes are always sent and can reset the send window.
+	PriorityAlarm
+	// PriorityBulk publishes are sent only when the send window allows and
+	// the battery is above the bulk battery threshold.
+	PriorityBulk
+)
+
+// TopicPriority assigns a PriorityClass to all topics matching the filter.
+// The filter may contain the same wildcards as a subscription.
+type TopicPriority struct {
+	Filter string
+	Class  PriorityClass
+}
+
+// ErrHermesSendDisabled is the error returned when a publish was dropped
+// because the send window of the device does not allow sending
+var ErrHermesSendDisabled = errors.New("QoS too small or send disabled")
+
+// ErrHermesBatteryLow is the error returned when a bulk publish was dropped
+// because the battery of the device is below the bulk battery threshold
+var ErrHermesBatteryLow = errors.New("battery too low for bulk data")
+
+// priorityClass will return the class of the first priority whose filter
+// matches the topic, topics which match no filter are normal.
+func (h *hermes) priorityClass(topic string) PriorityClass {
+	for _, p := range h.priorities {
+		if routeIncludesTopic(p.Filter, topic) {
+			return p.Class
+		}
+	}
+	return PriorityNormal
+}
+
+// batteryAbove will check whether the battery left is above the given part
+// of the total battery. If the total battery is not known the device is
+// assumed to be powered.
+func (h *hermes) batteryAbove(threshold float32) bool {
+	h.rwMutex.RLock()
+	defer h.rwMutex.RUnlock()
+
+	if h.totalBatteryMah == 0 {
+		return true
+	}
+	return h.batteryLeftMah/h.totalBatteryMah > threshold
+}
+
+// allowPublish will decide whether a publish to the topic of a device can be
+// sent now. Without any priorities only publishes with QoS >= 1 bypass the
+// send window, otherwise the priority class of the topic decides.
+func (h *hermes) allowPublish(c *client, topic string, mac string, qos byte) error {
+	if len(h.priorities) == 0 {
+		if qos >= 1 || h.GetCanSend(c, mac) {
+			return nil
+		}
+		return ErrHermesSendDisabled
+	}
+
+	switch h.priorityClass(topic) {
+	case PriorityAlarm:
+		if h.alarmResetsWindow {
+			h.resetWindow(mac)
+		}
+		return nil
+	case PriorityBulk:
+		if !h.batteryAbove(h.bulkBatteryThreshold) {
+			return ErrHermesBatteryLow
+		}
+	}
+
+	if !h.GetCanSend(c, mac) {
+		return ErrHermesSendDisabled
+	}
+	return nil
+}
+
+// resetWindow will restart the send window of a device, so the next normal
+// publish is allowed only after a full send interval.
+func (h *hermes) resetWindow(mac string) {
+	h.rwMutex.Lock()
+	defer h.rwMutex.Unlock()
+
+	if h.sendTicker[mac] == nil || h.currentSendInterval[mac] == 0 {
+		return
+	}
+
+	h.sendTicker[mac].Stop()
+	h.sendTicker[mac] = clockOr(h.clock).NewTicker(h.currentSendInterval[mac])
+	h.canSend[mac] = false
+}
@@ -32,6 +32,28 @@ func (r *ClientHermesReader) GetHandlers() []TopicHandler {
 	return h
 }
 
+// CallSetRSSI will set the signal strength of a device as seen by the
+// application, it is captured in the samples uploaded to Hades.
+func (r *ClientHermesReader) CallSetRSSI(mac string, rssi int) {
+	r.hermes.SetRSSI(mac, rssi)
+}
+
+// CallSetBatteryLeftMah will update the battery that is left for the device.
+func (r *ClientHermesReader) CallSetBatteryLeftMah(battery float32) {
+	r.hermes.SetBatteryLeftMah(battery)
+}
+
+// CallSetFeature will set the value of a named device feature which is used
+// as a model input when the model manifest refers to it.
+func (r *ClientHermesReader) CallSetFeature(mac string, name string, value float32) {
+	r.hermes.SetFeature(mac, name, value)
+}
+
+// CallGetCohortStats will return the experiment counters of a device.
+func (r *ClientHermesReader) CallGetCohortStats(mac string) (CohortStats, bool) {
+	return r.hermes.GetCohortStats(mac)
+}
+
 func (r *ClientHermesReader) Finalize() {
 	r.hermes.Reset()
 }
@@ -2,12 +2,15 @@ package mqtt
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/aretas77/paho.mqtt.golang/broker"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -139,16 +142,83 @@ func TestHermesGetSetSendInterval(t *testing.T) {
 	assert.Equal(t, current_interval, time.Minute*5)
 }
 
+func TestHermesReceiveInterval(t *testing.T) {
+	hermes := &hermes{}
+	hermes.Initialize()
+	mac := "AA:BB:CC:DD:EE:FF"
+	topic := fmt.Sprintf("node/global/%s/hades/interval/receive", mac)
+
+	var intervalTests = []struct {
+		payload  string
+		duration time.Duration
+	}{
+		{`{"send_interval":2}`, time.Minute * 2},
+		// fractions of a minute are kept.
+		{`{"send_interval":0.5}`, time.Second * 30},
+		// the intervals which are not positive are rejected.
+		{`{"send_interval":0}`, 0},
+		{`{"send_interval":-1}`, 0},
+	}
+
+	for _, test := range intervalTests {
+		go hermes.HandleReceiveInterval(nil, &message{topic: topic, payload: []byte(test.payload)})
+
+		select {
+		case timer := <-hermes.setTimer:
+			assert.Equal(t, test.duration, timer.duration, test.payload)
+			assert.Equal(t, mac, timer.mac, test.payload)
+		case <-time.After(100 * time.Millisecond):
+			assert.Zero(t, test.duration, test.payload)
+		}
+	}
+}
+
+func TestHermesSendTimerStop(t *testing.T) {
+	for _, stopClient := range []bool{false, true} {
+		hermes := &hermes{}
+		hermes.Initialize()
+		c := &client{stop: make(chan struct{})}
+		c.workers.Add(1)
+		go hermes.sendTimer(c)
+
+		if stopClient {
+			close(c.stop)
+		} else {
+			close(hermes.stop)
+		}
+
+		// the loop returns and marks itself as stopped.
+		done := make(chan struct{})
+		go func() {
+			c.workers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("send timer did not stop (client stopped = %t)", stopClient)
+		}
+		hermes.rwMutex.RLock()
+		assert.False(t, hermes.sendLoopOperating)
+		hermes.rwMutex.RUnlock()
+	}
+}
+
 func TestHermesSaveModel(t *testing.T) {
 	modelData := []byte{0x1c, 0x00, 0x00, 0x00, 0x54, 0x46, 0x4c, 0x33}
-	hermes := &hermes{}
+	dir, err := ioutil.TempDir("", "hermes_models")
+	if err != nil {
+		t.Fatalf("failed to create a models directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	hermes := &hermes{modelDir: dir}
 	mac := "00:00:00:00:00:00"
 
 	// save test model data
 	hermes.saveModel(modelData, mac)
 
 	// confirm that the model was written to
-	savedModelName := fmt.Sprintf("%s/model_%s.tflite", modelsDir, mac)
+	savedModelName := fmt.Sprintf("%s/model_%s.tflite", dir, mac)
 
 	data, err := ioutil.ReadFile(savedModelName)
 	if err != nil {
@@ -182,7 +252,7 @@ func TestHermesGetCanSend(t *testing.T) {
 	for _, data := range testData {
 		if data.canSend {
 			hermes.canSend[data.mac] = data.canSend
-			hermes.sendTicker[data.mac] = time.NewTicker(data.time)
+			hermes.sendTicker[data.mac] = SystemClock.NewTicker(data.time)
 			count++
 		}
 	}
@@ -211,3 +281,355 @@ func TestHermesParseMac(t *testing.T) {
 		assert.Equal(t, test.result, parseTopicMac(test.topic), "Result is invalid")
 	}
 }
+
+func TestHermesSampleRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermes_samples")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ring := newSampleRing(dir, 3)
+	assert.Nil(t, ring.open())
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, ring.push(&Sample{MAC: "AA:BB:CC:DD:EE:FF", Publishes: i}))
+	}
+	assert.Equal(t, 3, ring.len())
+
+	// the oldest samples should have been overwritten
+	keys, samples, err := ring.peek(2)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, 2, samples[0].Publishes)
+	assert.Equal(t, 3, samples[1].Publishes)
+
+	// the ring should be restored after reopening
+	ring = newSampleRing(dir, 3)
+	assert.Nil(t, ring.open())
+	assert.Equal(t, 3, ring.len())
+
+	ring.drop(keys)
+	assert.Equal(t, 1, ring.len())
+	_, samples, err = ring.peek(10)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, samples[0].Publishes)
+}
+
+func TestHermesCaptureWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermes_samples")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mac := "AA:BB:CC:DD:EE:FF"
+	hermes := &hermes{capture: newSampleRing(dir, 10), captureBatchSize: 2}
+	hermes.Initialize()
+	hermes.batteryLeftMah = 150
+	hermes.SetRSSI(mac, -70)
+
+	hermes.recordPublish(mac, 10, true)
+	hermes.recordPublish(mac, 20, true)
+	hermes.recordPublish(mac, 30, false)
+	hermes.closeWindow(mac)
+
+	_, samples, err := hermes.capture.peek(1)
+	assert.Nil(t, err)
+	assert.Len(t, samples, 1)
+	assert.Equal(t, 2, samples[0].Publishes)
+	assert.Equal(t, 1, samples[0].Dropped)
+	assert.Equal(t, 30, samples[0].PayloadBytes)
+	assert.Equal(t, float32(150), samples[0].BatteryLeftMah)
+	assert.Equal(t, -70, samples[0].RSSI)
+
+	// a new window should be opened after closing the previous one
+	assert.Zero(t, hermes.windows[mac].Publishes)
+}
+
+func TestHermesUploadSamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermes_samples")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := broker.New()
+	defer b.Close()
+	l, err := ListenMem("hermes-upload")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	go b.Serve(l)
+
+	client := NewClient(NewClientOptions().AddBroker("mem://hermes-upload"))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("client failed to connect: %s", token.Error())
+	}
+	defer client.Disconnect(0)
+
+	uploads := make(chan Message, 4)
+	token := client.Subscribe("hades/global/+/dataset/upload", 1, func(_ Client, m Message) {
+		uploads <- m
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("client failed to subscribe: %s", token.Error())
+	}
+
+	hermes := &hermes{capture: newSampleRing(dir, 10), captureBatchSize: 3}
+	assert.Nil(t, hermes.capture.open())
+	for _, mac := range []string{"AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02", "AA:BB:CC:DD:EE:01"} {
+		assert.Nil(t, hermes.capture.push(&Sample{MAC: mac}))
+	}
+	hermes.startUpload(client)
+
+	// every device gets its own upload with only its samples.
+	expected := map[string]int{"AA:BB:CC:DD:EE:01": 2, "AA:BB:CC:DD:EE:02": 1}
+	for range expected {
+		select {
+		case m := <-uploads:
+			mac := parseTopicMac(m.Topic())
+			zr, err := gzip.NewReader(bytes.NewReader(m.Payload()))
+			assert.Nil(t, err)
+			samples := []*Sample{}
+			assert.Nil(t, json.NewDecoder(zr).Decode(&samples))
+			assert.Len(t, samples, expected[mac], m.Topic())
+			for _, s := range samples {
+				assert.Equal(t, mac, s.MAC, m.Topic())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("samples were not uploaded")
+		}
+	}
+
+	for i := 0; hermes.capture.len() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("uploaded samples were not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHermesEncodeSamples(t *testing.T) {
+	samples := []*Sample{{MAC: "AA:BB:CC:DD:EE:FF", Publishes: 3}}
+
+	data, err := encodeSamples(samples)
+	assert.Nil(t, err)
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	decoded := []*Sample{}
+	assert.Nil(t, json.NewDecoder(zr).Decode(&decoded))
+	assert.Equal(t, samples, decoded)
+}
+
+func TestHermesParseManifest(t *testing.T) {
+	var manifestTests = []struct {
+		manifest string
+		valid    bool
+	}{
+		{`{"inputs":[{"name":"rssi"}],"output":{"type":"interval"}}`, true},
+		{`{"inputs":[{"name":"rssi"}],"output":{"type":"classes","classes":[1,5]}}`, true},
+		{`{"inputs":[],"output":{"type":"interval"}}`, false},
+		{`{"inputs":[{"name":"rssi"},{"name":"rssi"}],"output":{"type":"interval"}}`, false},
+		{`{"inputs":[{"name":"rssi"}],"output":{"type":"classes"}}`, false},
+		{`{"inputs":[{"name":"rssi"}],"output":{"type":"unknown"}}`, false},
+		{`{"inputs":[{"name":"rssi"}],"output":{"type":"interval","unit":"d"}}`, false},
+		{`{"inputs":[{"name":"rssi"}],"output":{"type":"interval","min":5,"max":1}}`, false},
+		{`not a manifest`, false},
+	}
+
+	for _, test := range manifestTests {
+		_, err := parseManifest([]byte(test.manifest))
+		assert.Equal(t, test.valid, err == nil, test.manifest)
+	}
+}
+
+func TestHermesLoadManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermes_models")
+	if err != nil {
+		t.Fatalf("failed to create a models directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	mac := "AA:BB:CC:DD:EE:FF"
+	topic := fmt.Sprintf("node/global/%s/hades/manifest/receive", mac)
+
+	received := &hermes{modelDir: dir}
+	received.Initialize()
+	received.HandleReceiveManifest(nil, &message{
+		topic:   topic,
+		payload: []byte(`{"inputs":[{"name":"rssi"}],"output":{"type":"interval","unit":"m"}}`),
+	})
+	ioutil.WriteFile(dir+"/model_invalid.json", []byte("not a manifest"), 0644)
+
+	// the manifest is loaded again after a restart.
+	restarted := &hermes{modelDir: dir}
+	restarted.Initialize()
+	assert.Equal(t, received.manifests[mac], restarted.manifests[mac])
+	assert.Len(t, restarted.manifests, 1)
+}
+
+func TestHermesManifestInputVector(t *testing.T) {
+	manifest := &ModelManifest{
+		Inputs: []ManifestInput{
+			{Name: FeatureRSSI, Mean: -60, Scale: 10},
+			{Name: FeatureBatteryLeft},
+		},
+	}
+
+	input, err := manifest.inputVector(map[string]float32{
+		FeatureBatteryLeft: 0.5,
+		FeatureRSSI:        -80,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []float32{-2, 0.5}, input)
+
+	_, err = manifest.inputVector(map[string]float32{FeatureRSSI: -80})
+	assert.NotNil(t, err)
+}
+
+func TestHermesManifestSendInterval(t *testing.T) {
+	var intervalTests = []struct {
+		output   ManifestOutput
+		values   []float32
+		expected time.Duration
+	}{
+		{ManifestOutput{Type: OutputInterval}, []float32{30}, time.Second * 30},
+		{ManifestOutput{Type: OutputInterval, Unit: "m"}, []float32{2}, time.Minute * 2},
+		{ManifestOutput{Type: OutputInterval, Min: 10}, []float32{1}, time.Second * 10},
+		{ManifestOutput{Type: OutputInterval, Max: 60}, []float32{600}, time.Second * 60},
+		{ManifestOutput{Type: OutputInterval, Scale: 60, Max: 600}, []float32{2}, time.Second * 120},
+		{ManifestOutput{Type: OutputClasses, Unit: "m", Classes: []float32{1, 5, 10}},
+			[]float32{0.1, 0.7, 0.2}, time.Minute * 5},
+	}
+
+	for _, test := range intervalTests {
+		manifest := &ModelManifest{Output: test.output}
+		interval, err := manifest.sendInterval(test.values)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, interval)
+	}
+
+	manifest := &ModelManifest{Output: ManifestOutput{Type: OutputInterval}}
+	_, err := manifest.sendInterval([]float32{-1})
+	assert.NotNil(t, err)
+}
+
+func TestHermesDeviceFeatures(t *testing.T) {
+	mac := "AA:BB:CC:DD:EE:FF"
+	hermes := &hermes{batteryLeftMah: 50, totalBatteryMah: 200}
+	hermes.Initialize()
+	hermes.SetRSSI(mac, -70)
+	hermes.SetFeature(mac, "temperature", 21.5)
+
+	features := hermes.deviceFeatures(mac)
+	assert.Equal(t, float32(-70), features[FeatureRSSI])
+	assert.Equal(t, float32(0.25), features[FeatureBatteryLeft])
+	assert.Equal(t, float32(21.5), features["temperature"])
+}
+
+func TestHermesExperimentCohort(t *testing.T) {
+	experiment := &Experiment{ID: "exp-1", Cohorts: 3}
+	macs := []string{"AA:BB:CC:DD:EE:FF", "AA:BB:CC:DD:EE:FB", "AA:BB:CC:DD:EE:FA"}
+
+	for _, mac := range macs {
+		cohort := experiment.cohortOf(mac)
+		assert.True(t, cohort < experiment.Cohorts)
+		assert.Equal(t, cohort, experiment.cohortOf(mac), "cohort is not stable")
+	}
+
+	_, err := parseExperiment([]byte(`{"id":"exp-1","cohorts":0}`))
+	assert.NotNil(t, err)
+
+	e, err := parseExperiment([]byte(`{"id":""}`))
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+}
+
+func TestHermesExperimentStats(t *testing.T) {
+	mac := "AA:BB:CC:DD:EE:FF"
+	hermes := &hermes{sendEnergyMah: 0.5, byteEnergyMah: 0.01}
+	hermes.Initialize()
+
+	// nothing is counted without an experiment
+	hermes.recordPublish(mac, 10, true)
+	_, ok := hermes.GetCohortStats(mac)
+	assert.False(t, ok)
+
+	hermes.HandleReceiveExperiment(nil, &message{
+		topic:   "hermes/node/global/" + mac + "/hades/experiment/receive",
+		payload: []byte(`{"id":"exp-1","cohorts":2}`),
+	})
+
+	hermes.recordPublish(mac, 100, true)
+	hermes.recordPublish(mac, 100, false)
+
+	stats, ok := hermes.GetCohortStats(mac)
+	assert.True(t, ok)
+	assert.Equal(t, "exp-1", stats.Experiment)
+	assert.Equal(t, 1, stats.Sends)
+	assert.Equal(t, 1, stats.Drops)
+	assert.InDelta(t, 1.5, stats.EnergyMah, 0.0001)
+
+	payload := hermes.requestPayload(mac)
+	assert.Equal(t, "exp-1", payload.Experiment)
+	if assert.NotNil(t, payload.Cohort) {
+		assert.Equal(t, stats.Cohort, *payload.Cohort)
+	}
+	assert.True(t, hermes.inCohort(mac, stats.Cohort))
+	assert.False(t, hermes.inCohort(mac, stats.Cohort+1))
+
+	// a new experiment resets the counters
+	hermes.setExperiment(&Experiment{ID: "exp-2", Cohorts: 2})
+	_, ok = hermes.GetCohortStats(mac)
+	assert.False(t, ok)
+
+	// without an experiment the request carries no cohort
+	hermes.setExperiment(nil)
+	data, err := json.Marshal(hermes.requestPayload(mac))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "cohort")
+}
+
+func TestHermesPriorityClass(t *testing.T) {
+	hermes := &hermes{
+		priorities: []TopicPriority{
+			{"sensors/+/alarm", PriorityAlarm},
+			{"sensors/#", PriorityBulk},
+		},
+	}
+
+	assert.Equal(t, PriorityAlarm, hermes.priorityClass("sensors/door/alarm"))
+	assert.Equal(t, PriorityBulk, hermes.priorityClass("sensors/door/log"))
+	assert.Equal(t, PriorityNormal, hermes.priorityClass("status/door"))
+}
+
+func TestHermesAllowPublish(t *testing.T) {
+	mac := "AA:BB:CC:DD:EE:FF"
+	hermes := &hermes{
+		batteryLeftMah:       20,
+		totalBatteryMah:      100,
+		alarmResetsWindow:    true,
+		bulkBatteryThreshold: 0.5,
+	}
+	hermes.Initialize()
+
+	// without priorities QoS >= 1 bypasses the closed window
+	hermes.currentSendInterval[mac] = time.Minute
+	hermes.sendTicker[mac] = SystemClock.NewTicker(time.Minute)
+	hermes.canSend[mac] = false
+	assert.Nil(t, hermes.allowPublish(nil, "status/"+mac, mac, 1))
+	assert.Equal(t, ErrHermesSendDisabled, hermes.allowPublish(nil, "status/"+mac, mac, 0))
+
+	hermes.priorities = []TopicPriority{
+		{"alarm/#", PriorityAlarm},
+		{"bulk/#", PriorityBulk},
+	}
+	assert.Nil(t, hermes.allowPublish(nil, "alarm/"+mac, mac, 0))
+	assert.Equal(t, ErrHermesSendDisabled, hermes.allowPublish(nil, "status/"+mac, mac, 1))
+	assert.Equal(t, ErrHermesBatteryLow, hermes.allowPublish(nil, "bulk/"+mac, mac, 0))
+
+	hermes.batteryLeftMah = 80
+	assert.Equal(t, ErrHermesSendDisabled, hermes.allowPublish(nil, "bulk/"+mac, mac, 0))
+}
@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// inflightWindow limits the number of QoS 1 and 2 publishes which have been
+// sent but not yet acknowledged. Publishes beyond the limit wait in order
+// until an acknowledgement frees a slot, they are already persisted in the
+// Store so a reconnect resends them through resume.
+type inflightWindow struct {
+	sync.Mutex
+	max     int
+	count   int
+	pending *list.List
+}
+
+func newInflightWindow() *inflightWindow {
+	return &inflightWindow{pending: list.New()}
+}
+
+// reset will empty the window for a new connection with the given limit,
+// 0 means no limit.
+func (w *inflightWindow) reset(max int) {
+	w.Lock()
+	defer w.Unlock()
+	w.max = max
+	w.count = 0
+	w.pending.Init()
+}
+
+// acquire will take a slot for the publish, false is returned if the window
+// is full and the publish was queued.
+func (w *inflightWindow) acquire(p *PacketAndToken) bool {
+	w.Lock()
+	defer w.Unlock()
+	if w.max == 0 || (w.count < w.max && w.pending.Len() == 0) {
+		w.count++
+		return true
+	}
+	w.pending.PushBack(p)
+	return false
+}
+
+// track will count a message which is in flight regardless of the limit,
+// it is used for the PUBREL of a QoS 2 flow resumed after a reconnect.
+func (w *inflightWindow) track() {
+	w.Lock()
+	defer w.Unlock()
+	w.count++
+}
+
+// remove will take the publish of the token out of the queue, false is
+// returned if it is not queued.
+func (w *inflightWindow) remove(t tokenCompletor) bool {
+	w.Lock()
+	defer w.Unlock()
+	for e := w.pending.Front(); e != nil; e = e.Next() {
+		if e.Value.(*PacketAndToken).t == t {
+			w.pending.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+// release will free the slot of an acknowledged publish and return the next
+// queued publish which took the slot, if any.
+func (w *inflightWindow) release() *PacketAndToken {
+	w.Lock()
+	defer w.Unlock()
+	if w.count > 0 {
+		w.count--
+	}
+	if e := w.pending.Front(); e != nil && (w.max == 0 || w.count < w.max) {
+		w.count++
+		return w.pending.Remove(e).(*PacketAndToken)
+	}
+	return nil
+}
+
+// inflightMax returns the limit of the in-flight window for a connection,
+// the smaller of MaxInflight and the Receive Maximum sent by the server.
+func inflightMax(o *ClientOptions, connack *packets.Properties) int {
+	max := int(o.MaxInflight)
+	if connack != nil && connack.ReceiveMaximum != nil {
+		if rm := int(*connack.ReceiveMaximum); max == 0 || rm < max {
+			max = rm
+		}
+	}
+	return max
+}
+
+// releaseInflight will free the slot of an acknowledged publish and send
+// the next queued publish.
+func (c *client) releaseInflight() {
+	next := c.inflight.release()
+	if next == nil {
+		return
+	}
+	DEBUG.Println(NET, "sending queued publish, id:", next.p.Details().MessageID)
+	select {
+	case c.obound <- next:
+	case <-c.stop:
+	}
+}
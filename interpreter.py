@@ -89,6 +89,33 @@ class Interpreter:
         output_data = interpreter.get_tensor(output_details[0]['index'])
         return output_data[0].tolist()
 
+    def infer(self, inputs):
+        """infer runs the model of the device with the given inputs. The inputs
+        are built by hermes from the model manifest, so the interpreter does
+        not need to know anything about the model architecture. The output is
+        returned as a flat list.
+
+        Args:
+            inputs: is a list of already normalized input values.
+        """
+        path = os.path.join(self.models_dir, self.modelname)
+        interpreter = self.init_interpreter(path)
+
+        input_details = interpreter.get_input_details()
+        output_details = interpreter.get_output_details()
+
+        # The last dimension of the input should hold all of the features.
+        input_shape = input_details[0]['shape']
+        assert input_shape[-1] == len(inputs), (input_shape, len(inputs))
+
+        input_data = np.array(inputs, dtype=np.float32).reshape(input_shape)
+        interpreter.set_tensor(input_details[0]['index'], input_data)
+
+        interpreter.invoke()
+
+        output_data = interpreter.get_tensor(output_details[0]['index'])
+        return output_data.flatten().tolist()
+
     def assert_shape(self, x, shape: list):
         """assert_shape will be used to check whether an input or output shape
         corresponds to the expected shape. Example:
@@ -108,6 +135,12 @@ def start(device_mac):
     return
 
 
+def infer(device_mac, inputs):
+    # infer is called by hermes to run the model of a device.
+    interpreter = Interpreter(device_mac, os.environ.get("PYTHONPATH", "."))
+    return interpreter.infer(inputs)
+
+
 """
 Methods used primarily for TensorFlow Lite testing.
 """
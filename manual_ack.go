@@ -0,0 +1,211 @@
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// ErrAckTimeout is the error of the connection lost when a message was not
+// acknowledged within the AckTimeout and AckTimeoutDisconnect is set.
+var ErrAckTimeout = errors.New("message not acknowledged in time")
+
+// pendingAck is a QoS 1 or 2 message received with AutoAck disabled whose
+// acknowledgement has not been sent yet.
+type pendingAck struct {
+	packet   *packets.PublishPacket
+	received time.Time
+	acked    bool
+	warned   bool
+}
+
+// ackQueue holds the acknowledgements of the messages received with
+// AutoAck disabled, they are sent in the order the messages were received
+// as MQTT requires, whatever the order the handlers call Ack in.
+type ackQueue struct {
+	sync.Mutex
+	entries *list.List
+	// slots holds a value for each message not yet acknowledged, the
+	// delivery waits while it is full.
+	slots chan struct{}
+	// generation is increased for each connection, the acknowledgements of
+	// the messages of a lost connection are ignored.
+	generation uint64
+	// ready holds the acknowledgements which can be sent, a single caller
+	// of ack sends them at a time without the queue locked.
+	ready   []*packets.PublishPacket
+	sending bool
+}
+
+// newAckQueue returns the queue of the acknowledgements for the options,
+// nil if AutoAck is enabled.
+func newAckQueue(o *ClientOptions) *ackQueue {
+	if o.AutoAck {
+		return nil
+	}
+	q := &ackQueue{entries: list.New()}
+	if o.MaxUnacked > 0 {
+		q.slots = make(chan struct{}, o.MaxUnacked)
+	}
+	return q
+}
+
+// reset will forget the messages of the previous connection, the server
+// sends them again.
+func (q *ackQueue) reset() {
+	q.Lock()
+	defer q.Unlock()
+	q.generation++
+	q.entries.Init()
+	q.ready = nil
+	if q.slots != nil {
+		q.slots = make(chan struct{}, cap(q.slots))
+	}
+}
+
+// add will queue the acknowledgement of the message and return the
+// function which acknowledges it. It waits while MaxUnacked messages are
+// not acknowledged, which stops the delivery of the next messages.
+func (q *ackQueue) add(c *client, packet *packets.PublishPacket) func() {
+	if packet.Qos == 0 {
+		return func() {}
+	}
+	for {
+		q.Lock()
+		slots, generation := q.slots, q.generation
+		q.Unlock()
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-c.stop:
+				return func() {}
+			}
+		}
+
+		q.Lock()
+		if generation != q.generation {
+			// the slot was taken from the channel of a lost connection
+			q.Unlock()
+			continue
+		}
+		e := q.entries.PushBack(&pendingAck{packet: packet, received: c.options.Clock.Now()})
+		q.Unlock()
+		return func() {
+			q.ack(c, e, generation)
+		}
+	}
+}
+
+// ack will mark the message as acknowledged and send the acknowledgements
+// which are no longer waiting for an earlier message. They are sent without
+// the queue locked, by one caller at a time so they stay in order.
+func (q *ackQueue) ack(c *client, e *list.Element, generation uint64) {
+	q.Lock()
+	if generation != q.generation {
+		q.Unlock()
+		return
+	}
+	e.Value.(*pendingAck).acked = true
+	for f := q.entries.Front(); f != nil && f.Value.(*pendingAck).acked; f = q.entries.Front() {
+		q.entries.Remove(f)
+		if q.slots != nil {
+			<-q.slots
+		}
+		q.ready = append(q.ready, f.Value.(*pendingAck).packet)
+	}
+	if q.sending {
+		// the caller already sending takes these as well
+		q.Unlock()
+		return
+	}
+	q.sending = true
+	for len(q.ready) > 0 {
+		ready := q.ready
+		q.ready = nil
+		q.Unlock()
+		for _, p := range ready {
+			c.sendAck(p)
+		}
+		q.Lock()
+	}
+	q.sending = false
+	q.Unlock()
+}
+
+// oldest returns the time the oldest message not acknowledged and not yet
+// reported was received, ok is false if there is none.
+func (q *ackQueue) oldest() (received time.Time, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	for e := q.entries.Front(); e != nil; e = e.Next() {
+		if p := e.Value.(*pendingAck); !p.acked && !p.warned {
+			return p.received, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// expire will report the messages not acknowledged since the deadline and
+// return how many there were.
+func (q *ackQueue) expire(deadline time.Time) int {
+	q.Lock()
+	defer q.Unlock()
+	n := 0
+	for e := q.entries.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*pendingAck)
+		if p.acked || p.warned || p.received.After(deadline) {
+			continue
+		}
+		p.warned = true
+		n++
+		WARN.Println(CLI, "message not acknowledged in time, id:", p.packet.MessageID, "topic:", p.packet.TopicName)
+	}
+	return n
+}
+
+// startAcks will forget the acknowledgements of the previous connection
+// and watch those of the new one for the AckTimeout, before the messages
+// of the new connection are received.
+func (c *client) startAcks() {
+	if c.acks == nil {
+		return
+	}
+	c.acks.reset()
+	if c.options.AckTimeout > 0 {
+		c.workers.Add(1)
+		go ackWatch(c)
+	}
+}
+
+// ackWatch will report the messages which are not acknowledged within the
+// AckTimeout, and end the connection if AckTimeoutDisconnect is set.
+func ackWatch(c *client) {
+	defer c.workers.Done()
+	timeout := c.options.AckTimeout
+	clock := c.options.Clock
+	for {
+		wait := timeout
+		if received, ok := c.acks.oldest(); ok {
+			wait = received.Add(timeout).Sub(clock.Now())
+		}
+		if wait <= 0 {
+			if c.acks.expire(clock.Now().Add(-timeout)) > 0 && c.options.AckTimeoutDisconnect {
+				ERROR.Println(CLI, "message not acknowledged in time, disconnecting")
+				signalError(c.errors, ErrAckTimeout)
+				return
+			}
+			continue
+		}
+
+		timer := clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-c.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
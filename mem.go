@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrMemAddrInUse is returned by ListenMem when a listener already has the
+// name.
+var ErrMemAddrInUse = errors.New("mem listener name already in use")
+
+var memListeners = struct {
+	sync.Mutex
+	names map[string]*memListener
+}{names: make(map[string]*memListener)}
+
+// memAddr is the address of both ends of an in-memory connection.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memListener is a net.Listener for the in-memory transport, the
+// connections are the broker ends of net.Pipe pairs.
+type memListener struct {
+	name   string
+	conns  chan net.Conn
+	done   chan struct{}
+	closed sync.Once
+}
+
+// ListenMem returns a net.Listener for the in-memory transport, the clients
+// connect to it with a broker URL of mem://<name>. It lets a broker such as
+// the one of the broker package run in the same process without a network.
+func ListenMem(name string) (net.Listener, error) {
+	memListeners.Lock()
+	defer memListeners.Unlock()
+	if _, ok := memListeners.names[name]; ok {
+		return nil, ErrMemAddrInUse
+	}
+	l := &memListener{name: name, conns: make(chan net.Conn), done: make(chan struct{})}
+	memListeners.names[name] = l
+	return l, nil
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("mem listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closed.Do(func() {
+		memListeners.Lock()
+		delete(memListeners.names, l.name)
+		memListeners.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.name)
+}
+
+// dialMem opens an in-memory connection to the listener with the name, a
+// timeout of 0 waits until the listener accepts it.
+func dialMem(name string, timeout time.Duration) (net.Conn, error) {
+	var err error
+	memListeners.Lock()
+	l, ok := memListeners.names[name]
+	memListeners.Unlock()
+	if !ok {
+		return nil, errors.New("no mem listener named " + name)
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	client, broker := net.Pipe()
+	select {
+	case l.conns <- broker:
+		return client, nil
+	case <-l.done:
+		err = errors.New("mem listener closed")
+	case <-expired:
+		err = errors.New("mem listener did not accept the connection in time")
+	}
+	client.Close()
+	broker.Close()
+	return nil, err
+}
@@ -16,9 +16,10 @@ package mqtt
 
 import (
 	"net/url"
-
-	"github.com/eclipse/paho.mqtt.golang/packets"
 	"sync"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 // Message defines the externals that a message implementation must support
@@ -31,18 +32,26 @@ type Message interface {
 	Topic() string
 	MessageID() uint16
 	Payload() []byte
+	Properties() *packets.Properties
+	UserProperties() []packets.UserProperty
+	ContentType() string
+	PayloadFormat() byte
+	MessageExpiry() time.Duration
+	ResponseTopic() string
+	CorrelationData() []byte
 	Ack()
 }
 
 type message struct {
-	duplicate bool
-	qos       byte
-	retained  bool
-	topic     string
-	messageID uint16
-	payload   []byte
-	once      sync.Once
-	ack       func()
+	duplicate  bool
+	qos        byte
+	retained   bool
+	topic      string
+	messageID  uint16
+	payload    []byte
+	properties *packets.Properties
+	once       sync.Once
+	ack        func()
 }
 
 func (m *message) Duplicate() bool {
@@ -69,19 +78,78 @@ func (m *message) Payload() []byte {
 	return m.payload
 }
 
+// Properties returns the properties of a message received with MQTT 5, it
+// is nil for older versions.
+func (m *message) Properties() *packets.Properties {
+	return m.properties
+}
+
+// UserProperties returns the user properties of the message in the order
+// they were sent.
+func (m *message) UserProperties() []packets.UserProperty {
+	if m.properties == nil {
+		return nil
+	}
+	return m.properties.User
+}
+
+// ContentType returns the MIME type of the payload, if it was sent.
+func (m *message) ContentType() string {
+	if m.properties == nil {
+		return ""
+	}
+	return m.properties.ContentType
+}
+
+// PayloadFormat returns PayloadFormatUTF8 if the payload is UTF-8 encoded
+// text, PayloadFormatBytes otherwise.
+func (m *message) PayloadFormat() byte {
+	if m.properties == nil || m.properties.PayloadFormat == nil {
+		return PayloadFormatBytes
+	}
+	return *m.properties.PayloadFormat
+}
+
+// MessageExpiry returns the remaining lifetime of the message as sent by the
+// server, zero means that the message does not expire.
+func (m *message) MessageExpiry() time.Duration {
+	if m.properties == nil || m.properties.MessageExpiry == nil {
+		return 0
+	}
+	return time.Duration(*m.properties.MessageExpiry) * time.Second
+}
+
+// ResponseTopic returns the topic on which a response to the message is
+// expected, if any.
+func (m *message) ResponseTopic() string {
+	if m.properties == nil {
+		return ""
+	}
+	return m.properties.ResponseTopic
+}
+
+// CorrelationData returns the data used to match a response to its request.
+func (m *message) CorrelationData() []byte {
+	if m.properties == nil {
+		return nil
+	}
+	return m.properties.CorrelationData
+}
+
 func (m *message) Ack() {
 	m.once.Do(m.ack)
 }
 
 func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
 	return &message{
-		duplicate: p.Dup,
-		qos:       p.Qos,
-		retained:  p.Retain,
-		topic:     p.TopicName,
-		messageID: p.MessageID,
-		payload:   p.Payload,
-		ack:       ack,
+		duplicate:  p.Dup,
+		qos:        p.Qos,
+		retained:   p.Retain,
+		topic:      p.TopicName,
+		messageID:  p.MessageID,
+		payload:    p.Payload,
+		properties: p.Properties,
+		ack:        ack,
 	}
 }
 
@@ -97,6 +165,15 @@ func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.
 		m.WillQos = options.WillQos
 		m.WillTopic = options.WillTopic
 		m.WillMessage = options.WillPayload
+		m.WillProperties = options.WillProperties.Copy()
+	}
+	m.Properties = options.ConnectProperties.Copy()
+	if options.TopicAliasMaximum > 0 {
+		if m.Properties == nil {
+			m.Properties = &packets.Properties{}
+		}
+		max := options.TopicAliasMaximum
+		m.Properties.TopicAliasMaximum = &max
 	}
 
 	username := options.Username
@@ -94,6 +94,13 @@ func (mids *messageIds) getToken(id uint16) tokenCompletor {
 	return &DummyToken{id: id}
 }
 
+// closedChan is the Done channel of the tokens which are always complete.
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
 type DummyToken struct {
 	id uint16
 }
@@ -106,6 +113,10 @@ func (d *DummyToken) WaitTimeout(t time.Duration) bool {
 	return true
 }
 
+func (d *DummyToken) Done() <-chan struct{} {
+	return closedChan
+}
+
 func (d *DummyToken) flowComplete() {
 	ERROR.Printf("A lookup for token %d returned nil\n", d.id)
 }
@@ -131,6 +142,10 @@ func (p *PlaceHolderToken) WaitTimeout(t time.Duration) bool {
 	return true
 }
 
+func (p *PlaceHolderToken) Done() <-chan struct{} {
+	return closedChan
+}
+
 func (p *PlaceHolderToken) flowComplete() {
 }
 
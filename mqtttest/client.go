@@ -0,0 +1,445 @@
+package mqtttest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	mqtt "github.com/aretas77/paho.mqtt.golang"
+)
+
+// Op is an operation of the fake Client whose outcome can be scripted.
+type Op int
+
+// The operations of the fake Client.
+const (
+	OpConnect Op = iota
+	OpPublish
+	OpSubscribe
+	OpUnsubscribe
+	OpReauthenticate
+)
+
+// Outcome is the scripted outcome of an operation, the zero Outcome is a
+// success.
+type Outcome struct {
+	// Err is the error of the token of the operation.
+	Err error
+	// Pending leaves the token incomplete, the test completes it with
+	// Token.Complete.
+	Pending bool
+}
+
+// Publication is a publish recorded by the fake Client.
+type Publication struct {
+	Topic    string
+	Qos      byte
+	Retained bool
+	Payload  []byte
+	Options  mqtt.PublishOptions
+	Token    *Token
+}
+
+// Subscription is a subscribe recorded by the fake Client, a
+// SubscribeMultiple is recorded as a Subscription per topic.
+type Subscription struct {
+	Topic   string
+	Options mqtt.SubscribeOptions
+	Token   *Token
+}
+
+type state int
+
+const (
+	disconnected state = iota
+	reconnecting
+	connected
+)
+
+// Client is a fake mqtt.Client for the unit tests of the code using a
+// client. It records the publishes, subscriptions and unsubscribes, routes
+// the messages given to Deliver to the subscriptions with the rules of a
+// real client, and simulates the loss of the connection. The operations
+// succeed at once unless their outcome is scripted with Script. The handlers
+// of the options are called on the goroutine of the operation.
+type Client struct {
+	mu           sync.Mutex
+	options      mqtt.ClientOptions
+	router       *mqtt.Router
+	state        state
+	outcomes     map[Op][]Outcome
+	published    []Publication
+	subscribed   []Subscription
+	unsubscribed []string
+	active       map[string]byte
+}
+
+var _ mqtt.Client = (*Client)(nil)
+
+// NewClient returns a disconnected fake Client with the options, nil for
+// the default options.
+func NewClient(o *mqtt.ClientOptions) *Client {
+	if o == nil {
+		o = mqtt.NewClientOptions()
+	}
+	c := &Client{
+		options:  *o,
+		router:   mqtt.NewRouter(),
+		outcomes: make(map[Op][]Outcome),
+		active:   make(map[string]byte),
+	}
+	c.router.SetDefaultHandler(o.DefaultPublishHandler)
+	c.router.SetAutoAck(o.AutoAck)
+	return c
+}
+
+// Script queues the outcomes of the next calls of the operation, in order.
+// The calls succeed once the queue is empty.
+func (c *Client) Script(op Op, outcomes ...Outcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outcomes[op] = append(c.outcomes[op], outcomes...)
+}
+
+// outcome returns the token for the next call of the operation, the client
+// must be locked.
+func (c *Client) outcome(op Op) *Token {
+	var o Outcome
+	if queue := c.outcomes[op]; len(queue) > 0 {
+		o, c.outcomes[op] = queue[0], queue[1:]
+	}
+	t := newToken()
+	if !o.Pending {
+		t.Complete(o.Err)
+	}
+	return t
+}
+
+// failed reports whether the token has completed with an error.
+func failed(t *Token) bool {
+	select {
+	case <-t.Done():
+		return t.Error() != nil
+	default:
+		return false
+	}
+}
+
+// succeeded reports whether the token has completed without an error.
+func succeeded(t *Token) bool {
+	select {
+	case <-t.Done():
+		return t.Error() == nil
+	default:
+		return false
+	}
+}
+
+// IsConnected returns true while the client is connected, or reconnecting
+// with AutoReconnect set, as for a real client.
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == connected || (c.state == reconnecting && c.options.AutoReconnect)
+}
+
+// IsConnectionOpen returns true while the client is connected.
+func (c *Client) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == connected
+}
+
+// setState will change the state of the client, the listener of the
+// options is told about the change. The client must not be locked.
+func (c *Client) setState(to state, cause error) {
+	c.mu.Lock()
+	from := c.state
+	c.state = to
+	c.mu.Unlock()
+	if l := c.options.OnConnectionStateChange; l != nil && from != to {
+		l(c, mqtt.ConnectionEvent{From: connectionState(from), To: connectionState(to), Time: mqtt.SystemClock.Now(), Cause: cause})
+	}
+}
+
+func connectionState(s state) mqtt.ConnectionState {
+	switch s {
+	case connected:
+		return mqtt.StateConnected
+	case reconnecting:
+		return mqtt.StateReconnecting
+	}
+	return mqtt.StateDisconnected
+}
+
+// Connect will connect the client unless the outcome is scripted to fail,
+// the OnConnect handler is then called.
+func (c *Client) Connect() mqtt.Token {
+	c.mu.Lock()
+	t := c.outcome(OpConnect)
+	c.mu.Unlock()
+	if succeeded(t) {
+		c.connected()
+	}
+	return t
+}
+
+// connected will make the client connected and call the OnConnect handler.
+func (c *Client) connected() {
+	c.setState(connected, nil)
+	if c.options.OnConnect != nil {
+		c.options.OnConnect(c)
+	}
+}
+
+// ConnectContext will connect like Connect and wait for the token or the
+// context.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	return wait(ctx, c.Connect())
+}
+
+// Disconnect will disconnect the client.
+func (c *Client) Disconnect(quiesce uint) {
+	c.setState(disconnected, nil)
+}
+
+// LoseConnection simulates the loss of the connection with the error, the
+// client is then reconnecting if AutoReconnect is set and disconnected
+// otherwise. The OnConnectionLost handler is called.
+func (c *Client) LoseConnection(err error) {
+	if !c.IsConnectionOpen() {
+		return
+	}
+	if c.options.AutoReconnect {
+		c.setState(reconnecting, err)
+	} else {
+		c.setState(disconnected, err)
+	}
+	if c.options.OnConnectionLost != nil {
+		c.options.OnConnectionLost(c, err)
+	}
+}
+
+// Reconnect simulates a successful reconnect after LoseConnection, the
+// OnReconnecting and OnConnect handlers are called. The subscriptions are
+// kept as for a real client.
+func (c *Client) Reconnect() {
+	c.mu.Lock()
+	reconnect := c.state == reconnecting
+	c.mu.Unlock()
+	if !reconnect {
+		return
+	}
+	if c.options.OnReconnecting != nil {
+		c.options.OnReconnecting(c, &c.options)
+	}
+	c.connected()
+}
+
+// Publish will record the publish, it fails with mqtt.ErrNotConnected if the
+// client is not connected.
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.PublishWithOptions(topic, qos, retained, payload, mqtt.PublishOptions{})
+}
+
+// PublishWithOptions will record the publish like Publish.
+func (c *Client) PublishWithOptions(topic string, qos byte, retained bool, payload interface{}, opts mqtt.PublishOptions) mqtt.Token {
+	if !c.IsConnected() {
+		return completedToken(mqtt.ErrNotConnected)
+	}
+	var body []byte
+	switch p := payload.(type) {
+	case string:
+		body = []byte(p)
+	case []byte:
+		body = p
+	case bytes.Buffer:
+		body = p.Bytes()
+	default:
+		return completedToken(errors.New("Unknown payload type"))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.outcome(OpPublish)
+	c.published = append(c.published, Publication{
+		Topic:    topic,
+		Qos:      qos,
+		Retained: retained,
+		Payload:  body,
+		Options:  opts,
+		Token:    t,
+	})
+	return t
+}
+
+// PublishContext will publish like Publish and wait for the token or the
+// context.
+func (c *Client) PublishContext(ctx context.Context, topic string, qos byte, retained bool, payload interface{}) error {
+	return wait(ctx, c.Publish(topic, qos, retained, payload))
+}
+
+// Subscribe will record the subscription, its callback receives the
+// matching messages given to Deliver once the subscribe has succeeded.
+func (c *Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeWithOptions(topic, mqtt.SubscribeOptions{QoS: qos}, callback)
+}
+
+// SubscribeWithOptions will record the subscription like Subscribe, the
+// subscription identifier is used to route the messages.
+func (c *Client) SubscribeWithOptions(topic string, opts mqtt.SubscribeOptions, callback mqtt.MessageHandler) mqtt.Token {
+	if !c.IsConnected() {
+		return completedToken(mqtt.ErrNotConnected)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.outcome(OpSubscribe)
+	c.subscribe(Subscription{Topic: topic, Options: opts, Token: t}, callback)
+	return t
+}
+
+// SubscribeMultiple will record a subscription to each of the topics.
+func (c *Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	if !c.IsConnected() {
+		return completedToken(mqtt.ErrNotConnected)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.outcome(OpSubscribe)
+	for topic, qos := range filters {
+		c.subscribe(Subscription{Topic: topic, Options: mqtt.SubscribeOptions{QoS: qos}, Token: t}, callback)
+	}
+	return t
+}
+
+// subscribe will record the subscription and route the messages to the
+// callback unless it has failed, a pending subscription is routed as a
+// real client does before the broker acknowledges it. The client must be
+// locked.
+func (c *Client) subscribe(s Subscription, callback mqtt.MessageHandler) {
+	c.subscribed = append(c.subscribed, s)
+	if failed(s.Token) {
+		return
+	}
+	c.active[s.Topic] = s.Options.QoS
+	if callback != nil {
+		c.router.AddRouteWithID(s.Topic, s.Options.SubscriptionIdentifier, callback)
+	}
+}
+
+// SubscribeContext will subscribe like Subscribe and wait for the token or
+// the context.
+func (c *Client) SubscribeContext(ctx context.Context, topic string, qos byte, callback mqtt.MessageHandler) error {
+	return wait(ctx, c.Subscribe(topic, qos, callback))
+}
+
+// Unsubscribe will record the unsubscribe, the subscriptions and their
+// routes are removed once it has succeeded.
+func (c *Client) Unsubscribe(topics ...string) mqtt.Token {
+	if !c.IsConnected() {
+		return completedToken(mqtt.ErrNotConnected)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.outcome(OpUnsubscribe)
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	if succeeded(t) {
+		for _, topic := range topics {
+			delete(c.active, topic)
+			c.router.DeleteRoute(topic)
+		}
+	}
+	return t
+}
+
+// UnsubscribeContext will unsubscribe like Unsubscribe and wait for the
+// token or the context.
+func (c *Client) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	return wait(ctx, c.Unsubscribe(topics...))
+}
+
+// Reauthenticate returns the scripted outcome of a reauthentication, it
+// fails with mqtt.ErrNotConnected if the client is not connected.
+func (c *Client) Reauthenticate() mqtt.Token {
+	if !c.IsConnectionOpen() {
+		return completedToken(mqtt.ErrNotConnected)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outcome(OpReauthenticate)
+}
+
+// AddRoute adds the handler for the messages matching the topic without a
+// subscription.
+func (c *Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.router.AddRoute(topic, callback)
+}
+
+// OptionsReader returns a reader of the options of the client.
+func (c *Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewOptionsReader(&c.options)
+}
+
+// HermesReader returns nil, the fake Client has no hermes.
+func (c *Client) HermesReader() *mqtt.ClientHermesReader {
+	return nil
+}
+
+// Deliver will route the message as if it was received from the broker,
+// the handlers are called in order on the calling goroutine. False is
+// returned if no handler was called.
+func (c *Client) Deliver(m mqtt.Message) bool {
+	return c.router.Dispatch(c, m)
+}
+
+// Published returns the publishes recorded, in order.
+func (c *Client) Published() []Publication {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Publication(nil), c.published...)
+}
+
+// Subscribed returns the subscribes recorded, in order.
+func (c *Client) Subscribed() []Subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Subscription(nil), c.subscribed...)
+}
+
+// Unsubscribed returns the topics of the unsubscribes recorded, in order.
+func (c *Client) Unsubscribed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.unsubscribed...)
+}
+
+// Subscriptions returns the topics the client is subscribed to with their
+// QoS.
+func (c *Client) Subscriptions() map[string]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := make(map[string]byte, len(c.active))
+	for topic, qos := range c.active {
+		active[topic] = qos
+	}
+	return active
+}
+
+// Reset will forget the publishes, subscribes and unsubscribes recorded,
+// the subscriptions are kept.
+func (c *Client) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published, c.subscribed, c.unsubscribed = nil, nil, nil
+}
+
+// wait will wait for the token or the context.
+func wait(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,184 @@
+package mqtttest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/aretas77/paho.mqtt.golang"
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func Test_ClientRecords(t *testing.T) {
+	c := NewClient(nil)
+	if token := c.Publish("a", 0, false, "offline"); token.Error() != mqtt.ErrNotConnected {
+		t.Errorf("publish while disconnected returned %v", token.Error())
+	}
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect failed: %v", token.Error())
+	}
+
+	c.Publish("a/b", 1, true, "payload")
+	c.PublishWithOptions("a/c", 0, false, []byte{1}, mqtt.PublishOptions{ContentType: "bin"})
+	if token := c.Publish("a/d", 0, false, 42); token.Error() == nil {
+		t.Errorf("publish of an int succeeded")
+	}
+	published := c.Published()
+	if len(published) != 2 {
+		t.Fatalf("%d publishes recorded", len(published))
+	}
+	if p := published[0]; p.Topic != "a/b" || p.Qos != 1 || !p.Retained || string(p.Payload) != "payload" {
+		t.Errorf("first publish recorded as %+v", p)
+	}
+	if p := published[1]; p.Options.ContentType != "bin" {
+		t.Errorf("second publish recorded as %+v", p)
+	}
+
+	c.Subscribe("x/+", 1, nil)
+	c.SubscribeMultiple(map[string]byte{"y": 0, "z": 2}, nil)
+	c.Unsubscribe("y")
+	if n := len(c.Subscribed()); n != 3 {
+		t.Errorf("%d subscribes recorded", n)
+	}
+	if u := c.Unsubscribed(); len(u) != 1 || u[0] != "y" {
+		t.Errorf("unsubscribes recorded as %v", u)
+	}
+	subs := c.Subscriptions()
+	if len(subs) != 2 || subs["x/+"] != 1 || subs["z"] != 2 {
+		t.Errorf("subscriptions are %v", subs)
+	}
+
+	c.Reset()
+	if len(c.Published()) != 0 || len(c.Subscribed()) != 0 || len(c.Subscriptions()) != 2 {
+		t.Errorf("Reset did not forget the records only")
+	}
+}
+
+func Test_ClientDeliver(t *testing.T) {
+	var called []string
+	handler := func(name string) mqtt.MessageHandler {
+		return func(_ mqtt.Client, m mqtt.Message) { called = append(called, name+":"+m.Topic()) }
+	}
+	c := NewClient(mqtt.NewClientOptions().SetDefaultPublishHandler(handler("default")))
+	c.Connect()
+	c.Subscribe("sensors/+/temp", 0, handler("temp"))
+	c.Subscribe("$share/group/sensors/#", 0, handler("shared"))
+	c.SubscribeWithOptions("ids", mqtt.SubscribeOptions{SubscriptionIdentifier: 7}, handler("id"))
+
+	m := NewMessage("sensors/a/temp", 0, false, []byte("20"))
+	if !c.Deliver(m) {
+		t.Fatalf("message not delivered")
+	}
+	if !m.Acked() {
+		t.Errorf("message not acked")
+	}
+	c.Deliver(NewMessage("other", 0, false, nil))
+	c.Deliver(NewMessage("routed/by/id", 0, false, nil).SetProperties(&packets.Properties{SubscriptionIdentifier: []int{7}}))
+
+	want := []string{"temp:sensors/a/temp", "shared:sensors/a/temp", "default:other", "id:routed/by/id"}
+	if len(called) != len(want) {
+		t.Fatalf("handlers called %v, should be %v", called, want)
+	}
+	for i := range want {
+		if called[i] != want[i] {
+			t.Errorf("handlers called %v, should be %v", called, want)
+			break
+		}
+	}
+
+	c.Unsubscribe("sensors/+/temp")
+	called = nil
+	c.Deliver(NewMessage("sensors/a/temp", 0, false, nil))
+	if len(called) != 1 || called[0] != "shared:sensors/a/temp" {
+		t.Errorf("handlers called %v after the unsubscribe", called)
+	}
+}
+
+func Test_ClientScript(t *testing.T) {
+	c := NewClient(nil)
+	refused := errors.New("refused")
+	c.Script(OpConnect, Outcome{Err: refused})
+	if token := c.Connect(); token.Error() != refused || c.IsConnected() {
+		t.Fatalf("scripted connect returned %v", token.Error())
+	}
+	c.Connect()
+
+	c.Script(OpPublish, Outcome{Pending: true}, Outcome{Err: refused})
+	pending := c.Publish("a", 1, false, "1")
+	if pending.WaitTimeout(10 * time.Millisecond) {
+		t.Errorf("pending publish completed")
+	}
+	if token := c.Publish("a", 1, false, "2"); token.Error() != refused {
+		t.Errorf("failed publish returned %v", token.Error())
+	}
+	if token := c.Publish("a", 1, false, "3"); token.Error() != nil {
+		t.Errorf("publish after the script returned %v", token.Error())
+	}
+	c.Published()[0].Token.Complete(nil)
+	if !pending.WaitTimeout(time.Second) || pending.Error() != nil {
+		t.Errorf("pending publish not completed")
+	}
+
+	c.Script(OpSubscribe, Outcome{Err: refused})
+	c.Subscribe("a", 0, func(mqtt.Client, mqtt.Message) {})
+	if len(c.Subscriptions()) != 0 || c.Deliver(NewMessage("a", 0, false, nil)) {
+		t.Errorf("failed subscription is routed")
+	}
+
+	c.Script(OpPublish, Outcome{Pending: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.PublishContext(ctx, "a", 1, false, "4"); err != context.DeadlineExceeded {
+		t.Errorf("PublishContext returned %v", err)
+	}
+}
+
+func Test_ClientConnectionLoss(t *testing.T) {
+	var events []string
+	lost := errors.New("lost")
+	ops := mqtt.NewClientOptions().
+		SetOnConnectHandler(func(mqtt.Client) { events = append(events, "connect") }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { events = append(events, "lost:"+err.Error()) }).
+		SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) { events = append(events, "reconnecting") }).
+		SetConnectionStateListener(func(_ mqtt.Client, e mqtt.ConnectionEvent) { events = append(events, e.To.String()) })
+	c := NewClient(ops)
+	c.Connect()
+	c.LoseConnection(lost)
+	if !c.IsConnected() || c.IsConnectionOpen() {
+		t.Errorf("client should be reconnecting")
+	}
+	c.Reconnect()
+	c.Disconnect(0)
+
+	want := []string{"connected", "connect", "reconnecting", "lost:lost", "reconnecting", "connected", "connect", "disconnected"}
+	if len(events) != len(want) {
+		t.Fatalf("events are %v, should be %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("events are %v, should be %v", events, want)
+		}
+	}
+	r := c.OptionsReader()
+	if c.HermesReader() != nil || !r.AutoReconnect() {
+		t.Errorf("readers are wrong")
+	}
+}
+
+func Test_ClientManualAck(t *testing.T) {
+	var received mqtt.Message
+	c := NewClient(mqtt.NewClientOptions().SetAutoAck(false))
+	c.Connect()
+	c.Subscribe("a", 1, func(_ mqtt.Client, m mqtt.Message) { received = m })
+
+	m := NewMessage("a", 1, false, nil)
+	c.Deliver(m)
+	if received != m || m.Acked() {
+		t.Fatalf("message acked before the handler acked it")
+	}
+	received.Ack()
+	if !m.Acked() {
+		t.Errorf("message not acked")
+	}
+}
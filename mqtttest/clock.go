@@ -0,0 +1,177 @@
+// Package mqtttest provides test doubles for the users of the mqtt package:
+// a fake Client which records what the code under test does with it, and a
+// FakeClock to drive the timers of a real client.
+package mqtttest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/aretas77/paho.mqtt.golang"
+)
+
+// FakeClock is a mqtt.Clock whose time only moves when it is advanced, the
+// timers and tickers fire as the time passes their deadlines. Set it with
+// ClientOptions.SetClock to drive the keepalive, the backoff and the token
+// timeouts of a client without waiting.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a timer, or a ticker if it has a period.
+type fakeWaiter struct {
+	clock  *FakeClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+// NewFakeClock returns a FakeClock set at the time.
+func NewFakeClock(now time.Time) *FakeClock {
+	f := &FakeClock{now: now}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the time of the clock.
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel which receives the time once the clock has been
+// advanced by d.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer returns a timer which fires once the clock has been advanced by
+// d.
+func (f *FakeClock) NewTimer(d time.Duration) mqtt.ClockTimer {
+	w := &fakeWaiter{clock: f, c: make(chan time.Time, 1)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schedule(w, d)
+	return w
+}
+
+// NewTicker returns a ticker which ticks each time the clock has been
+// advanced by d, the ticks are dropped for a slow receiver as for a
+// time.Ticker.
+func (f *FakeClock) NewTicker(d time.Duration) mqtt.ClockTicker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	w := &fakeWaiter{clock: f, c: make(chan time.Time, 1), period: d}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schedule(w, d)
+	return fakeTicker{w}
+}
+
+// Advance will move the clock forward by d, firing the timers and tickers
+// in the order of their deadlines.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].when.Before(f.waiters[j].when) })
+		if len(f.waiters) == 0 || f.waiters[0].when.After(end) {
+			break
+		}
+		w := f.waiters[0]
+		f.now = w.when
+		f.remove(w)
+		select {
+		case w.c <- f.now:
+		default:
+		}
+		if w.period > 0 {
+			f.schedule(w, w.period)
+		}
+	}
+	f.now = end
+}
+
+// Waiters returns the number of timers and tickers which have not fired or
+// been stopped.
+func (f *FakeClock) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil will wait until the clock has at least n timers and tickers
+// waiting, so the code under test has started them before the clock is
+// advanced.
+func (f *FakeClock) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+// schedule will make the waiter fire after d, the clock must be locked.
+func (f *FakeClock) schedule(w *fakeWaiter, d time.Duration) {
+	w.when = f.now.Add(d)
+	if d <= 0 && w.period == 0 {
+		select {
+		case w.c <- f.now:
+		default:
+		}
+		return
+	}
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+}
+
+// remove will take the waiter off the clock, false is returned if it was
+// not waiting. The clock must be locked.
+func (f *FakeClock) remove(w *fakeWaiter) bool {
+	for i, o := range f.waiters {
+		if o == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+// Stop will stop the timer or ticker, for a timer false is returned if it
+// had already fired or been stopped.
+func (w *fakeWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	return w.clock.remove(w)
+}
+
+// Reset will make the timer fire after d, false is returned if it had
+// already fired or been stopped.
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	active := w.clock.remove(w)
+	w.clock.schedule(w, d)
+	return active
+}
+
+// fakeTicker is the ticker of a FakeClock.
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
@@ -0,0 +1,190 @@
+package mqtttest
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/aretas77/paho.mqtt.golang"
+	"github.com/aretas77/paho.mqtt.golang/broker"
+	"github.com/aretas77/paho.mqtt.golang/faultconn"
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func Test_FakeClockTimer(t *testing.T) {
+	f := NewFakeClock(epoch)
+	timer := f.NewTimer(time.Second)
+	after := f.After(2 * time.Second)
+
+	f.Advance(time.Second - 1)
+	select {
+	case <-timer.C():
+		t.Fatalf("timer fired early")
+	default:
+	}
+	f.Advance(1)
+	if now := <-timer.C(); !now.Equal(epoch.Add(time.Second)) {
+		t.Errorf("timer fired at %v", now)
+	}
+	if timer.Stop() {
+		t.Errorf("Stop of a fired timer returned true")
+	}
+	if timer.Reset(time.Second) {
+		t.Errorf("Reset of a fired timer returned true")
+	}
+	if !timer.Stop() {
+		t.Errorf("Stop of a reset timer returned false")
+	}
+
+	f.Advance(time.Hour)
+	if now := <-after; !now.Equal(epoch.Add(2 * time.Second)) {
+		t.Errorf("After fired at %v", now)
+	}
+	select {
+	case <-timer.C():
+		t.Errorf("stopped timer fired")
+	default:
+	}
+	if n := f.Waiters(); n != 0 {
+		t.Errorf("%d waiters left", n)
+	}
+}
+
+func Test_FakeClockTicker(t *testing.T) {
+	f := NewFakeClock(epoch)
+	ticker := f.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for i := 1; i <= 3; i++ {
+		f.Advance(time.Second)
+		if now := <-ticker.C(); !now.Equal(epoch.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("tick %d at %v", i, now)
+		}
+	}
+	// the ticks are dropped while the channel is full.
+	f.Advance(5 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Errorf("dropped tick received")
+	default:
+	}
+	if !f.Now().Equal(epoch.Add(8 * time.Second)) {
+		t.Errorf("clock at %v", f.Now())
+	}
+}
+
+// serve will start a broker on a mem listener with the name.
+func serve(t *testing.T, name string) *broker.Broker {
+	b := broker.New()
+	l, err := mqtt.ListenMem(name)
+	if err != nil {
+		t.Fatalf("ListenMem failed: %v", err)
+	}
+	go b.Serve(l)
+	return b
+}
+
+// dropAfterConnack opens connections whose reads are dropped after the
+// CONNACK, so the broker looks gone while the writes still reach it.
+func dropAfterConnack(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	conn, err := mqtt.DefaultOpenConnection(uri, options)
+	if err != nil {
+		return nil, err
+	}
+	return faultconn.Wrap(conn, faultconn.DropReads(faultconn.AfterRead(packets.Connack, 1))), nil
+}
+
+func Test_FakeClockKeepalive(t *testing.T) {
+	b := serve(t, "mqtttest-keepalive")
+	defer b.Close()
+
+	f := NewFakeClock(epoch)
+	lost := make(chan error, 1)
+	ops := mqtt.NewClientOptions().AddBroker("mem://mqtttest-keepalive").
+		SetClock(f).SetKeepAlive(2 * time.Second).SetPingTimeout(time.Second).
+		SetAutoReconnect(false).SetCustomOpenConnectionFn(dropAfterConnack).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost <- err })
+	c := mqtt.NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	// the keepalive checks each second, it pings after 2s and gives up 1s
+	// later as the PINGRESP is dropped.
+	f.BlockUntil(1)
+	for i := 0; i < 100; i++ {
+		f.Advance(time.Second)
+		select {
+		case err := <-lost:
+			if !strings.Contains(err.Error(), "pingresp") {
+				t.Errorf("connection lost with %v", err)
+			}
+			if d := f.Now().Sub(epoch); d > 5*time.Second {
+				t.Errorf("connection lost after %v", d)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatalf("connection not lost after %v", f.Now().Sub(epoch))
+}
+
+func Test_FakeClockConnectRetry(t *testing.T) {
+	f := NewFakeClock(epoch)
+	ops := mqtt.NewClientOptions().AddBroker("mem://mqtttest-retry").SetClock(f).
+		SetConnectRetry(true).SetConnectRetryInterval(time.Minute)
+	c := mqtt.NewClient(ops)
+	token := c.Connect()
+
+	// the first attempt fails as there is no broker, the retry waits for a
+	// minute of the clock.
+	f.BlockUntil(1)
+	b := serve(t, "mqtttest-retry")
+	defer b.Close()
+	defer c.Disconnect(0)
+	f.Advance(time.Minute)
+	select {
+	case <-token.Done():
+		if token.Error() != nil {
+			t.Errorf("Connect failed: %v", token.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connect not retried")
+	}
+}
+
+func Test_FakeClockWaitTimeout(t *testing.T) {
+	b := serve(t, "mqtttest-wait")
+	defer b.Close()
+
+	f := NewFakeClock(epoch)
+	ops := mqtt.NewClientOptions().AddBroker("mem://mqtttest-wait").SetClock(f).
+		SetKeepAlive(0).SetCustomOpenConnectionFn(dropAfterConnack)
+	c := mqtt.NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	// the PUBACK is dropped, the publish times out after an hour of the
+	// clock. Publish has a timer of its own for the send.
+	token := c.Publish("mqtttest", 1, false, "payload")
+	done := make(chan bool)
+	go func() { done <- token.WaitTimeout(time.Hour) }()
+	f.BlockUntil(2)
+	f.Advance(time.Hour)
+	select {
+	case completed := <-done:
+		if completed {
+			t.Errorf("WaitTimeout returned true")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WaitTimeout did not return")
+	}
+}
@@ -0,0 +1,100 @@
+package mqtttest
+
+import (
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/aretas77/paho.mqtt.golang"
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// Message is a mqtt.Message for the fake Client to deliver, it records
+// whether the handlers have acknowledged it.
+type Message struct {
+	topic      string
+	qos        byte
+	retained   bool
+	duplicate  bool
+	messageID  uint16
+	payload    []byte
+	properties *packets.Properties
+	acked      int32
+}
+
+// NewMessage returns a message on the topic.
+func NewMessage(topic string, qos byte, retained bool, payload []byte) *Message {
+	return &Message{topic: topic, qos: qos, retained: retained, payload: payload}
+}
+
+// SetProperties sets the MQTT 5 properties of the message, such as the
+// subscription identifiers used to route it.
+func (m *Message) SetProperties(p *packets.Properties) *Message {
+	m.properties = p
+	return m
+}
+
+// SetMessageID sets the message ID and the duplicate flag of the message.
+func (m *Message) SetMessageID(id uint16, duplicate bool) *Message {
+	m.messageID, m.duplicate = id, duplicate
+	return m
+}
+
+// Acked reports whether the message has been acknowledged.
+func (m *Message) Acked() bool {
+	return atomic.LoadInt32(&m.acked) == 1
+}
+
+func (m *Message) Duplicate() bool                 { return m.duplicate }
+func (m *Message) Qos() byte                       { return m.qos }
+func (m *Message) Retained() bool                  { return m.retained }
+func (m *Message) Topic() string                   { return m.topic }
+func (m *Message) MessageID() uint16               { return m.messageID }
+func (m *Message) Payload() []byte                 { return m.payload }
+func (m *Message) Properties() *packets.Properties { return m.properties }
+
+func (m *Message) UserProperties() []packets.UserProperty {
+	if m.properties == nil {
+		return nil
+	}
+	return m.properties.User
+}
+
+func (m *Message) ContentType() string {
+	if m.properties == nil {
+		return ""
+	}
+	return m.properties.ContentType
+}
+
+func (m *Message) PayloadFormat() byte {
+	if m.properties == nil || m.properties.PayloadFormat == nil {
+		return mqtt.PayloadFormatBytes
+	}
+	return *m.properties.PayloadFormat
+}
+
+func (m *Message) MessageExpiry() time.Duration {
+	if m.properties == nil || m.properties.MessageExpiry == nil {
+		return 0
+	}
+	return time.Duration(*m.properties.MessageExpiry) * time.Second
+}
+
+func (m *Message) ResponseTopic() string {
+	if m.properties == nil {
+		return ""
+	}
+	return m.properties.ResponseTopic
+}
+
+func (m *Message) CorrelationData() []byte {
+	if m.properties == nil {
+		return nil
+	}
+	return m.properties.CorrelationData
+}
+
+// Ack will acknowledge the message.
+func (m *Message) Ack() {
+	atomic.StoreInt32(&m.acked, 1)
+}
@@ -0,0 +1,69 @@
+package mqtttest
+
+import (
+	"sync"
+	"time"
+)
+
+// Token is the mqtt.Token returned by the fake Client. A token scripted to
+// be pending completes only when the test calls Complete.
+type Token struct {
+	mu   sync.Mutex
+	done chan struct{}
+	err  error
+}
+
+func newToken() *Token {
+	return &Token{done: make(chan struct{})}
+}
+
+// completedToken returns a token which has completed with the error.
+func completedToken(err error) *Token {
+	t := newToken()
+	t.Complete(err)
+	return t
+}
+
+// Complete will complete the token with the error, nil for success. A
+// token completes only once, the later calls are ignored.
+func (t *Token) Complete(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+	default:
+		t.err = err
+		close(t.done)
+	}
+}
+
+// Wait will wait until the token completes.
+func (t *Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+// WaitTimeout will wait at most the duration for the token to complete,
+// false is returned if it did not.
+func (t *Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Done returns a channel which is closed when the token completes.
+func (t *Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Error returns the error the token completed with.
+func (t *Token) Error() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
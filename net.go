@@ -25,7 +25,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 	"golang.org/x/net/proxy"
 )
 
@@ -60,6 +60,8 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 			return nil, err
 		}
 		return conn, nil
+	case "mem":
+		return dialMem(uri.Host, timeout)
 	case "unix":
 		conn, err := net.DialTimeout("unix", uri.Host, timeout)
 		if err != nil {
@@ -110,15 +112,21 @@ func incoming(c *client) {
 	DEBUG.Println(NET, "incoming started")
 
 	for {
-		if cp, err = packets.ReadPacket(c.conn); err != nil {
+		if cp, err = packets.ReadPacketWithVersion(c.conn, byte(c.options.ProtocolVersion)); err != nil {
 			break
 		}
 		DEBUG.Println(NET, "Received Message")
+		if pub, ok := cp.(*packets.PublishPacket); ok {
+			if err = c.aliases.inbound(pub); err != nil {
+				sendDisconnect(c, err)
+				break
+			}
+		}
 		select {
 		case c.ibound <- cp:
 			// Notify keepalive logic that we recently received a packet
 			if c.options.KeepAlive != 0 {
-				c.lastReceived.Store(time.Now())
+				c.lastReceived.Store(c.options.Clock.Now())
 			}
 		case <-c.stop:
 			// This avoids a deadlock should a message arrive while shutting down.
@@ -141,6 +149,27 @@ func incoming(c *client) {
 	}
 }
 
+// sendDisconnect will send a DISCONNECT with the reason code of the error
+// and wait for it to be written, before the connection is closed for it.
+func sendDisconnect(c *client, err error) {
+	e, ok := err.(*packets.ReasonCodeError)
+	if !ok {
+		return
+	}
+	dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	dm.ReasonCode = e.Code
+	dt := c.newToken(packets.Disconnect)
+	select {
+	case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
+	case <-c.stop:
+		return
+	}
+	select {
+	case <-dt.Done():
+	case <-c.stop:
+	}
+}
+
 // receive a Message object on obound, and then
 // actually send outgoing message to the wire
 func outgoing(c *client) {
@@ -155,6 +184,14 @@ func outgoing(c *client) {
 			return
 		case pub := <-c.obound:
 			msg := pub.p.(*packets.PublishPacket)
+			if c.options.ProtocolVersion == 5 {
+				packets.InitProperties(msg)
+				// subscription identifiers are only sent by the server.
+				msg.Properties.SubscriptionIdentifier = nil
+				msg = c.aliases.outbound(msg)
+			} else {
+				packets.ClearProperties(msg)
+			}
 
 			if c.options.WriteTimeout > 0 {
 				c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
@@ -173,12 +210,26 @@ func outgoing(c *client) {
 				c.conn.SetWriteDeadline(time.Time{})
 			}
 
+			if t, ok := pub.t.(timedToken); ok {
+				t.stampWritten()
+			}
 			if msg.Qos == 0 {
 				pub.t.flowComplete()
 			}
 			DEBUG.Println(NET, "obound wrote msg, id:", msg.MessageID)
 		case msg := <-c.oboundP:
 			DEBUG.Println(NET, "obound priority msg to write, type", reflect.TypeOf(msg.p))
+			if c.options.ProtocolVersion == 5 {
+				packets.InitProperties(msg.p)
+			} else {
+				packets.ClearProperties(msg.p)
+				if sub, ok := msg.p.(*packets.SubscribePacket); ok {
+					// only the QoS of the subscription options is valid
+					for i := range sub.Qoss {
+						sub.Qoss[i] &= 0x03
+					}
+				}
+			}
 			if err := msg.p.Write(c.conn); err != nil {
 				ERROR.Println(NET, "outgoing stopped with error", err)
 				if msg.t != nil {
@@ -187,6 +238,9 @@ func outgoing(c *client) {
 				signalError(c.errors, err)
 				return
 			}
+			if t, ok := msg.t.(timedToken); ok {
+				t.stampWritten()
+			}
 			switch msg.p.(type) {
 			case *packets.DisconnectPacket:
 				msg.t.(*DisconnectToken).flowComplete()
@@ -196,7 +250,7 @@ func outgoing(c *client) {
 		}
 		// Reset ping timer after sending control packet.
 		if c.options.KeepAlive != 0 {
-			c.lastSent.Store(time.Now())
+			c.lastSent.Store(c.options.Clock.Now())
 		}
 	}
 }
@@ -226,15 +280,27 @@ func alllogic(c *client) {
 				switch t := token.(type) {
 				case *SubscribeToken:
 					DEBUG.Println(NET, "granted qoss", m.ReturnCodes)
+					t.stampAcked()
+					t.m.Lock()
 					for i, qos := range m.ReturnCodes {
 						t.subResult[t.subs[i]] = qos
 					}
+					t.properties = m.Properties
+					t.m.Unlock()
 				}
 				token.flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.UnsubackPacket:
 				DEBUG.Println(NET, "received unsuback, id:", m.MessageID)
-				c.getToken(m.MessageID).flowComplete()
+				token := c.getToken(m.MessageID)
+				switch t := token.(type) {
+				case *UnsubscribeToken:
+					t.m.Lock()
+					t.reasonCodes = m.ReasonCodes
+					t.properties = m.Properties
+					t.m.Unlock()
+				}
+				token.flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.PublishPacket:
 				DEBUG.Println(NET, "received publish, msgId:", m.MessageID)
@@ -257,10 +323,20 @@ func alllogic(c *client) {
 				DEBUG.Println(NET, "received puback, id:", m.MessageID)
 				// c.receipts.get(msg.MsgId()) <- Receipt{}
 				// c.receipts.end(msg.MsgId())
-				c.getToken(m.MessageID).flowComplete()
+				completeAck(c.getToken(m.MessageID), m.ReasonCode, m.Properties)
 				c.freeID(m.MessageID)
+				c.releaseInflight()
 			case *packets.PubrecPacket:
 				DEBUG.Println(NET, "received pubrec, id:", m.MessageID)
+				if m.ReasonCode >= packets.ReasonUnspecifiedError {
+					// the publish was refused by the broker, the flow ends
+					// without a PUBREL.
+					c.persist.Del(outboundKeyFromMID(m.MessageID))
+					completeAck(c.getToken(m.MessageID), m.ReasonCode, m.Properties)
+					c.freeID(m.MessageID)
+					c.releaseInflight()
+					break
+				}
 				prel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
 				prel.MessageID = m.MessageID
 				select {
@@ -278,8 +354,22 @@ func alllogic(c *client) {
 				}
 			case *packets.PubcompPacket:
 				DEBUG.Println(NET, "received pubcomp, id:", m.MessageID)
-				c.getToken(m.MessageID).flowComplete()
+				completeAck(c.getToken(m.MessageID), m.ReasonCode, m.Properties)
 				c.freeID(m.MessageID)
+				c.releaseInflight()
+			case *packets.DisconnectPacket:
+				// only an MQTT 5 broker sends a DISCONNECT, the reason is
+				// passed on as the error of the lost connection.
+				WARN.Println(NET, "received disconnect, reason:", m.ReasonCode)
+				err := packets.NewReasonCodeError(m.ReasonCode, m.Properties)
+				if err == nil {
+					err = ErrServerDisconnect
+				}
+				c.finishReauth(err)
+				signalError(c.errors, err)
+			case *packets.AuthPacket:
+				DEBUG.Println(NET, "received auth, reason:", m.ReasonCode)
+				c.handleAuth(m)
 			}
 		case <-c.stop:
 			WARN.Println(NET, "logic stopped")
@@ -288,31 +378,56 @@ func alllogic(c *client) {
 	}
 }
 
+// completeAck will complete the token of a publish with the reason code and
+// properties of its acknowledgement. A reason code which indicates a failure
+// is set as the error of the token.
+func completeAck(token tokenCompletor, reasonCode byte, properties *packets.Properties) {
+	if t, ok := token.(*PublishToken); ok {
+		t.setAck(reasonCode, properties)
+		t.stampAcked()
+	}
+	if err := packets.NewReasonCodeError(reasonCode, properties); err != nil {
+		token.setError(err)
+		return
+	}
+	token.flowComplete()
+}
+
+// ackFunc returns the function which acknowledges the message, it queues
+// the acknowledgement in order when AutoAck is disabled.
 func (c *client) ackFunc(packet *packets.PublishPacket) func() {
+	if c.acks != nil {
+		return c.acks.add(c, packet)
+	}
 	return func() {
-		switch packet.Qos {
-		case 2:
-			pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
-			pr.MessageID = packet.MessageID
-			DEBUG.Println(NET, "putting pubrec msg on obound")
-			select {
-			case c.oboundP <- &PacketAndToken{p: pr, t: nil}:
-			case <-c.stop:
-			}
-			DEBUG.Println(NET, "done putting pubrec msg on obound")
-		case 1:
-			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
-			pa.MessageID = packet.MessageID
-			DEBUG.Println(NET, "putting puback msg on obound")
-			persistOutbound(c.persist, pa)
-			select {
-			case c.oboundP <- &PacketAndToken{p: pa, t: nil}:
-			case <-c.stop:
-			}
-			DEBUG.Println(NET, "done putting puback msg on obound")
-		case 0:
-			// do nothing, since there is no need to send an ack packet back
+		c.sendAck(packet)
+	}
+}
+
+// sendAck will send the PUBACK or PUBREC of a message.
+func (c *client) sendAck(packet *packets.PublishPacket) {
+	switch packet.Qos {
+	case 2:
+		pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pr.MessageID = packet.MessageID
+		DEBUG.Println(NET, "putting pubrec msg on obound")
+		select {
+		case c.oboundP <- &PacketAndToken{p: pr, t: nil}:
+		case <-c.stop:
+		}
+		DEBUG.Println(NET, "done putting pubrec msg on obound")
+	case 1:
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = packet.MessageID
+		DEBUG.Println(NET, "putting puback msg on obound")
+		persistOutbound(c.persist, pa)
+		select {
+		case c.oboundP <- &PacketAndToken{p: pa, t: nil}:
+		case <-c.stop:
 		}
+		DEBUG.Println(NET, "done putting puback msg on obound")
+	case 0:
+		// do nothing, since there is no need to send an ack packet back
 	}
 }
 
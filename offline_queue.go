@@ -0,0 +1,246 @@
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// OfflineQueuePolicy selects the message which is dropped when a QoS 0
+// publish is made while the offline queue is full.
+type OfflineQueuePolicy int
+
+const (
+	// DropOldest drops the message which has been queued the longest
+	DropOldest OfflineQueuePolicy = iota
+	// DropNewest drops the message being published
+	DropNewest
+)
+
+// ErrOfflineQueueFull is the error of the token of a QoS 0 publish which
+// was dropped from a full offline queue.
+var ErrOfflineQueueFull = errors.New("publish dropped, the offline queue is full")
+
+// ErrOfflineMessageExpired is the error of the token of a QoS 0 publish
+// which stayed in the offline queue for longer than its TTL.
+var ErrOfflineMessageExpired = errors.New("publish dropped, it expired in the offline queue")
+
+type offlineEntry struct {
+	key     string
+	token   *PublishToken
+	expires time.Time
+}
+
+// offlineQueue holds the QoS 0 publishes made while the client is
+// reconnecting, they are sent in order once the connection is back. The
+// packets are kept in a Store under keys numbered in the order of the
+// queue, so a disk-backed queue is loaded again when the client restarts.
+// The tokens are kept in memory.
+type offlineQueue struct {
+	sync.Mutex
+	store   Store
+	size    int
+	policy  OfflineQueuePolicy
+	ttl     time.Duration
+	clock   Clock
+	next    uint64
+	entries *list.List
+	// draining is set while queued messages wait to be sent, the new
+	// publishes are then queued behind them so they keep their order
+	draining bool
+	// flushing makes sure a single flush sends the queue at a time
+	flushing sync.Mutex
+}
+
+// newOfflineQueue returns the offline queue described by the options, nil
+// if the queue is disabled.
+func newOfflineQueue(o *ClientOptions) *offlineQueue {
+	if o.OfflineQueueSize <= 0 {
+		return nil
+	}
+	q := &offlineQueue{
+		store:   o.OfflineQueueStore,
+		size:    o.OfflineQueueSize,
+		policy:  o.OfflineQueuePolicy,
+		ttl:     o.OfflineQueueTTL,
+		clock:   clockOr(o.Clock),
+		entries: list.New(),
+	}
+	if q.store == nil {
+		q.store = NewMemoryStore()
+	}
+	q.store.Open()
+	q.load()
+	return q
+}
+
+// offlineKey returns the Store key of the nth queued message.
+func offlineKey(n uint64) string {
+	return "q." + strconv.FormatUint(n, 10)
+}
+
+// load will queue the messages left in the Store by an earlier run of the
+// client in their order, their tokens are not waited on by anyone.
+func (q *offlineQueue) load() {
+	var numbers []uint64
+	for _, key := range q.store.All() {
+		if !strings.HasPrefix(key, "q.") {
+			continue
+		}
+		n, err := strconv.ParseUint(key[2:], 10, 64)
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	for _, n := range numbers {
+		e := &offlineEntry{key: offlineKey(n), token: newToken(packets.Publish).(*PublishToken)}
+		if q.ttl > 0 {
+			e.expires = q.clock.Now().Add(q.ttl)
+		}
+		q.entries.PushBack(e)
+		q.next = n
+	}
+	for q.entries.Len() > q.size {
+		q.drop(q.entries.Front(), ErrOfflineQueueFull)
+	}
+	if q.entries.Len() > 0 {
+		DEBUG.Println(CLI, "loaded", q.entries.Len(), "publishes queued while offline")
+		q.draining = true
+	}
+}
+
+// push will queue the publish, dropping the expired messages and, when the
+// queue is full, a message selected by the policy.
+func (q *offlineQueue) push(p *packets.PublishPacket, t *PublishToken) {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpired()
+	if q.entries.Len() >= q.size {
+		if q.policy == DropNewest {
+			DEBUG.Println(CLI, "offline queue is full, dropped publish, topic:", p.TopicName)
+			t.setError(ErrOfflineQueueFull)
+			return
+		}
+		q.drop(q.entries.Front(), ErrOfflineQueueFull)
+	}
+
+	q.next++
+	e := &offlineEntry{key: offlineKey(q.next), token: t}
+	if q.ttl > 0 {
+		e.expires = q.clock.Now().Add(q.ttl)
+	}
+	q.store.Put(e.key, p)
+	q.entries.PushBack(e)
+	q.draining = true
+	DEBUG.Println(CLI, "queued publish while offline, topic:", p.TopicName)
+}
+
+// pushIfDraining will queue the publish behind the messages which are still
+// waiting to be sent, false is returned if there are none.
+func (q *offlineQueue) pushIfDraining(p *packets.PublishPacket, t *PublishToken) bool {
+	q.Lock()
+	draining := q.draining
+	q.Unlock()
+	if !draining {
+		return false
+	}
+	q.push(p, t)
+	return true
+}
+
+// pop will take the oldest message which has not expired out of the queue
+// along with its entry, nil is returned and the queue stops draining if it
+// is empty. The message stays in the Store until it is sent.
+func (q *offlineQueue) pop() (*PacketAndToken, *offlineEntry) {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpired()
+	for f := q.entries.Front(); f != nil; f = q.entries.Front() {
+		e := q.entries.Remove(f).(*offlineEntry)
+		p := q.store.Get(e.key)
+		if p == nil {
+			ERROR.Println(CLI, "offline queue lost message", e.key)
+			e.token.setError(errors.New("publish dropped, it was lost by the offline queue store"))
+			continue
+		}
+		return &PacketAndToken{p: p, t: e.token}, e
+	}
+	q.draining = false
+	return nil, nil
+}
+
+// sent will remove a message taken by pop from the Store.
+func (q *offlineQueue) sent(e *offlineEntry) {
+	q.store.Del(e.key)
+}
+
+// unpop will put a message taken by pop which could not be sent back at the
+// front of the queue, keeping its key and expiry.
+func (q *offlineQueue) unpop(e *offlineEntry) {
+	q.Lock()
+	defer q.Unlock()
+	q.entries.PushFront(e)
+}
+
+// clear will drop all of the queued messages with the error.
+func (q *offlineQueue) clear(err error) {
+	q.Lock()
+	defer q.Unlock()
+	for f := q.entries.Front(); f != nil; f = q.entries.Front() {
+		q.drop(f, err)
+	}
+}
+
+// dropExpired will drop the messages at the front of the queue which have
+// outlived the TTL, the queue must be locked.
+func (q *offlineQueue) dropExpired() {
+	if q.ttl <= 0 {
+		return
+	}
+	now := q.clock.Now()
+	for f := q.entries.Front(); f != nil && now.After(f.Value.(*offlineEntry).expires); f = q.entries.Front() {
+		q.drop(f, ErrOfflineMessageExpired)
+	}
+}
+
+// drop will remove the entry from the queue and fail its token with the
+// error, the queue must be locked.
+func (q *offlineQueue) drop(f *list.Element, err error) {
+	e := q.entries.Remove(f).(*offlineEntry)
+	q.store.Del(e.key)
+	e.token.setError(err)
+}
+
+// flushOffline will send the messages queued while the client was offline.
+// A message which cannot be sent because the connection is lost again is
+// kept for the next reconnect.
+func (c *client) flushOffline() {
+	if c.offline == nil {
+		return
+	}
+	c.offline.flushing.Lock()
+	defer c.offline.flushing.Unlock()
+	for c.connectionStatus() == connected {
+		pt, e := c.offline.pop()
+		if pt == nil {
+			return
+		}
+		DEBUG.Println(CLI, "sending publish queued while offline, topic:", pt.p.(*packets.PublishPacket).TopicName)
+		select {
+		case c.obound <- pt:
+			c.offline.sent(e)
+		case <-c.stop:
+			c.offline.unpop(e)
+			return
+		}
+	}
+}
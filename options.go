@@ -24,6 +24,8 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 // CredentialsProvider allows the username and password to be updated
@@ -59,6 +61,10 @@ type ClientOptions struct {
 	CredentialsProvider     CredentialsProvider
 	CleanSession            bool
 	Order                   bool
+	AutoAck                 bool
+	MaxUnacked              int
+	AckTimeout              time.Duration
+	AckTimeoutDisconnect    bool
 	WillEnabled             bool
 	WillTopic               string
 	WillPayload             []byte
@@ -66,6 +72,15 @@ type ClientOptions struct {
 	WillRetained            bool
 	ProtocolVersion         uint
 	protocolVersionExplicit bool
+	ConnectProperties       *packets.Properties
+	WillProperties          *packets.Properties
+	TopicAliasMaximum       uint16
+	Authenticator           Authenticator
+	MaxInflight             uint16
+	OfflineQueueSize        int
+	OfflineQueuePolicy      OfflineQueuePolicy
+	OfflineQueueTTL         time.Duration
+	OfflineQueueStore       Store
 	TLSConfig               *tls.Config
 	KeepAlive               int64
 	PingTimeout             time.Duration
@@ -74,11 +89,19 @@ type ClientOptions struct {
 	AutoReconnect           bool
 	ConnectRetryInterval    time.Duration
 	ConnectRetry            bool
+	BackoffStrategy         BackoffStrategy
+	MaxConnectAttempts      int
+	BackoffResetAfter       time.Duration
+	ServerSelector          ServerSelector
+	BrokerResolver          BrokerResolver
+	CustomOpenConnectionFn  OpenConnectionFunc
+	Clock                   Clock
 	Store                   Store
 	DefaultPublishHandler   MessageHandler
 	OnConnect               OnConnectHandler
 	OnConnectionLost        ConnectionLostHandler
 	OnReconnecting          ReconnectHandler
+	OnConnectionStateChange ConnectionStateListener
 	WriteTimeout            time.Duration
 	MessageChannelDepth     uint
 	ResumeSubs              bool
@@ -89,9 +112,19 @@ type ClientOptions struct {
 
 // HermesOptions contains information about the device its operating on
 type HermesOptions struct {
-	Mac             string
-	BatteryLeftMah  float32
-	TotalBatteryMah float32
+	Mac               string
+	BatteryLeftMah    float32
+	TotalBatteryMah   float32
+	CaptureSamples    bool
+	CaptureDir        string
+	CaptureMaxSamples int
+	CaptureBatchSize  int
+	SendEnergyMah     float32
+	ByteEnergyMah     float32
+
+	Priorities           []TopicPriority
+	AlarmResetsWindow    bool
+	BulkBatteryThreshold float32
 }
 
 // NewClientOptions will create a new ClientClientOptions type with some
@@ -99,6 +132,7 @@ type HermesOptions struct {
 //   Port: 1883
 //   CleanSession: True
 //   Order: True
+//   AutoAck: True
 //   KeepAlive: 30 (seconds)
 //   ConnectTimeout: 30 (seconds)
 //   MaxReconnectInterval 10 (minutes)
@@ -111,6 +145,7 @@ func NewClientOptions() *ClientOptions {
 		Password:                "",
 		CleanSession:            true,
 		Order:                   true,
+		AutoAck:                 true,
 		WillEnabled:             false,
 		WillTopic:               "",
 		WillPayload:             nil,
@@ -133,9 +168,19 @@ func NewClientOptions() *ClientOptions {
 		HTTPHeaders:             make(map[string][]string),
 		UseHermes:               false,
 		HermesOptions: HermesOptions{
-			Mac:             "",
-			BatteryLeftMah:  0,
-			TotalBatteryMah: 0,
+			Mac:               "",
+			BatteryLeftMah:    0,
+			TotalBatteryMah:   0,
+			CaptureSamples:    false,
+			CaptureDir:        defaultCaptureDir,
+			CaptureMaxSamples: defaultCaptureMaxSamples,
+			CaptureBatchSize:  defaultCaptureBatchSize,
+			SendEnergyMah:     0,
+			ByteEnergyMah:     0,
+
+			Priorities:           nil,
+			AlarmResetsWindow:    false,
+			BulkBatteryThreshold: 0.5,
 		},
 	}
 	return o
@@ -150,6 +195,18 @@ func NewClientOptions() *ClientOptions {
 //
 // An example broker URI would look like: tcp://foobar.com:1883
 func (o *ClientOptions) AddBroker(server string) *ClientOptions {
+	brokerURI, err := parseBrokerURI(server)
+	if err != nil {
+		ERROR.Println(CLI, "Failed to parse %q broker address: %s", server, err)
+		return o
+	}
+	o.Servers = append(o.Servers, brokerURI)
+	return o
+}
+
+// parseBrokerURI parses the address of a broker with the defaults of
+// AddBroker for the host and the scheme.
+func parseBrokerURI(server string) (*url.URL, error) {
 	re := regexp.MustCompile(`%(25)?`)
 	if len(server) > 0 && server[0] == ':' {
 		server = "127.0.0.1" + server
@@ -158,13 +215,7 @@ func (o *ClientOptions) AddBroker(server string) *ClientOptions {
 		server = "tcp://" + server
 	}
 	server = re.ReplaceAllLiteralString(server, "%25")
-	brokerURI, err := url.Parse(server)
-	if err != nil {
-		ERROR.Println(CLI, "Failed to parse %q broker address: %s", server, err)
-		return o
-	}
-	o.Servers = append(o.Servers, brokerURI)
-	return o
+	return url.Parse(server)
 }
 
 // SetResumeSubs will enable resuming of stored (un)subscribe messages when connecting
@@ -262,15 +313,81 @@ func (o *ClientOptions) SetPingTimeout(k time.Duration) *ClientOptions {
 }
 
 // SetProtocolVersion sets the MQTT version to be used to connect to the
-// broker. Legitimate values are currently 3 - MQTT 3.1 or 4 - MQTT 3.1.1
+// broker. Legitimate values are currently 3 - MQTT 3.1, 4 - MQTT 3.1.1 or
+// 5 - MQTT 5. If the broker does not support MQTT 5 the client will fall
+// back to MQTT 3.1.1.
 func (o *ClientOptions) SetProtocolVersion(pv uint) *ClientOptions {
-	if (pv >= 3 && pv <= 4) || (pv > 0x80) {
+	if (pv >= 3 && pv <= 5) || (pv > 0x80) {
 		o.ProtocolVersion = pv
 		o.protocolVersionExplicit = true
 	}
 	return o
 }
 
+// SetConnectProperties sets the properties sent in the CONNECT packet when
+// connecting with MQTT 5, they are ignored for older versions.
+func (o *ClientOptions) SetConnectProperties(p *packets.Properties) *ClientOptions {
+	o.ConnectProperties = p
+	return o
+}
+
+// SetWillProperties sets the properties of the will message when connecting
+// with MQTT 5, they are ignored for older versions.
+func (o *ClientOptions) SetWillProperties(p *packets.Properties) *ClientOptions {
+	o.WillProperties = p
+	return o
+}
+
+// SetTopicAliasMaximum sets the number of topic aliases the server may use
+// when sending messages to the client over an MQTT 5 connection, 0 (the
+// default) disables inbound aliases. Outbound aliases are limited by the
+// maximum sent by the server.
+func (o *ClientOptions) SetTopicAliasMaximum(max uint16) *ClientOptions {
+	o.TopicAliasMaximum = max
+	return o
+}
+
+// SetAuthenticator sets the method used for MQTT 5 enhanced authentication,
+// the authenticator drives the exchange of AUTH packets with the server when
+// connecting and when Reauthenticate is called. It is not used for older
+// protocol versions.
+func (o *ClientOptions) SetAuthenticator(a Authenticator) *ClientOptions {
+	o.Authenticator = a
+	return o
+}
+
+// SetMaxInflight sets the maximum number of QoS 1 and 2 messages which are
+// published but not yet acknowledged, further publishes are queued in order
+// until an acknowledgement arrives. The Receive Maximum sent by an MQTT 5
+// server lowers the limit. The default of 0 means no limit.
+func (o *ClientOptions) SetMaxInflight(max uint16) *ClientOptions {
+	o.MaxInflight = max
+	return o
+}
+
+// SetOfflineQueue enables a queue of up to size QoS 0 messages published
+// while the client is reconnecting, which are otherwise discarded. The
+// queued messages are sent in order once the connection is back. When the
+// queue is full the policy selects the message which is dropped, and a
+// message queued for longer than the ttl is dropped, 0 means no limit. The
+// token of a dropped message completes with an error. The default size of
+// 0 disables the queue.
+func (o *ClientOptions) SetOfflineQueue(size int, policy OfflineQueuePolicy, ttl time.Duration) *ClientOptions {
+	o.OfflineQueueSize = size
+	o.OfflineQueuePolicy = policy
+	o.OfflineQueueTTL = ttl
+	return o
+}
+
+// SetOfflineQueueStore sets the Store which holds the messages of the
+// offline queue, such as a FileStore to keep them on disk. The messages
+// left in the Store by an earlier run are sent once the client connects.
+// The default is a MemoryStore. It should not be the Store of the client.
+func (o *ClientOptions) SetOfflineQueueStore(s Store) *ClientOptions {
+	o.OfflineQueueStore = s
+	return o
+}
+
 // UnsetWill will cause any set will message to be disregarded.
 func (o *ClientOptions) UnsetWill() *ClientOptions {
 	o.WillEnabled = false
@@ -327,6 +444,14 @@ func (o *ClientOptions) SetReconnectingHandler(cb ReconnectHandler) *ClientOptio
 	return o
 }
 
+// SetConnectionStateListener sets the callback to be executed upon every
+// change of the connection state, including each failed attempt to connect,
+// with the cause and the details of the connection.
+func (o *ClientOptions) SetConnectionStateListener(l ConnectionStateListener) *ClientOptions {
+	o.OnConnectionStateChange = l
+	return o
+}
+
 // SetWriteTimeout puts a limit on how long a mqtt publish should block until it unblocks with a
 // timeout error. A duration of 0 never times out. Default 30 seconds
 func (o *ClientOptions) SetWriteTimeout(t time.Duration) *ClientOptions {
@@ -357,6 +482,96 @@ func (o *ClientOptions) SetAutoReconnect(a bool) *ClientOptions {
 	return o
 }
 
+// SetBackoffStrategy sets the strategy which computes the time waited
+// between the attempts to reconnect and, with ConnectRetry, the attempts
+// to connect. By default the reconnect waits double from 1 second up to
+// MaxReconnectInterval and the connect retries wait ConnectRetryInterval.
+func (o *ClientOptions) SetBackoffStrategy(s BackoffStrategy) *ClientOptions {
+	o.BackoffStrategy = s
+	return o
+}
+
+// SetMaxConnectAttempts sets the number of attempts after which the client
+// gives up connecting with ConnectRetry, or reconnecting, and ends up
+// disconnected with ErrMaxConnectAttempts. An attempt tries each of the
+// servers once. The default of 0 means no limit.
+func (o *ClientOptions) SetMaxConnectAttempts(n int) *ClientOptions {
+	o.MaxConnectAttempts = n
+	return o
+}
+
+// SetBackoffResetAfter sets how long a connection must be up for the
+// reconnect backoff to start over when it is lost. A connection lost
+// sooner counts as a failed attempt, so a flapping connection is retried
+// less and less often. The default of 0 always starts over.
+func (o *ClientOptions) SetBackoffResetAfter(d time.Duration) *ClientOptions {
+	o.BackoffResetAfter = d
+	return o
+}
+
+// SetServerSelector sets the strategy which orders the servers for each
+// attempt to connect or reconnect. By default the servers are tried in the
+// order they were added. A built-in selector keeps the Clock of the first
+// client it is set on, it must not be shared by clients with different
+// Clocks.
+func (o *ClientOptions) SetServerSelector(s ServerSelector) *ClientOptions {
+	o.ServerSelector = s
+	return o
+}
+
+// SetBrokerResolver sets the resolver consulted for the servers before each
+// attempt to connect or reconnect, such as NewSRVResolver. The servers added
+// with AddBroker are used when the resolver fails.
+func (o *ClientOptions) SetBrokerResolver(r BrokerResolver) *ClientOptions {
+	o.BrokerResolver = r
+	return o
+}
+
+// SetCustomOpenConnectionFn sets the function which opens the connections
+// of the client to the brokers, taking the place of the dialers registered
+// with RegisterDialer and of the built-in transports. It may wrap the
+// connections opened by DefaultOpenConnection.
+func (o *ClientOptions) SetCustomOpenConnectionFn(fn OpenConnectionFunc) *ClientOptions {
+	o.CustomOpenConnectionFn = fn
+	return o
+}
+
+// SetClock sets the Clock of the client, used for the keepalive, the
+// backoff, the timeouts of the tokens and the send windows of hermes. The
+// default is the SystemClock.
+func (o *ClientOptions) SetClock(clock Clock) *ClientOptions {
+	o.Clock = clock
+	return o
+}
+
+// SetAutoAck sets whether the messages received are acknowledged as soon as
+// their handlers return, which is the default. When it is false the
+// handlers, or the workers they hand the messages to, must call Ack on each
+// message. The acknowledgements are sent in the order the messages were
+// received, an acknowledgement waits for those of the earlier messages.
+func (o *ClientOptions) SetAutoAck(autoAck bool) *ClientOptions {
+	o.AutoAck = autoAck
+	return o
+}
+
+// SetMaxUnacked sets how many QoS 1 and 2 messages may be delivered and not
+// yet acknowledged when AutoAck is false, the next messages are delivered
+// once the earlier ones are acknowledged. The default of 0 sets no limit.
+func (o *ClientOptions) SetMaxUnacked(n int) *ClientOptions {
+	o.MaxUnacked = n
+	return o
+}
+
+// SetAckTimeout sets how long a message may stay unacknowledged when
+// AutoAck is false, such messages are logged and, if disconnect is true,
+// the connection is ended with ErrAckTimeout so the server sends them
+// again. The default of 0 sets no timeout.
+func (o *ClientOptions) SetAckTimeout(d time.Duration, disconnect bool) *ClientOptions {
+	o.AckTimeout = d
+	o.AckTimeoutDisconnect = disconnect
+	return o
+}
+
 // SetConnectRetryInterval sets the time that will be waited between connection attempts
 // when initially connecting if ConnectRetry is TRUE
 func (o *ClientOptions) SetConnectRetryInterval(t time.Duration) *ClientOptions {
@@ -413,3 +628,65 @@ func (o *ClientOptions) SetBatteryLeftMah(battery float32) *ClientOptions {
 	o.HermesOptions.BatteryLeftMah = battery
 	return o
 }
+
+// SetCaptureSamples enables the capturing of a sample for each send window
+// of a device. The samples are kept on disk and uploaded to Hades in batches
+// to be used as training data for new models.
+func (o *ClientOptions) SetCaptureSamples(capture bool) *ClientOptions {
+	o.HermesOptions.CaptureSamples = capture
+	return o
+}
+
+// SetCaptureDir sets the directory in which captured samples are kept until
+// they are uploaded. Default is "./samples".
+func (o *ClientOptions) SetCaptureDir(dir string) *ClientOptions {
+	o.HermesOptions.CaptureDir = dir
+	return o
+}
+
+// SetCaptureMaxSamples sets how many samples are kept on disk, when the limit
+// is reached the oldest samples are dropped. Default is 1024.
+func (o *ClientOptions) SetCaptureMaxSamples(max int) *ClientOptions {
+	o.HermesOptions.CaptureMaxSamples = max
+	return o
+}
+
+// SetCaptureBatchSize sets how many samples are uploaded to Hades in a single
+// compressed batch. Default is 32.
+func (o *ClientOptions) SetCaptureBatchSize(size int) *ClientOptions {
+	o.HermesOptions.CaptureBatchSize = size
+	return o
+}
+
+// SetSendEnergy sets the estimated energy in mAh used by a single publish and
+// by each byte of its payload. It is used to estimate the energy used by the
+// cohorts of a model experiment.
+func (o *ClientOptions) SetSendEnergy(perSend float32, perByte float32) *ClientOptions {
+	o.HermesOptions.SendEnergyMah = perSend
+	o.HermesOptions.ByteEnergyMah = perByte
+	return o
+}
+
+// AddTopicPriority assigns a priority class to all topics matching the given
+// filter, the first matching filter decides the class of a topic. Once any
+// priority is added, the class alone decides how a publish is scheduled and
+// a QoS >= 1 no longer bypasses the send window.
+func (o *ClientOptions) AddTopicPriority(filter string, class PriorityClass) *ClientOptions {
+	o.HermesOptions.Priorities = append(o.HermesOptions.Priorities,
+		TopicPriority{Filter: filter, Class: class})
+	return o
+}
+
+// SetAlarmResetsWindow sets whether a publish of the alarm class restarts the
+// send window of the device.
+func (o *ClientOptions) SetAlarmResetsWindow(reset bool) *ClientOptions {
+	o.HermesOptions.AlarmResetsWindow = reset
+	return o
+}
+
+// SetBulkBatteryThreshold sets the part of the total battery (0 to 1) that
+// has to be left for publishes of the bulk class to be sent. Default is 0.5.
+func (o *ClientOptions) SetBulkBatteryThreshold(threshold float32) *ClientOptions {
+	o.HermesOptions.BulkBatteryThreshold = threshold
+	return o
+}
@@ -19,6 +19,8 @@ import (
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 // ClientOptionsReader provides an interface for reading ClientOptions after the client has been initialized.
@@ -26,6 +28,12 @@ type ClientOptionsReader struct {
 	options *ClientOptions
 }
 
+// NewOptionsReader returns a ClientOptionsReader of the options, for the
+// implementations of Client other than the one of NewClient.
+func NewOptionsReader(o *ClientOptions) ClientOptionsReader {
+	return ClientOptionsReader{options: o}
+}
+
 //Servers returns a slice of the servers defined in the clientoptions
 func (r *ClientOptionsReader) Servers() []*url.URL {
 	s := make([]*url.URL, len(r.options.Servers))
@@ -103,6 +111,101 @@ func (r *ClientOptionsReader) ProtocolVersion() uint {
 	return s
 }
 
+func (r *ClientOptionsReader) ConnectProperties() *packets.Properties {
+	s := r.options.ConnectProperties
+	return s
+}
+
+func (r *ClientOptionsReader) WillProperties() *packets.Properties {
+	s := r.options.WillProperties
+	return s
+}
+
+func (r *ClientOptionsReader) TopicAliasMaximum() uint16 {
+	s := r.options.TopicAliasMaximum
+	return s
+}
+
+func (r *ClientOptionsReader) Authenticator() Authenticator {
+	s := r.options.Authenticator
+	return s
+}
+
+func (r *ClientOptionsReader) MaxInflight() uint16 {
+	s := r.options.MaxInflight
+	return s
+}
+
+func (r *ClientOptionsReader) OfflineQueueSize() int {
+	s := r.options.OfflineQueueSize
+	return s
+}
+
+func (r *ClientOptionsReader) OfflineQueuePolicy() OfflineQueuePolicy {
+	s := r.options.OfflineQueuePolicy
+	return s
+}
+
+func (r *ClientOptionsReader) OfflineQueueTTL() time.Duration {
+	s := r.options.OfflineQueueTTL
+	return s
+}
+
+func (r *ClientOptionsReader) OfflineQueueStore() Store {
+	s := r.options.OfflineQueueStore
+	return s
+}
+
+func (r *ClientOptionsReader) BackoffStrategy() BackoffStrategy {
+	s := r.options.BackoffStrategy
+	return s
+}
+
+func (r *ClientOptionsReader) MaxConnectAttempts() int {
+	s := r.options.MaxConnectAttempts
+	return s
+}
+
+func (r *ClientOptionsReader) BackoffResetAfter() time.Duration {
+	s := r.options.BackoffResetAfter
+	return s
+}
+
+func (r *ClientOptionsReader) ServerSelector() ServerSelector {
+	s := r.options.ServerSelector
+	return s
+}
+
+func (r *ClientOptionsReader) BrokerResolver() BrokerResolver {
+	s := r.options.BrokerResolver
+	return s
+}
+
+func (r *ClientOptionsReader) Clock() Clock {
+	s := r.options.Clock
+	return s
+}
+
+func (r *ClientOptionsReader) AutoAck() bool {
+	s := r.options.AutoAck
+	return s
+}
+
+func (r *ClientOptionsReader) MaxUnacked() int {
+	s := r.options.MaxUnacked
+	return s
+}
+
+func (r *ClientOptionsReader) AckTimeout() time.Duration {
+	s := r.options.AckTimeout
+	return s
+}
+
+func (r *ClientOptionsReader) AckTimeoutDisconnect() bool {
+	s := r.options.AckTimeoutDisconnect
+	return s
+}
+
 func (r *ClientOptionsReader) TLSConfig() *tls.Config {
 	s := r.options.TLSConfig
 	return s
@@ -0,0 +1,47 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+//AuthPacket is an internal representation of the fields of the
+//Auth MQTT packet, which only exists in MQTT 5
+type AuthPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (a *AuthPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d", a.FixedHeader, a.ReasonCode)
+}
+
+func (a *AuthPacket) Write(w io.Writer) error {
+	body := encodeReason(a.ReasonCode, a.Properties, Auth)
+	a.FixedHeader.RemainingLength = len(body)
+	packet := a.FixedHeader.pack()
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
+
+	return err
+}
+
+//Unpack decodes the details of a ControlPacket after the fixed
+//header has been read
+func (a *AuthPacket) Unpack(b io.Reader) error {
+	if a.Properties == nil {
+		a.Properties = &Properties{}
+	}
+
+	var err error
+	a.ReasonCode, err = decodeReason(b, a.FixedHeader.RemainingLength, a.Properties, Auth)
+
+	return err
+}
+
+//Details returns a Details struct containing the Qos and
+//MessageID of this ControlPacket
+func (a *AuthPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -12,6 +12,10 @@ type ConnackPacket struct {
 	FixedHeader
 	SessionPresent bool
 	ReturnCode     byte
+
+	// Properties are sent only for MQTT 5, where ReturnCode is the reason
+	// code of the CONNACK.
+	Properties *Properties
 }
 
 func (ca *ConnackPacket) String() string {
@@ -24,7 +28,10 @@ func (ca *ConnackPacket) Write(w io.Writer) error {
 
 	body.WriteByte(boolToByte(ca.SessionPresent))
 	body.WriteByte(ca.ReturnCode)
-	ca.FixedHeader.RemainingLength = 2
+	if ca.Properties != nil {
+		body.Write(ca.Properties.encode(Connack))
+	}
+	ca.FixedHeader.RemainingLength = body.Len()
 	packet := ca.FixedHeader.pack()
 	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
@@ -41,8 +48,17 @@ func (ca *ConnackPacket) Unpack(b io.Reader) error {
 	}
 	ca.SessionPresent = 1&flags > 0
 	ca.ReturnCode, err = decodeByte(b)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// a server which does not support MQTT 5 answers with a 3.1.1 CONNACK,
+	// so the properties are read only if they were sent.
+	if ca.Properties != nil && ca.FixedHeader.RemainingLength > 2 {
+		return ca.Properties.Unpack(b, Connack)
+	}
+
+	return nil
 }
 
 //Details returns a Details struct containing the Qos and
@@ -26,6 +26,11 @@ type ConnectPacket struct {
 	WillMessage      []byte
 	Username         string
 	Password         []byte
+
+	// Properties and WillProperties are sent only when the ProtocolVersion
+	// is 5.
+	Properties     *Properties
+	WillProperties *Properties
 }
 
 func (c *ConnectPacket) String() string {
@@ -40,8 +45,14 @@ func (c *ConnectPacket) Write(w io.Writer) error {
 	body.WriteByte(c.ProtocolVersion)
 	body.WriteByte(boolToByte(c.CleanSession)<<1 | boolToByte(c.WillFlag)<<2 | c.WillQos<<3 | boolToByte(c.WillRetain)<<5 | boolToByte(c.PasswordFlag)<<6 | boolToByte(c.UsernameFlag)<<7)
 	body.Write(encodeUint16(c.Keepalive))
+	if c.ProtocolVersion == 5 {
+		body.Write(c.Properties.encode(Connect))
+	}
 	body.Write(encodeString(c.ClientIdentifier))
 	if c.WillFlag {
+		if c.ProtocolVersion == 5 {
+			body.Write(c.WillProperties.encode(willPacket))
+		}
 		body.Write(encodeString(c.WillTopic))
 		body.Write(encodeBytes(c.WillMessage))
 	}
@@ -86,11 +97,23 @@ func (c *ConnectPacket) Unpack(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if c.ProtocolVersion == 5 {
+		c.Properties = &Properties{}
+		if err = c.Properties.Unpack(b, Connect); err != nil {
+			return err
+		}
+	}
 	c.ClientIdentifier, err = decodeString(b)
 	if err != nil {
 		return err
 	}
 	if c.WillFlag {
+		if c.ProtocolVersion == 5 {
+			c.WillProperties = &Properties{}
+			if err = c.WillProperties.Unpack(b, willPacket); err != nil {
+				return err
+			}
+		}
 		c.WillTopic, err = decodeString(b)
 		if err != nil {
 			return err
@@ -125,7 +148,7 @@ func (c *ConnectPacket) Validate() byte {
 		//Bad reserved bit
 		return ErrProtocolViolation
 	}
-	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != 3) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != 4) {
+	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != 3) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != 4 && c.ProtocolVersion != 5) {
 		//Mismatched or unsupported protocol version
 		return ErrRefusedBadProtocolVersion
 	}
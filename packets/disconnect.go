@@ -8,6 +8,10 @@ import (
 //Disconnect MQTT packet
 type DisconnectPacket struct {
 	FixedHeader
+
+	// ReasonCode and Properties are sent only for MQTT 5.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (d *DisconnectPacket) String() string {
@@ -15,7 +19,13 @@ func (d *DisconnectPacket) String() string {
 }
 
 func (d *DisconnectPacket) Write(w io.Writer) error {
+	var body []byte
+	if d.Properties != nil {
+		body = encodeReason(d.ReasonCode, d.Properties, Disconnect)
+	}
+	d.FixedHeader.RemainingLength = len(body)
 	packet := d.FixedHeader.pack()
+	packet.Write(body)
 	_, err := packet.WriteTo(w)
 
 	return err
@@ -24,7 +34,14 @@ func (d *DisconnectPacket) Write(w io.Writer) error {
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (d *DisconnectPacket) Unpack(b io.Reader) error {
-	return nil
+	if d.Properties == nil {
+		return nil
+	}
+
+	var err error
+	d.ReasonCode, err = decodeReason(b, d.FixedHeader.RemainingLength, d.Properties, Disconnect)
+
+	return err
 }
 
 //Details returns a Details struct containing the Qos and
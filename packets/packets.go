@@ -35,6 +35,7 @@ var PacketNames = map[uint8]string{
 	12: "PINGREQ",
 	13: "PINGRESP",
 	14: "DISCONNECT",
+	15: "AUTH",
 }
 
 //Below are the constants assigned to each of the MQTT packet types
@@ -53,6 +54,7 @@ const (
 	Pingreq     = 12
 	Pingresp    = 13
 	Disconnect  = 14
+	Auth        = 15
 )
 
 //Below are the const definitions for error codes returned by
@@ -99,6 +101,13 @@ var ConnErrors = map[byte]error{
 //representing the decoded MQTT packet and an error. One of these returns will
 //always be nil, a nil ControlPacket indicating an error occurred.
 func ReadPacket(r io.Reader) (ControlPacket, error) {
+	return ReadPacketWithVersion(r, 4)
+}
+
+//ReadPacketWithVersion is like ReadPacket but decodes the packet according
+//to the given protocol version. The packets read with version 5 always have
+//properties, even if none were sent.
+func ReadPacketWithVersion(r io.Reader, version byte) (ControlPacket, error) {
 	var fh FixedHeader
 	b := make([]byte, 1)
 
@@ -116,6 +125,9 @@ func ReadPacket(r io.Reader) (ControlPacket, error) {
 	if err != nil {
 		return nil, err
 	}
+	if version == 5 {
+		InitProperties(cp)
+	}
 
 	packetBytes := make([]byte, fh.RemainingLength)
 	n, err := io.ReadFull(r, packetBytes)
@@ -164,6 +176,8 @@ func NewControlPacket(packetType byte) ControlPacket {
 		return &PingreqPacket{FixedHeader: FixedHeader{MessageType: Pingreq}}
 	case Pingresp:
 		return &PingrespPacket{FixedHeader: FixedHeader{MessageType: Pingresp}}
+	case Auth:
+		return &AuthPacket{FixedHeader: FixedHeader{MessageType: Auth}}
 	}
 	return nil
 }
@@ -201,6 +215,8 @@ func NewControlPacketWithHeader(fh FixedHeader) (ControlPacket, error) {
 		return &PingreqPacket{FixedHeader: fh}, nil
 	case Pingresp:
 		return &PingrespPacket{FixedHeader: fh}, nil
+	case Auth:
+		return &AuthPacket{FixedHeader: fh}, nil
 	}
 	return nil, fmt.Errorf("unsupported packet type 0x%x", fh.MessageType)
 }
@@ -0,0 +1,471 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Below are the identifiers of the MQTT 5 properties
+const (
+	PropPayloadFormat          = 0x01
+	PropMessageExpiry          = 0x02
+	PropContentType            = 0x03
+	PropResponseTopic          = 0x08
+	PropCorrelationData        = 0x09
+	PropSubscriptionIdentifier = 0x0B
+	PropSessionExpiryInterval  = 0x11
+	PropAssignedClientID       = 0x12
+	PropServerKeepAlive        = 0x13
+	PropAuthMethod             = 0x15
+	PropAuthData               = 0x16
+	PropRequestProblemInfo     = 0x17
+	PropWillDelayInterval      = 0x18
+	PropRequestResponseInfo    = 0x19
+	PropResponseInfo           = 0x1A
+	PropServerReference        = 0x1C
+	PropReasonString           = 0x1F
+	PropReceiveMaximum         = 0x21
+	PropTopicAliasMaximum      = 0x22
+	PropTopicAlias             = 0x23
+	PropMaximumQos             = 0x24
+	PropRetainAvailable        = 0x25
+	PropUser                   = 0x26
+	PropMaximumPacketSize      = 0x27
+	PropWildcardSubAvailable   = 0x28
+	PropSubIDAvailable         = 0x29
+	PropSharedSubAvailable     = 0x2A
+)
+
+// willPacket is used in validProperties for the properties of a will
+// message, which are sent inside of the Connect packet.
+const willPacket = 0xFF
+
+// validProperties maps each property to the packet types it may be sent in.
+var validProperties = map[byte]map[byte]bool{
+	PropPayloadFormat:          {Publish: true, willPacket: true},
+	PropMessageExpiry:          {Publish: true, willPacket: true},
+	PropContentType:            {Publish: true, willPacket: true},
+	PropResponseTopic:          {Publish: true, willPacket: true},
+	PropCorrelationData:        {Publish: true, willPacket: true},
+	PropSubscriptionIdentifier: {Publish: true, Subscribe: true},
+	PropSessionExpiryInterval:  {Connect: true, Connack: true, Disconnect: true},
+	PropAssignedClientID:       {Connack: true},
+	PropServerKeepAlive:        {Connack: true},
+	PropAuthMethod:             {Connect: true, Connack: true, Auth: true},
+	PropAuthData:               {Connect: true, Connack: true, Auth: true},
+	PropRequestProblemInfo:     {Connect: true},
+	PropWillDelayInterval:      {willPacket: true},
+	PropRequestResponseInfo:    {Connect: true},
+	PropResponseInfo:           {Connack: true},
+	PropServerReference:        {Connack: true, Disconnect: true},
+	PropReasonString:           {Connack: true, Puback: true, Pubrec: true, Pubrel: true, Pubcomp: true, Suback: true, Unsuback: true, Disconnect: true, Auth: true},
+	PropReceiveMaximum:         {Connect: true, Connack: true},
+	PropTopicAliasMaximum:      {Connect: true, Connack: true},
+	PropTopicAlias:             {Publish: true},
+	PropMaximumQos:             {Connack: true},
+	PropRetainAvailable:        {Connack: true},
+	PropUser:                   {Connect: true, Connack: true, Publish: true, Puback: true, Pubrec: true, Pubrel: true, Pubcomp: true, Subscribe: true, Suback: true, Unsubscribe: true, Unsuback: true, Disconnect: true, Auth: true, willPacket: true},
+	PropMaximumPacketSize:      {Connect: true, Connack: true},
+	PropWildcardSubAvailable:   {Connack: true},
+	PropSubIDAvailable:         {Connack: true},
+	PropSharedSubAvailable:     {Connack: true},
+}
+
+// ValidateProperty will check whether the property may be sent in a packet of
+// the given type.
+func ValidateProperty(id byte, packetType byte) bool {
+	return validProperties[id][packetType]
+}
+
+// UserProperty is a name and value pair defined by the application. User
+// properties may appear multiple times and their order is kept.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5 properties of a packet. Properties which are
+// not present are nil (or empty for strings and byte slices), so only the
+// properties that were set are sent.
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiryInterval  *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQos             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+func (p *Properties) String() string {
+	if p == nil {
+		return "properties: none"
+	}
+	return fmt.Sprintf("properties: %d bytes", len(p.Pack(0)))
+}
+
+// Copy will return a deep copy of the properties.
+func (p *Properties) Copy() *Properties {
+	if p == nil {
+		return nil
+	}
+
+	c := *p
+	if p.CorrelationData != nil {
+		c.CorrelationData = append([]byte(nil), p.CorrelationData...)
+	}
+	if p.AuthData != nil {
+		c.AuthData = append([]byte(nil), p.AuthData...)
+	}
+	if p.SubscriptionIdentifier != nil {
+		c.SubscriptionIdentifier = append([]int(nil), p.SubscriptionIdentifier...)
+	}
+	if p.User != nil {
+		c.User = append([]UserProperty(nil), p.User...)
+	}
+
+	return &c
+}
+
+// Pack will encode the properties allowed in a packet of the given type,
+// without the leading property length. A packetType of 0 encodes all of the
+// properties that are set.
+func (p *Properties) Pack(packetType byte) []byte {
+	var b bytes.Buffer
+	if p == nil {
+		return nil
+	}
+
+	allowed := func(id byte) bool {
+		return packetType == 0 || ValidateProperty(id, packetType)
+	}
+	writeByte := func(id byte, v *byte) {
+		if v != nil && allowed(id) {
+			b.WriteByte(id)
+			b.WriteByte(*v)
+		}
+	}
+	writeUint16 := func(id byte, v *uint16) {
+		if v != nil && allowed(id) {
+			b.WriteByte(id)
+			b.Write(encodeUint16(*v))
+		}
+	}
+	writeUint32 := func(id byte, v *uint32) {
+		if v != nil && allowed(id) {
+			b.WriteByte(id)
+			b.Write(encodeUint32(*v))
+		}
+	}
+	writeString := func(id byte, v string) {
+		if v != "" && allowed(id) {
+			b.WriteByte(id)
+			b.Write(encodeString(v))
+		}
+	}
+	writeBytes := func(id byte, v []byte) {
+		if v != nil && allowed(id) {
+			b.WriteByte(id)
+			b.Write(encodeBytes(v))
+		}
+	}
+
+	writeByte(PropPayloadFormat, p.PayloadFormat)
+	writeUint32(PropMessageExpiry, p.MessageExpiry)
+	writeString(PropContentType, p.ContentType)
+	writeString(PropResponseTopic, p.ResponseTopic)
+	writeBytes(PropCorrelationData, p.CorrelationData)
+	if allowed(PropSubscriptionIdentifier) {
+		for _, id := range p.SubscriptionIdentifier {
+			b.WriteByte(PropSubscriptionIdentifier)
+			b.Write(encodeLength(id))
+		}
+	}
+	writeUint32(PropSessionExpiryInterval, p.SessionExpiryInterval)
+	writeString(PropAssignedClientID, p.AssignedClientID)
+	writeUint16(PropServerKeepAlive, p.ServerKeepAlive)
+	writeString(PropAuthMethod, p.AuthMethod)
+	writeBytes(PropAuthData, p.AuthData)
+	writeByte(PropRequestProblemInfo, p.RequestProblemInfo)
+	writeUint32(PropWillDelayInterval, p.WillDelayInterval)
+	writeByte(PropRequestResponseInfo, p.RequestResponseInfo)
+	writeString(PropResponseInfo, p.ResponseInfo)
+	writeString(PropServerReference, p.ServerReference)
+	writeString(PropReasonString, p.ReasonString)
+	writeUint16(PropReceiveMaximum, p.ReceiveMaximum)
+	writeUint16(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	writeUint16(PropTopicAlias, p.TopicAlias)
+	writeByte(PropMaximumQos, p.MaximumQos)
+	writeByte(PropRetainAvailable, p.RetainAvailable)
+	if allowed(PropUser) {
+		for _, u := range p.User {
+			b.WriteByte(PropUser)
+			b.Write(encodeString(u.Key))
+			b.Write(encodeString(u.Value))
+		}
+	}
+	writeUint32(PropMaximumPacketSize, p.MaximumPacketSize)
+	writeByte(PropWildcardSubAvailable, p.WildcardSubAvailable)
+	writeByte(PropSubIDAvailable, p.SubIDAvailable)
+	writeByte(PropSharedSubAvailable, p.SharedSubAvailable)
+
+	return b.Bytes()
+}
+
+// encode will encode the properties allowed in a packet of the given type
+// together with the leading property length.
+func (p *Properties) encode(packetType byte) []byte {
+	props := p.Pack(packetType)
+	return append(encodeLength(len(props)), props...)
+}
+
+// Unpack will decode the properties, including the leading property length,
+// which are sent in a packet of the given type. It returns an error if a
+// property is not allowed in the packet.
+func (p *Properties) Unpack(r io.Reader, packetType byte) error {
+	_, err := p.unpack(r, packetType)
+	return err
+}
+
+// unpack will decode the properties and return the number of bytes read.
+func (p *Properties) unpack(r io.Reader, packetType byte) (int, error) {
+	length, err := decodeLength(r)
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, err
+	}
+	b := bytes.NewBuffer(data)
+	read := len(encodeLength(length)) + length
+
+	for b.Len() > 0 {
+		id, err := b.ReadByte()
+		if err != nil {
+			return read, err
+		}
+		if !ValidateProperty(id, packetType) {
+			return read, fmt.Errorf("invalid property 0x%x for %s", id, PacketNames[packetType])
+		}
+
+		switch id {
+		case PropPayloadFormat:
+			p.PayloadFormat, err = decodeBytePtr(b)
+		case PropMessageExpiry:
+			p.MessageExpiry, err = decodeUint32Ptr(b)
+		case PropContentType:
+			p.ContentType, err = decodeString(b)
+		case PropResponseTopic:
+			p.ResponseTopic, err = decodeString(b)
+		case PropCorrelationData:
+			p.CorrelationData, err = decodeBytes(b)
+		case PropSubscriptionIdentifier:
+			var id int
+			id, err = decodeLength(b)
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, id)
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, err = decodeUint32Ptr(b)
+		case PropAssignedClientID:
+			p.AssignedClientID, err = decodeString(b)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, err = decodeUint16Ptr(b)
+		case PropAuthMethod:
+			p.AuthMethod, err = decodeString(b)
+		case PropAuthData:
+			p.AuthData, err = decodeBytes(b)
+		case PropRequestProblemInfo:
+			p.RequestProblemInfo, err = decodeBytePtr(b)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, err = decodeUint32Ptr(b)
+		case PropRequestResponseInfo:
+			p.RequestResponseInfo, err = decodeBytePtr(b)
+		case PropResponseInfo:
+			p.ResponseInfo, err = decodeString(b)
+		case PropServerReference:
+			p.ServerReference, err = decodeString(b)
+		case PropReasonString:
+			p.ReasonString, err = decodeString(b)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, err = decodeUint16Ptr(b)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, err = decodeUint16Ptr(b)
+		case PropTopicAlias:
+			p.TopicAlias, err = decodeUint16Ptr(b)
+		case PropMaximumQos:
+			p.MaximumQos, err = decodeBytePtr(b)
+		case PropRetainAvailable:
+			p.RetainAvailable, err = decodeBytePtr(b)
+		case PropUser:
+			var u UserProperty
+			if u.Key, err = decodeString(b); err == nil {
+				u.Value, err = decodeString(b)
+			}
+			p.User = append(p.User, u)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, err = decodeUint32Ptr(b)
+		case PropWildcardSubAvailable:
+			p.WildcardSubAvailable, err = decodeBytePtr(b)
+		case PropSubIDAvailable:
+			p.SubIDAvailable, err = decodeBytePtr(b)
+		case PropSharedSubAvailable:
+			p.SharedSubAvailable, err = decodeBytePtr(b)
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+// encodeReason will encode the reason code and properties of an
+// acknowledgement or DISCONNECT packet. Both may be left out when the reason
+// code is success and there are no properties.
+func encodeReason(code byte, p *Properties, packetType byte) []byte {
+	props := p.Pack(packetType)
+	if code == ReasonSuccess && len(props) == 0 {
+		return nil
+	}
+
+	b := []byte{code}
+	if len(props) > 0 {
+		b = append(b, encodeLength(len(props))...)
+		b = append(b, props...)
+	}
+	return b
+}
+
+// decodeReason will decode the reason code and properties from the given
+// number of remaining bytes of a packet.
+func decodeReason(r io.Reader, length int, p *Properties, packetType byte) (byte, error) {
+	if length < 1 {
+		return ReasonSuccess, nil
+	}
+
+	code, err := decodeByte(r)
+	if err != nil || length < 2 {
+		return code, err
+	}
+
+	return code, p.Unpack(r, packetType)
+}
+
+// propertiesOf will return the properties field of the packet, nil is
+// returned for packets which have no properties.
+func propertiesOf(cp ControlPacket) **Properties {
+	switch p := cp.(type) {
+	case *ConnectPacket:
+		return &p.Properties
+	case *ConnackPacket:
+		return &p.Properties
+	case *PublishPacket:
+		return &p.Properties
+	case *PubackPacket:
+		return &p.Properties
+	case *PubrecPacket:
+		return &p.Properties
+	case *PubrelPacket:
+		return &p.Properties
+	case *PubcompPacket:
+		return &p.Properties
+	case *SubscribePacket:
+		return &p.Properties
+	case *SubackPacket:
+		return &p.Properties
+	case *UnsubscribePacket:
+		return &p.Properties
+	case *UnsubackPacket:
+		return &p.Properties
+	case *DisconnectPacket:
+		return &p.Properties
+	case *AuthPacket:
+		return &p.Properties
+	}
+	return nil
+}
+
+// InitProperties will give the packet an empty set of properties if it has
+// none, which makes it to be encoded as an MQTT 5 packet. Packets without
+// properties (PINGREQ and PINGRESP) are left unchanged.
+func InitProperties(cp ControlPacket) {
+	if c, ok := cp.(*ConnectPacket); ok {
+		c.ProtocolVersion = 5
+	}
+	if props := propertiesOf(cp); props != nil && *props == nil {
+		*props = &Properties{}
+	}
+}
+
+// ClearProperties will remove the properties of the packet, which makes it
+// to be encoded as an MQTT 3.1.1 packet.
+func ClearProperties(cp ControlPacket) {
+	if props := propertiesOf(cp); props != nil {
+		*props = nil
+	}
+}
+
+// PropertiesOf will return the properties of the packet, nil is returned for
+// packets which are encoded as MQTT 3.1.1 packets.
+func PropertiesOf(cp ControlPacket) *Properties {
+	if c, ok := cp.(*ConnectPacket); ok && c.ProtocolVersion == 5 && c.Properties == nil {
+		return &Properties{}
+	}
+	if props := propertiesOf(cp); props != nil {
+		return *props
+	}
+	return nil
+}
+
+func encodeUint32(num uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, num)
+	return bytes
+}
+
+func decodeUint32(b io.Reader) (uint32, error) {
+	num := make([]byte, 4)
+	_, err := io.ReadFull(b, num)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(num), nil
+}
+
+func decodeBytePtr(b io.Reader) (*byte, error) {
+	v, err := decodeByte(b)
+	return &v, err
+}
+
+func decodeUint16Ptr(b io.Reader) (*uint16, error) {
+	v, err := decodeUint16(b)
+	return &v, err
+}
+
+func decodeUint32Ptr(b io.Reader) (*uint32, error) {
+	v, err := decodeUint32(b)
+	return &v, err
+}
@@ -0,0 +1,162 @@
+package packets
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPropertiesPackUnpack(t *testing.T) {
+	format := byte(1)
+	expiry := uint32(60)
+	alias := uint16(3)
+	props := &Properties{
+		PayloadFormat:          &format,
+		MessageExpiry:          &expiry,
+		ContentType:            "application/json",
+		ResponseTopic:          "reply/to",
+		CorrelationData:        []byte{0x01, 0x02},
+		SubscriptionIdentifier: []int{1, 268435455},
+		TopicAlias:             &alias,
+		User:                   []UserProperty{{"a", "1"}, {"a", "2"}},
+	}
+
+	buf := bytes.NewBuffer(props.encode(Publish))
+	read := &Properties{}
+	if err := read.Unpack(buf, Publish); err != nil {
+		t.Fatalf("Unpack of properties returned error: %s", err)
+	}
+	if !reflect.DeepEqual(props, read) {
+		t.Errorf("Unpack of packed properties did not equal original.\nExpected: %+v\n     Got: %+v", props, read)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Unpack of properties left %d bytes unread", buf.Len())
+	}
+
+	// properties which are not allowed in a packet are not sent.
+	if res := props.Pack(Puback); len(res) != 2*(1+3+3) {
+		t.Errorf("Pack of publish properties for PUBACK returned [0x%X]", res)
+	}
+
+	if err := (&Properties{}).Unpack(bytes.NewBuffer(props.encode(Publish)), Puback); err == nil {
+		t.Errorf("Unpack of publish properties for PUBACK did not return an error")
+	}
+}
+
+func TestPackUnpackControlPacketsV5(t *testing.T) {
+	user := []UserProperty{{"key", "value"}}
+	keepAlive := uint16(30)
+
+	connect := NewControlPacket(Connect).(*ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ClientIdentifier = "client"
+	connect.WillFlag = true
+	connect.WillTopic = "will"
+	connect.WillMessage = []byte("gone")
+	connect.WillProperties = &Properties{ContentType: "text/plain"}
+	connack := NewControlPacket(Connack).(*ConnackPacket)
+	connack.ReturnCode = ReasonNotAuthorized
+	connack.Properties = &Properties{ServerKeepAlive: &keepAlive}
+	publish := NewControlPacket(Publish).(*PublishPacket)
+	publish.Qos = 1
+	publish.MessageID = 7
+	publish.TopicName = "a/b"
+	publish.Payload = []byte("payload")
+	publish.Properties = &Properties{User: user}
+	puback := NewControlPacket(Puback).(*PubackPacket)
+	puback.MessageID = 7
+	puback.ReasonCode = ReasonNoMatchingSubscribers
+	pubrec := NewControlPacket(Pubrec).(*PubrecPacket)
+	pubrec.ReasonCode = ReasonQuotaExceeded
+	pubrec.Properties = &Properties{ReasonString: "quota"}
+	subscribe := NewControlPacket(Subscribe).(*SubscribePacket)
+	subscribe.Topics = []string{"a/#"}
+	subscribe.Qoss = []byte{1}
+	subscribe.Properties = &Properties{SubscriptionIdentifier: []int{5}}
+	suback := NewControlPacket(Suback).(*SubackPacket)
+	suback.ReturnCodes = []byte{ReasonGrantedQos1, ReasonNotAuthorized}
+	unsubscribe := NewControlPacket(Unsubscribe).(*UnsubscribePacket)
+	unsubscribe.Topics = []string{"a/#"}
+	unsuback := NewControlPacket(Unsuback).(*UnsubackPacket)
+	unsuback.ReasonCodes = []byte{ReasonNoSubscriptionExisted}
+	disconnect := NewControlPacket(Disconnect).(*DisconnectPacket)
+	disconnect.ReasonCode = ReasonServerShuttingDown
+	disconnect.Properties = &Properties{ReasonString: "maintenance"}
+	auth := NewControlPacket(Auth).(*AuthPacket)
+	auth.ReasonCode = ReasonContinueAuthentication
+	auth.Properties = &Properties{AuthMethod: "SCRAM-SHA-256", AuthData: []byte("r=nonce")}
+
+	packets := []ControlPacket{
+		connect,
+		connack,
+		publish,
+		puback,
+		pubrec,
+		NewControlPacket(Pubrel).(*PubrelPacket),
+		NewControlPacket(Pubcomp).(*PubcompPacket),
+		subscribe,
+		suback,
+		unsubscribe,
+		unsuback,
+		NewControlPacket(Pingreq).(*PingreqPacket),
+		NewControlPacket(Pingresp).(*PingrespPacket),
+		disconnect,
+		NewControlPacket(Disconnect).(*DisconnectPacket),
+		auth,
+		NewControlPacket(Auth).(*AuthPacket),
+	}
+	buf := new(bytes.Buffer)
+	for _, packet := range packets {
+		InitProperties(packet)
+		buf.Reset()
+		if err := packet.Write(buf); err != nil {
+			t.Errorf("Write of %T returned error: %s", packet, err)
+		}
+		read, err := ReadPacketWithVersion(buf, 5)
+		if err != nil {
+			t.Errorf("Read of packed %T returned error: %s", packet, err)
+			continue
+		}
+		if !reflect.DeepEqual(read, packet) {
+			t.Errorf("Read of packed %T did not equal original.\nExpected: %+v\n     Got: %+v", packet, packet, read)
+		}
+	}
+}
+
+func TestReadConnackV3WithVersion5(t *testing.T) {
+	connack := NewControlPacket(Connack).(*ConnackPacket)
+	connack.ReturnCode = ErrRefusedBadProtocolVersion
+
+	buf := new(bytes.Buffer)
+	connack.Write(buf)
+	read, err := ReadPacketWithVersion(buf, 5)
+	if err != nil {
+		t.Fatalf("Read of 3.1.1 CONNACK returned error: %s", err)
+	}
+	if rc := read.(*ConnackPacket).ReturnCode; rc != ErrRefusedBadProtocolVersion {
+		t.Errorf("Read of 3.1.1 CONNACK returned code %d, should be %d", rc, ErrRefusedBadProtocolVersion)
+	}
+}
+
+func TestAckWithoutReasonCode(t *testing.T) {
+	puback := NewControlPacket(Puback).(*PubackPacket)
+	puback.MessageID = 1
+	puback.Properties = &Properties{}
+
+	buf := new(bytes.Buffer)
+	puback.Write(buf)
+	if !bytes.Equal(buf.Bytes(), []byte{Puback << 4, 0x02, 0x00, 0x01}) {
+		t.Errorf("Write of successful PUBACK returned [0x%X]", buf.Bytes())
+	}
+}
+
+func TestReasonCodeError(t *testing.T) {
+	if err := NewReasonCodeError(ReasonNoMatchingSubscribers, nil); err != nil {
+		t.Errorf("NewReasonCodeError(0x10) returned %v, should be nil", err)
+	}
+
+	err := NewReasonCodeError(ReasonNotAuthorized, &Properties{ReasonString: "acl"})
+	if err == nil || err.Error() != "Not authorized (0x87): acl" {
+		t.Errorf("NewReasonCodeError(0x87) returned %v", err)
+	}
+}
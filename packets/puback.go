@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -10,6 +11,10 @@ import (
 type PubackPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// ReasonCode and Properties are sent only for MQTT 5.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pa *PubackPacket) String() string {
@@ -17,10 +22,16 @@ func (pa *PubackPacket) String() string {
 }
 
 func (pa *PubackPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
 	var err error
-	pa.FixedHeader.RemainingLength = 2
+
+	body.Write(encodeUint16(pa.MessageID))
+	if pa.Properties != nil {
+		body.Write(encodeReason(pa.ReasonCode, pa.Properties, Puback))
+	}
+	pa.FixedHeader.RemainingLength = body.Len()
 	packet := pa.FixedHeader.pack()
-	packet.Write(encodeUint16(pa.MessageID))
+	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -31,6 +42,11 @@ func (pa *PubackPacket) Write(w io.Writer) error {
 func (pa *PubackPacket) Unpack(b io.Reader) error {
 	var err error
 	pa.MessageID, err = decodeUint16(b)
+	if err != nil || pa.Properties == nil {
+		return err
+	}
+
+	pa.ReasonCode, err = decodeReason(b, pa.FixedHeader.RemainingLength-2, pa.Properties, Puback)
 
 	return err
 }
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -10,6 +11,10 @@ import (
 type PubcompPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// ReasonCode and Properties are sent only for MQTT 5.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pc *PubcompPacket) String() string {
@@ -17,10 +22,16 @@ func (pc *PubcompPacket) String() string {
 }
 
 func (pc *PubcompPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
 	var err error
-	pc.FixedHeader.RemainingLength = 2
+
+	body.Write(encodeUint16(pc.MessageID))
+	if pc.Properties != nil {
+		body.Write(encodeReason(pc.ReasonCode, pc.Properties, Pubcomp))
+	}
+	pc.FixedHeader.RemainingLength = body.Len()
 	packet := pc.FixedHeader.pack()
-	packet.Write(encodeUint16(pc.MessageID))
+	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -31,6 +42,11 @@ func (pc *PubcompPacket) Write(w io.Writer) error {
 func (pc *PubcompPacket) Unpack(b io.Reader) error {
 	var err error
 	pc.MessageID, err = decodeUint16(b)
+	if err != nil || pc.Properties == nil {
+		return err
+	}
+
+	pc.ReasonCode, err = decodeReason(b, pc.FixedHeader.RemainingLength-2, pc.Properties, Pubcomp)
 
 	return err
 }
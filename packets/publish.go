@@ -13,6 +13,9 @@ type PublishPacket struct {
 	TopicName string
 	MessageID uint16
 	Payload   []byte
+
+	// Properties are sent only for MQTT 5.
+	Properties *Properties
 }
 
 func (p *PublishPacket) String() string {
@@ -27,6 +30,9 @@ func (p *PublishPacket) Write(w io.Writer) error {
 	if p.Qos > 0 {
 		body.Write(encodeUint16(p.MessageID))
 	}
+	if p.Properties != nil {
+		body.Write(p.Properties.encode(Publish))
+	}
 	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
 	packet := p.FixedHeader.pack()
 	packet.Write(body.Bytes())
@@ -55,6 +61,13 @@ func (p *PublishPacket) Unpack(b io.Reader) error {
 	} else {
 		payloadLength -= len(p.TopicName) + 2
 	}
+	if p.Properties != nil {
+		read, err := p.Properties.unpack(b, Publish)
+		if err != nil {
+			return err
+		}
+		payloadLength -= read
+	}
 	if payloadLength < 0 {
 		return fmt.Errorf("Error unpacking publish, payload length < 0")
 	}
@@ -72,6 +85,7 @@ func (p *PublishPacket) Copy() *PublishPacket {
 	newP := NewControlPacket(Publish).(*PublishPacket)
 	newP.TopicName = p.TopicName
 	newP.Payload = p.Payload
+	newP.Properties = p.Properties.Copy()
 
 	return newP
 }
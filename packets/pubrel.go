@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -10,6 +11,10 @@ import (
 type PubrelPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// ReasonCode and Properties are sent only for MQTT 5.
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pr *PubrelPacket) String() string {
@@ -17,10 +22,16 @@ func (pr *PubrelPacket) String() string {
 }
 
 func (pr *PubrelPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
 	var err error
-	pr.FixedHeader.RemainingLength = 2
+
+	body.Write(encodeUint16(pr.MessageID))
+	if pr.Properties != nil {
+		body.Write(encodeReason(pr.ReasonCode, pr.Properties, Pubrel))
+	}
+	pr.FixedHeader.RemainingLength = body.Len()
 	packet := pr.FixedHeader.pack()
-	packet.Write(encodeUint16(pr.MessageID))
+	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -31,6 +42,11 @@ func (pr *PubrelPacket) Write(w io.Writer) error {
 func (pr *PubrelPacket) Unpack(b io.Reader) error {
 	var err error
 	pr.MessageID, err = decodeUint16(b)
+	if err != nil || pr.Properties == nil {
+		return err
+	}
+
+	pr.ReasonCode, err = decodeReason(b, pr.FixedHeader.RemainingLength-2, pr.Properties, Pubrel)
 
 	return err
 }
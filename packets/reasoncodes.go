@@ -0,0 +1,135 @@
+package packets
+
+import (
+	"fmt"
+)
+
+// Below are the MQTT 5 reason codes. Codes below 0x80 indicate success, all
+// of the others indicate a failure.
+const (
+	ReasonSuccess                     = 0x00
+	ReasonGrantedQos1                 = 0x01
+	ReasonGrantedQos2                 = 0x02
+	ReasonDisconnectWithWill          = 0x04
+	ReasonNoMatchingSubscribers       = 0x10
+	ReasonNoSubscriptionExisted       = 0x11
+	ReasonContinueAuthentication      = 0x18
+	ReasonReauthenticate              = 0x19
+	ReasonUnspecifiedError            = 0x80
+	ReasonMalformedPacket             = 0x81
+	ReasonProtocolError               = 0x82
+	ReasonImplementationSpecificError = 0x83
+	ReasonUnsupportedProtocolVersion  = 0x84
+	ReasonClientIDNotValid            = 0x85
+	ReasonBadUsernameOrPassword       = 0x86
+	ReasonNotAuthorized               = 0x87
+	ReasonServerUnavailable           = 0x88
+	ReasonServerBusy                  = 0x89
+	ReasonBanned                      = 0x8A
+	ReasonServerShuttingDown          = 0x8B
+	ReasonBadAuthenticationMethod     = 0x8C
+	ReasonKeepAliveTimeout            = 0x8D
+	ReasonSessionTakenOver            = 0x8E
+	ReasonTopicFilterInvalid          = 0x8F
+	ReasonTopicNameInvalid            = 0x90
+	ReasonPacketIDInUse               = 0x91
+	ReasonPacketIDNotFound            = 0x92
+	ReasonReceiveMaximumExceeded      = 0x93
+	ReasonTopicAliasInvalid           = 0x94
+	ReasonPacketTooLarge              = 0x95
+	ReasonMessageRateTooHigh          = 0x96
+	ReasonQuotaExceeded               = 0x97
+	ReasonAdministrativeAction        = 0x98
+	ReasonPayloadFormatInvalid        = 0x99
+	ReasonRetainNotSupported          = 0x9A
+	ReasonQosNotSupported             = 0x9B
+	ReasonUseAnotherServer            = 0x9C
+	ReasonServerMoved                 = 0x9D
+	ReasonSharedSubNotSupported       = 0x9E
+	ReasonConnectionRateExceeded      = 0x9F
+	ReasonMaximumConnectTime          = 0xA0
+	ReasonSubIDNotSupported           = 0xA1
+	ReasonWildcardSubNotSupported     = 0xA2
+)
+
+// ReasonCodeNames is a map of the MQTT 5 reason codes to a string
+// representation of the reason
+var ReasonCodeNames = map[uint8]string{
+	0x00: "Success",
+	0x01: "Granted QoS 1",
+	0x02: "Granted QoS 2",
+	0x04: "Disconnect with Will Message",
+	0x10: "No matching subscribers",
+	0x11: "No subscription existed",
+	0x18: "Continue authentication",
+	0x19: "Re-authenticate",
+	0x80: "Unspecified error",
+	0x81: "Malformed Packet",
+	0x82: "Protocol Error",
+	0x83: "Implementation specific error",
+	0x84: "Unsupported Protocol Version",
+	0x85: "Client Identifier not valid",
+	0x86: "Bad User Name or Password",
+	0x87: "Not authorized",
+	0x88: "Server unavailable",
+	0x89: "Server busy",
+	0x8A: "Banned",
+	0x8B: "Server shutting down",
+	0x8C: "Bad authentication method",
+	0x8D: "Keep Alive timeout",
+	0x8E: "Session taken over",
+	0x8F: "Topic Filter invalid",
+	0x90: "Topic Name invalid",
+	0x91: "Packet Identifier in use",
+	0x92: "Packet Identifier not found",
+	0x93: "Receive Maximum exceeded",
+	0x94: "Topic Alias invalid",
+	0x95: "Packet too large",
+	0x96: "Message rate too high",
+	0x97: "Quota exceeded",
+	0x98: "Administrative action",
+	0x99: "Payload format invalid",
+	0x9A: "Retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "Use another server",
+	0x9D: "Server moved",
+	0x9E: "Shared Subscriptions not supported",
+	0x9F: "Connection rate exceeded",
+	0xA0: "Maximum connect time",
+	0xA1: "Subscription Identifiers not supported",
+	0xA2: "Wildcard Subscriptions not supported",
+}
+
+// ReasonCodeError is the error used when the server answers with an MQTT 5
+// reason code which indicates a failure. Reason is the reason string sent by
+// the server, if any.
+type ReasonCodeError struct {
+	Code   byte
+	Reason string
+}
+
+func (e *ReasonCodeError) Error() string {
+	name, ok := ReasonCodeNames[e.Code]
+	if !ok {
+		name = "Unknown reason"
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("%s (0x%02x): %s", name, e.Code, e.Reason)
+	}
+	return fmt.Sprintf("%s (0x%02x)", name, e.Code)
+}
+
+// NewReasonCodeError will return an error for the reason code, nil is
+// returned if the code indicates success. The reason string is taken from
+// the properties if they are given.
+func NewReasonCodeError(code byte, p *Properties) error {
+	if code < ReasonUnspecifiedError {
+		return nil
+	}
+
+	e := &ReasonCodeError{Code: code}
+	if p != nil {
+		e.Reason = p.ReasonString
+	}
+	return e
+}
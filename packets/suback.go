@@ -12,6 +12,10 @@ type SubackPacket struct {
 	FixedHeader
 	MessageID   uint16
 	ReturnCodes []byte
+
+	// Properties are sent only for MQTT 5, where ReturnCodes are the reason
+	// codes of the subscriptions.
+	Properties *Properties
 }
 
 func (sa *SubackPacket) String() string {
@@ -22,6 +26,9 @@ func (sa *SubackPacket) Write(w io.Writer) error {
 	var body bytes.Buffer
 	var err error
 	body.Write(encodeUint16(sa.MessageID))
+	if sa.Properties != nil {
+		body.Write(sa.Properties.encode(Suback))
+	}
 	body.Write(sa.ReturnCodes)
 	sa.FixedHeader.RemainingLength = body.Len()
 	packet := sa.FixedHeader.pack()
@@ -40,6 +47,11 @@ func (sa *SubackPacket) Unpack(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if sa.Properties != nil {
+		if err = sa.Properties.Unpack(b, Suback); err != nil {
+			return err
+		}
+	}
 
 	_, err = qosBuffer.ReadFrom(b)
 	if err != nil {
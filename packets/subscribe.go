@@ -13,6 +13,10 @@ type SubscribePacket struct {
 	MessageID uint16
 	Topics    []string
 	Qoss      []byte
+
+	// Properties are sent only for MQTT 5, where each of the Qoss also
+	// holds the subscription options.
+	Properties *Properties
 }
 
 func (s *SubscribePacket) String() string {
@@ -24,6 +28,9 @@ func (s *SubscribePacket) Write(w io.Writer) error {
 	var err error
 
 	body.Write(encodeUint16(s.MessageID))
+	if s.Properties != nil {
+		body.Write(s.Properties.encode(Subscribe))
+	}
 	for i, topic := range s.Topics {
 		body.Write(encodeString(topic))
 		body.WriteByte(s.Qoss[i])
@@ -45,6 +52,13 @@ func (s *SubscribePacket) Unpack(b io.Reader) error {
 		return err
 	}
 	payloadLength := s.FixedHeader.RemainingLength - 2
+	if s.Properties != nil {
+		read, err := s.Properties.unpack(b, Subscribe)
+		if err != nil {
+			return err
+		}
+		payloadLength -= read
+	}
 	for payloadLength > 0 {
 		topic, err := decodeString(b)
 		if err != nil {
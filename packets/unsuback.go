@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -10,6 +11,10 @@ import (
 type UnsubackPacket struct {
 	FixedHeader
 	MessageID uint16
+
+	// ReasonCodes and Properties are sent only for MQTT 5.
+	ReasonCodes []byte
+	Properties  *Properties
 }
 
 func (ua *UnsubackPacket) String() string {
@@ -17,10 +22,17 @@ func (ua *UnsubackPacket) String() string {
 }
 
 func (ua *UnsubackPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
 	var err error
-	ua.FixedHeader.RemainingLength = 2
+
+	body.Write(encodeUint16(ua.MessageID))
+	if ua.Properties != nil {
+		body.Write(ua.Properties.encode(Unsuback))
+		body.Write(ua.ReasonCodes)
+	}
+	ua.FixedHeader.RemainingLength = body.Len()
 	packet := ua.FixedHeader.pack()
-	packet.Write(encodeUint16(ua.MessageID))
+	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -29,10 +41,22 @@ func (ua *UnsubackPacket) Write(w io.Writer) error {
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (ua *UnsubackPacket) Unpack(b io.Reader) error {
+	var codes bytes.Buffer
 	var err error
 	ua.MessageID, err = decodeUint16(b)
+	if err != nil || ua.Properties == nil {
+		return err
+	}
 
-	return err
+	if err = ua.Properties.Unpack(b, Unsuback); err != nil {
+		return err
+	}
+	if _, err = codes.ReadFrom(b); err != nil {
+		return err
+	}
+	ua.ReasonCodes = codes.Bytes()
+
+	return nil
 }
 
 //Details returns a Details struct containing the Qos and
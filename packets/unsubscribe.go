@@ -12,6 +12,9 @@ type UnsubscribePacket struct {
 	FixedHeader
 	MessageID uint16
 	Topics    []string
+
+	// Properties are sent only for MQTT 5.
+	Properties *Properties
 }
 
 func (u *UnsubscribePacket) String() string {
@@ -22,6 +25,9 @@ func (u *UnsubscribePacket) Write(w io.Writer) error {
 	var body bytes.Buffer
 	var err error
 	body.Write(encodeUint16(u.MessageID))
+	if u.Properties != nil {
+		body.Write(u.Properties.encode(Unsubscribe))
+	}
 	for _, topic := range u.Topics {
 		body.Write(encodeString(topic))
 	}
@@ -41,6 +47,11 @@ func (u *UnsubscribePacket) Unpack(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if u.Properties != nil {
+		if err = u.Properties.Unpack(b, Unsubscribe); err != nil {
+			return err
+		}
+	}
 
 	for topic, err := decodeString(b); err == nil && topic != ""; topic, err = decodeString(b) {
 		u.Topics = append(u.Topics, topic)
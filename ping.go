@@ -19,7 +19,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 func keepalive(c *client) {
@@ -34,7 +34,8 @@ func keepalive(c *client) {
 		checkInterval = c.options.KeepAlive / 2
 	}
 
-	intervalTicker := time.NewTicker(time.Duration(checkInterval * int64(time.Second)))
+	clock := c.options.Clock
+	intervalTicker := clock.NewTicker(time.Duration(checkInterval * int64(time.Second)))
 	defer intervalTicker.Stop()
 
 	for {
@@ -42,12 +43,14 @@ func keepalive(c *client) {
 		case <-c.stop:
 			DEBUG.Println(PNG, "keepalive stopped")
 			return
-		case <-intervalTicker.C:
+		case <-intervalTicker.C():
 			lastSent := c.lastSent.Load().(time.Time)
 			lastReceived := c.lastReceived.Load().(time.Time)
 
-			DEBUG.Println(PNG, "ping check", time.Since(lastSent).Seconds())
-			if time.Since(lastSent) >= time.Duration(c.options.KeepAlive*int64(time.Second)) || time.Since(lastReceived) >= time.Duration(c.options.KeepAlive*int64(time.Second)) {
+			now := clock.Now()
+
+			DEBUG.Println(PNG, "ping check", now.Sub(lastSent).Seconds())
+			if now.Sub(lastSent) >= time.Duration(c.options.KeepAlive*int64(time.Second)) || now.Sub(lastReceived) >= time.Duration(c.options.KeepAlive*int64(time.Second)) {
 				if atomic.LoadInt32(&c.pingOutstanding) == 0 {
 					DEBUG.Println(PNG, "keepalive sending ping")
 					ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
@@ -55,11 +58,11 @@ func keepalive(c *client) {
 					//will block until it it able to send the packet.
 					atomic.StoreInt32(&c.pingOutstanding, 1)
 					ping.Write(c.conn)
-					c.lastSent.Store(time.Now())
-					pingSent = time.Now()
+					c.lastSent.Store(now)
+					pingSent = now
 				}
 			}
-			if atomic.LoadInt32(&c.pingOutstanding) > 0 && time.Since(pingSent) >= c.options.PingTimeout {
+			if atomic.LoadInt32(&c.pingOutstanding) > 0 && now.Sub(pingSent) >= c.options.PingTimeout {
 				CRITICAL.Println(PNG, "pingresp not received, disconnecting")
 				c.errors <- errors.New("pingresp not received, disconnecting")
 				return
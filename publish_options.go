@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// Payload format indicators of a message, see PublishOptions.PayloadFormat.
+const (
+	PayloadFormatBytes byte = 0
+	PayloadFormatUTF8  byte = 1
+)
+
+// PublishOptions holds the MQTT 5 metadata of a message published with
+// PublishWithOptions. The options are sent as properties of the PUBLISH
+// packet only when the client is connected with MQTT 5, they are dropped
+// for older protocol versions.
+type PublishOptions struct {
+	// ContentType is the MIME type of the payload.
+	ContentType string
+	// PayloadFormat is PayloadFormatUTF8 if the payload is UTF-8 encoded
+	// text, the indicator is not sent for PayloadFormatBytes.
+	PayloadFormat byte
+	// MessageExpiry is the lifetime of the message on the server, it is
+	// sent in whole seconds rounded up. Zero means the message never
+	// expires.
+	MessageExpiry time.Duration
+	// ResponseTopic and CorrelationData are used for request/response
+	// messaging.
+	ResponseTopic   string
+	CorrelationData []byte
+	// UserProperties are sent in the given order, a key may repeat.
+	UserProperties []packets.UserProperty
+}
+
+// properties will return the PUBLISH properties for the options.
+func (o PublishOptions) properties() *packets.Properties {
+	p := &packets.Properties{
+		ContentType:     o.ContentType,
+		ResponseTopic:   o.ResponseTopic,
+		CorrelationData: o.CorrelationData,
+		User:            o.UserProperties,
+	}
+	if o.PayloadFormat != PayloadFormatBytes {
+		format := o.PayloadFormat
+		p.PayloadFormat = &format
+	}
+	if o.MessageExpiry > 0 {
+		expiry := uint32((o.MessageExpiry + time.Second - 1) / time.Second)
+		p.MessageExpiry = &expiry
+	}
+	return p
+}
@@ -0,0 +1,241 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrRequestTimeout is the error of a RequestToken when no response has
+// arrived within the timeout of the request.
+var ErrRequestTimeout = errors.New("request timed out waiting for a response")
+
+// requestEnvelope carries the response topic and correlation data of a
+// request, or the correlation data of a response, in the payload when the
+// client is not connected with MQTT 5.
+type requestEnvelope struct {
+	ResponseTopic   string `json:"response_topic,omitempty"`
+	CorrelationData []byte `json:"correlation_data"`
+	Payload         []byte `json:"payload"`
+}
+
+// RequestToken is an extension of Token returned from calls to
+// Requester.Request, it completes when the response arrives.
+type RequestToken struct {
+	baseToken
+	response Message
+}
+
+// Response returns the response to the request, nil if it has not arrived.
+// With MQTT 3.1.1 the payload of the response is taken out of its envelope.
+func (t *RequestToken) Response() Message {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.response
+}
+
+// Requester implements request/response messaging on top of a Client. The
+// requests are published with a response topic and correlation data, which
+// are MQTT 5 properties or, for older protocol versions, a JSON envelope
+// around the payload which Respond understands.
+type Requester struct {
+	c             Client
+	responseTopic string
+	qos           byte
+
+	mu         sync.Mutex
+	subscribed bool
+	prefix     string
+	next       uint64
+	pending    map[string]*pendingRequest
+}
+
+// pendingRequest is a request waiting for its response, the timer ends it
+// with ErrRequestTimeout.
+type pendingRequest struct {
+	token *RequestToken
+	timer ClockTimer
+}
+
+// NewRequester returns a Requester which receives the responses on the
+// given topic, an empty topic means "response/<client ID>". The topic is
+// subscribed to with the QoS on the first request.
+func NewRequester(c Client, responseTopic string, qos byte) *Requester {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &Requester{
+		c:             c,
+		responseTopic: responseTopic,
+		qos:           qos,
+		prefix:        hex.EncodeToString(b) + "-",
+		pending:       make(map[string]*pendingRequest),
+	}
+}
+
+// Request will publish the payload to the topic and return a token which
+// completes with the response, or with ErrRequestTimeout if none arrives
+// within the timeout, which is timed with the Clock of the client. It should
+// not be called from a message handler as it may wait for the subscription
+// to the response topic.
+func (r *Requester) Request(topic string, payload []byte, timeout time.Duration) *RequestToken {
+	token := &RequestToken{baseToken: baseToken{complete: make(chan struct{})}}
+	if err := r.subscribe(); err != nil {
+		token.setError(err)
+		return token
+	}
+
+	o := r.c.OptionsReader()
+	timer := clockOr(o.Clock()).NewTimer(timeout)
+	r.mu.Lock()
+	r.next++
+	id := r.prefix + strconv.FormatUint(r.next, 10)
+	r.pending[id] = &pendingRequest{token: token, timer: timer}
+	r.mu.Unlock()
+
+	var pt Token
+	if o.ProtocolVersion() == 5 {
+		pt = r.c.PublishWithOptions(topic, r.qos, false, payload, PublishOptions{
+			ResponseTopic:   r.responseTopic,
+			CorrelationData: []byte(id),
+		})
+	} else {
+		env, err := json.Marshal(requestEnvelope{ResponseTopic: r.responseTopic, CorrelationData: []byte(id), Payload: payload})
+		if err != nil {
+			r.complete(id, nil, err)
+			return token
+		}
+		pt = r.c.Publish(topic, r.qos, false, env)
+	}
+
+	go func() {
+		select {
+		case <-pt.Done():
+			// a failed publish completes the request right away.
+			if pt.Error() != nil {
+				r.complete(id, nil, pt.Error())
+				return
+			}
+		case <-timer.C():
+			r.complete(id, nil, ErrRequestTimeout)
+			return
+		}
+		select {
+		case <-timer.C():
+			r.complete(id, nil, ErrRequestTimeout)
+		case <-token.Done():
+		}
+	}()
+	return token
+}
+
+// subscribe will subscribe to the response topic if it is not yet done.
+func (r *Requester) subscribe() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscribed {
+		return nil
+	}
+
+	if r.responseTopic == "" {
+		o := r.c.OptionsReader()
+		r.responseTopic = "response/" + o.ClientID()
+	}
+	token := r.c.Subscribe(r.responseTopic, r.qos, r.handleResponse)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	r.subscribed = true
+	return nil
+}
+
+func (r *Requester) handleResponse(c Client, m Message) {
+	id, payload := m.CorrelationData(), m.Payload()
+	if id == nil {
+		var env requestEnvelope
+		if err := json.Unmarshal(m.Payload(), &env); err != nil {
+			WARN.Println(CLI, "dropped response without correlation data on", m.Topic())
+			return
+		}
+		id, payload = env.CorrelationData, env.Payload
+	}
+	r.complete(string(id), withPayload(m, payload), nil)
+}
+
+// complete will finish the request with the response or the error, only
+// the first call for a request has an effect.
+func (r *Requester) complete(id string, response Message, err error) {
+	r.mu.Lock()
+	pending, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	pending.timer.Stop()
+
+	token := pending.token
+
+	if err != nil {
+		token.setError(err)
+		return
+	}
+	token.m.Lock()
+	token.response = response
+	token.m.Unlock()
+	token.flowComplete()
+}
+
+// RequestHandler is a callback type which handles a request received by a
+// Respond, the returned payload is published as the response.
+type RequestHandler func(Client, Message) []byte
+
+// Respond will subscribe to the topic and answer each of the requests
+// published there by a Requester with the payload returned by the handler.
+// Requests without a response topic are passed to the handler but are not
+// answered.
+func Respond(c Client, topic string, qos byte, handler RequestHandler) Token {
+	return c.Subscribe(topic, qos, func(c Client, m Message) {
+		responseTopic, id, payload := m.ResponseTopic(), m.CorrelationData(), m.Payload()
+		envelope := responseTopic == ""
+		if envelope {
+			var env requestEnvelope
+			if err := json.Unmarshal(m.Payload(), &env); err == nil {
+				responseTopic, id, payload = env.ResponseTopic, env.CorrelationData, env.Payload
+			}
+		}
+
+		response := handler(c, withPayload(m, payload))
+		if responseTopic == "" {
+			return
+		}
+		if !envelope {
+			c.PublishWithOptions(responseTopic, qos, false, response, PublishOptions{CorrelationData: id})
+			return
+		}
+		env, err := json.Marshal(requestEnvelope{CorrelationData: id, Payload: response})
+		if err != nil {
+			ERROR.Println(CLI, "failed to encode response", err)
+			return
+		}
+		c.Publish(responseTopic, qos, false, env)
+	})
+}
+
+// withPayload will return a copy of the message with another payload, used
+// for the messages taken out of their envelope.
+func withPayload(m Message, payload []byte) Message {
+	return &message{
+		duplicate:  m.Duplicate(),
+		qos:        m.Qos(),
+		retained:   m.Retained(),
+		topic:      m.Topic(),
+		messageID:  m.MessageID(),
+		payload:    payload,
+		properties: m.Properties(),
+		ack:        m.Ack,
+	}
+}
@@ -19,7 +19,7 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 // route is a type which associates MQTT Topic strings with a
@@ -27,6 +27,7 @@ import (
 // with a subscription to that topic.
 type route struct {
 	topic    string
+	subID    int
 	callback MessageHandler
 }
 
@@ -76,6 +77,28 @@ func (r *route) match(topic string) bool {
 	return r.topic == topic || routeIncludesTopic(r.topic, topic)
 }
 
+// matchMessage will match the message by its subscription identifiers if
+// both the route and the message have them, and by the topic otherwise. A
+// route without an identifier cannot tell which subscription a message was
+// sent for, so it always matches by the topic.
+func (r *route) matchMessage(p *packets.PublishPacket) bool {
+	return r.matchProperties(p.TopicName, p.Properties)
+}
+
+// matchProperties has the same logic as matchMessage for a topic and the
+// properties of a message.
+func (r *route) matchProperties(topic string, props *packets.Properties) bool {
+	if r.subID != 0 && props != nil && len(props.SubscriptionIdentifier) > 0 {
+		for _, id := range props.SubscriptionIdentifier {
+			if id == r.subID {
+				return true
+			}
+		}
+		return false
+	}
+	return r.match(topic)
+}
+
 type router struct {
 	sync.RWMutex
 	routes         *list.List
@@ -104,16 +127,48 @@ func newRouter() (*router, chan bool) {
 // routes to see if there is already a matching Route. If there is it replaces the current
 // callback with the new one. If not it add a new entry to the list of Routes.
 func (r *router) addRoute(topic string, callback MessageHandler) {
+	r.addRouteWithID(topic, 0, callback)
+}
+
+// addRouteWithID has the same logic as addRoute, the route also matches
+// the messages carrying the MQTT 5 subscription identifier, 0 means none.
+func (r *router) addRouteWithID(topic string, subID int, callback MessageHandler) {
+	r.putRoute(topic, subID, callback)
+}
+
+// putRoute has the same logic as addRouteWithID, it returns the route which
+// was added and the route it replaced, nil if there was none.
+func (r *router) putRoute(topic string, subID int, callback MessageHandler) (added, replaced *route) {
 	r.Lock()
 	defer r.Unlock()
+	added = &route{topic: topic, subID: subID, callback: callback}
 	for e := r.routes.Front(); e != nil; e = e.Next() {
 		if e.Value.(*route).topic == topic {
-			r := e.Value.(*route)
-			r.callback = callback
+			replaced = e.Value.(*route)
+			e.Value = added
+			return added, replaced
+		}
+	}
+	r.routes.PushBack(added)
+	return added, nil
+}
+
+// undoRoute will put back the route replaced by putRoute, or delete the
+// added route if none was replaced. Nothing is done if the added route has
+// been replaced or deleted since.
+func (r *router) undoRoute(added, replaced *route) {
+	r.Lock()
+	defer r.Unlock()
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value == added {
+			if replaced != nil {
+				e.Value = replaced
+			} else {
+				r.routes.Remove(e)
+			}
 			return
 		}
 	}
-	r.routes.PushBack(&route{topic: topic, callback: callback})
 }
 
 // addHermesRoute has the same logic as addRoute, however, this is used
@@ -183,8 +238,12 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 			select {
 			case message := <-messages:
 				sent := false
+				// the ack is queued before the routes are locked, it waits
+				// while too many messages are not acknowledged.
+				ack := client.ackFunc(message)
+				autoAck := client.acks == nil
 				r.RLock()
-				m := messageFromPublish(message, client.ackFunc(message))
+				m := messageFromPublish(message, ack)
 
 				for e := r.hermesRoutes.Front(); e != nil; e = e.Next() {
 					if e.Value.(*route).match(message.TopicName) {
@@ -200,14 +259,16 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 				handlers := []MessageHandler{}
 				if !sent {
 					for e := r.routes.Front(); e != nil; e = e.Next() {
-						if e.Value.(*route).match(message.TopicName) {
+						if e.Value.(*route).matchMessage(message) {
 							if order {
 								handlers = append(handlers, e.Value.(*route).callback)
 							} else {
 								hd := e.Value.(*route).callback
 								go func() {
 									hd(client, m)
-									m.Ack()
+									if autoAck {
+										m.Ack()
+									}
 								}()
 							}
 							sent = true
@@ -220,15 +281,25 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 					} else {
 						go func() {
 							r.defaultHandler(client, m)
-							m.Ack()
+							if autoAck {
+								m.Ack()
+							}
 						}()
 					}
 				}
+				// a message no handler receives is acknowledged as no one
+				// else would, the later acknowledgements wait for it.
+				unhandled := !sent && r.defaultHandler == nil
 				r.RUnlock()
+				if unhandled && !autoAck {
+					m.Ack()
+				}
 				for _, handler := range handlers {
 					func() {
 						handler(client, m)
-						m.Ack()
+						if autoAck {
+							m.Ack()
+						}
 					}()
 				}
 			case <-r.stop:
@@ -237,3 +308,73 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 		}
 	}()
 }
+
+// Router dispatches messages to the handlers of the routes which match
+// them, with the same rules as the router of a client. It lets test doubles
+// such as the fake Client of the mqtttest package route the messages they
+// are given as a client would.
+type Router struct {
+	r         *router
+	manualAck bool
+}
+
+// NewRouter returns a Router without any routes.
+func NewRouter() *Router {
+	r, _ := newRouter()
+	return &Router{r: r}
+}
+
+// SetAutoAck sets whether Dispatch acknowledges the messages after each
+// handler, as with the AutoAck option of a client. It is true by default.
+func (r *Router) SetAutoAck(autoAck bool) {
+	r.manualAck = !autoAck
+}
+
+// AddRoute adds the handler for the messages matching the topic filter,
+// replacing the handler of the filter if it had one.
+func (r *Router) AddRoute(topic string, callback MessageHandler) {
+	r.r.addRoute(topic, callback)
+}
+
+// AddRouteWithID adds the handler like AddRoute, the route also matches
+// the messages carrying the MQTT 5 subscription identifier.
+func (r *Router) AddRouteWithID(topic string, subID int, callback MessageHandler) {
+	r.r.addRouteWithID(topic, subID, callback)
+}
+
+// DeleteRoute removes the route of the topic filter.
+func (r *Router) DeleteRoute(topic string) {
+	r.r.deleteRoute(topic)
+}
+
+// SetDefaultHandler sets the handler of the messages no route matches.
+func (r *Router) SetDefaultHandler(handler MessageHandler) {
+	r.r.setDefaultHandler(handler)
+}
+
+// Dispatch will call the handlers of the routes matching the message in the
+// order the routes were added, or the default handler if none matches, and
+// acknowledge the message after each of them unless AutoAck is disabled.
+// The handlers are called on the calling goroutine, false is returned if
+// none was called.
+func (r *Router) Dispatch(client Client, m Message) bool {
+	var handlers []MessageHandler
+	r.r.RLock()
+	for e := r.r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).matchProperties(m.Topic(), m.Properties()) {
+			handlers = append(handlers, e.Value.(*route).callback)
+		}
+	}
+	if len(handlers) == 0 && r.r.defaultHandler != nil {
+		handlers = append(handlers, r.r.defaultHandler)
+	}
+	r.r.RUnlock()
+
+	for _, handler := range handlers {
+		handler(client, m)
+		if !r.manualAck {
+			m.Ack()
+		}
+	}
+	return len(handlers) > 0
+}
@@ -0,0 +1,153 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// scram implements the client side of the SCRAM authentication methods
+// (RFC 5802 and RFC 7677) as an Authenticator. Channel binding is not
+// supported and the password is used as given, without SASLprep.
+type scram struct {
+	method   string
+	hash     func() hash.Hash
+	username string
+	password string
+
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// NewScramSHA256 returns an Authenticator for the SCRAM-SHA-256 method.
+func NewScramSHA256(username, password string) Authenticator {
+	return &scram{method: "SCRAM-SHA-256", hash: sha256.New, username: username, password: password}
+}
+
+// NewScramSHA512 returns an Authenticator for the SCRAM-SHA-512 method.
+func NewScramSHA512(username, password string) Authenticator {
+	return &scram{method: "SCRAM-SHA-512", hash: sha512.New, username: username, password: password}
+}
+
+func (s *scram) Method() string {
+	return s.method
+}
+
+// Start returns the client-first-message.
+func (s *scram) Start() ([]byte, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s.nonce = base64.RawStdEncoding.EncodeToString(b)
+	s.clientFirstBare = "n=" + scramEscape(s.username) + ",r=" + s.nonce
+	s.serverSignature = nil
+	return []byte("n,," + s.clientFirstBare), nil
+}
+
+// Continue returns the client-final-message for the server-first-message.
+func (s *scram) Continue(challenge []byte) ([]byte, error) {
+	if s.clientFirstBare == "" || s.serverSignature != nil {
+		return nil, errors.New("scram: unexpected challenge")
+	}
+
+	attrs := scramAttributes(string(challenge))
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("scram: invalid salt: %s", err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("scram: invalid iteration count")
+	}
+
+	saltedPassword := scramHi(s.hash, []byte(s.password), salt, iterations)
+	clientKey := scramHMAC(s.hash, saltedPassword, []byte("Client Key"))
+	h := s.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := []byte(s.clientFirstBare + "," + string(challenge) + "," + clientFinal)
+
+	proof := scramHMAC(s.hash, storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverKey := scramHMAC(s.hash, saltedPassword, []byte("Server Key"))
+	s.serverSignature = scramHMAC(s.hash, serverKey, authMessage)
+
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Complete verifies the server signature of the server-final-message.
+func (s *scram) Complete(data []byte) error {
+	if s.serverSignature == nil {
+		return errors.New("scram: authentication was not completed")
+	}
+
+	attrs := scramAttributes(string(data))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("scram: server error: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(signature, s.serverSignature) {
+		return errors.New("scram: invalid server signature")
+	}
+	return nil
+}
+
+// scramAttributes will split a SCRAM message into its attributes.
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) > 1 && a[1] == '=' {
+			attrs[a[:1]] = a[2:]
+		}
+	}
+	return attrs
+}
+
+// scramEscape will escape the characters of a username which have a
+// special meaning in a SCRAM message.
+func scramEscape(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func scramHMAC(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramHi is the Hi function of RFC 5802, which is PBKDF2 with the output
+// length of the hash.
+func scramHi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	var block bytes.Buffer
+	block.Write(salt)
+	binary.Write(&block, binary.BigEndian, uint32(1))
+
+	u := scramHMAC(h, password, block.Bytes())
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = scramHMAC(h, password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
@@ -0,0 +1,323 @@
+package mqtt
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// ServerSelector chooses the order in which the servers are tried by an
+// attempt to connect or reconnect, and learns from the outcome of each.
+type ServerSelector interface {
+	// Order returns the servers to try, in order, for an attempt
+	Order(servers []*url.URL) []*url.URL
+	// Result is called with the outcome of connecting to a server, err is
+	// nil if the connection was accepted
+	Result(server *url.URL, err error)
+}
+
+// Defaults of the circuit breaker of a HealthTracker.
+const (
+	DefaultBreakerThreshold = 3
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// ServerHealth is the health of a server as tracked by a HealthTracker.
+type ServerHealth struct {
+	// Score is an average of the recent outcomes, from 0 when all have
+	// failed to 1 when all have succeeded
+	Score float64
+	// Failures is the number of consecutive failed attempts
+	Failures int
+	// OpenUntil is the time until which the circuit breaker is open, the
+	// server is then tried only after the servers which are available
+	OpenUntil time.Time
+}
+
+// HealthTracker keeps the health of the servers from the outcomes of the
+// attempts to connect to them. After threshold consecutive failures the
+// circuit breaker of the server opens for the cooldown. The breakers of the
+// tracker of a built-in selector are timed with the Clock of the client, so
+// a tracker must not be shared by clients with different Clocks.
+type HealthTracker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	servers   map[string]*ServerHealth
+	clock     Clock
+}
+
+// NewHealthTracker returns a HealthTracker with the given circuit breaker,
+// a threshold of 0 disables the breaker.
+func NewHealthTracker(threshold int, cooldown time.Duration) *HealthTracker {
+	return &HealthTracker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		servers:   make(map[string]*ServerHealth),
+	}
+}
+
+func (h *HealthTracker) get(server *url.URL) *ServerHealth {
+	s, ok := h.servers[server.String()]
+	if !ok {
+		s = &ServerHealth{Score: 1}
+		h.servers[server.String()] = s
+	}
+	return s
+}
+
+// Result will record the outcome of an attempt to connect to the server.
+func (h *HealthTracker) Result(server *url.URL, err error) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(server)
+	if err == nil {
+		s.Score = 0.8*s.Score + 0.2
+		s.Failures = 0
+		s.OpenUntil = time.Time{}
+		return
+	}
+	s.Score = 0.8 * s.Score
+	s.Failures++
+	if h.threshold > 0 && s.Failures >= h.threshold {
+		s.OpenUntil = clockOr(h.clock).Now().Add(h.cooldown)
+	}
+}
+
+// Health returns the health of the server.
+func (h *HealthTracker) Health(server *url.URL) ServerHealth {
+	h.Lock()
+	defer h.Unlock()
+	return *h.get(server)
+}
+
+// Available returns false if the circuit breaker of the server is open.
+func (h *HealthTracker) Available(server *url.URL) bool {
+	h.Lock()
+	defer h.Unlock()
+	return !clockOr(h.clock).Now().Before(h.get(server).OpenUntil)
+}
+
+// setClock sets the Clock the breakers are timed with, a tracker shared by
+// several clients keeps the Clock of the first one.
+func (h *HealthTracker) setClock(c Clock) {
+	h.Lock()
+	defer h.Unlock()
+	if h.clock == nil {
+		h.clock = c
+	}
+}
+
+// healthFirst returns the servers with the available ones first, keeping
+// their order otherwise. The unavailable servers are still tried so the
+// client connects even if all of the breakers are open.
+func (h *HealthTracker) healthFirst(servers []*url.URL) []*url.URL {
+	ordered := make([]*url.URL, 0, len(servers))
+	var open []*url.URL
+	for _, s := range servers {
+		if h.Available(s) {
+			ordered = append(ordered, s)
+		} else {
+			open = append(open, s)
+		}
+	}
+	return append(ordered, open...)
+}
+
+// selector holds the health tracking shared by the built-in selectors.
+type selector struct {
+	health *HealthTracker
+}
+
+func newSelector(h *HealthTracker) selector {
+	if h == nil {
+		h = NewHealthTracker(DefaultBreakerThreshold, DefaultBreakerCooldown)
+	}
+	return selector{health: h}
+}
+
+func (s *selector) Result(server *url.URL, err error) {
+	s.health.Result(server, err)
+}
+
+func (s *selector) setClock(c Clock) {
+	s.health.setClock(c)
+}
+
+// clockSetter is implemented by the built-in selectors, which are given
+// the Clock of the client.
+type clockSetter interface {
+	setClock(c Clock)
+}
+
+type stickySelector struct {
+	selector
+	mu   sync.Mutex
+	last string
+}
+
+// NewStickySelector returns a ServerSelector which tries the server of the
+// last accepted connection first, then the others in order. A nil tracker
+// means one with the default circuit breaker.
+func NewStickySelector(h *HealthTracker) ServerSelector {
+	return &stickySelector{selector: newSelector(h)}
+}
+
+func (s *stickySelector) Order(servers []*url.URL) []*url.URL {
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+	ordered := make([]*url.URL, 0, len(servers))
+	for _, u := range servers {
+		if u.String() == last {
+			ordered = append(ordered, u)
+		}
+	}
+	for _, u := range servers {
+		if u.String() != last {
+			ordered = append(ordered, u)
+		}
+	}
+	return s.health.healthFirst(ordered)
+}
+
+func (s *stickySelector) Result(server *url.URL, err error) {
+	s.selector.Result(server, err)
+	if err == nil {
+		s.mu.Lock()
+		s.last = server.String()
+		s.mu.Unlock()
+	}
+}
+
+type roundRobinSelector struct {
+	selector
+	mu   sync.Mutex
+	next int
+}
+
+// NewRoundRobinSelector returns a ServerSelector which starts each attempt
+// with the server after the one the previous attempt started with. A nil
+// tracker means one with the default circuit breaker.
+func NewRoundRobinSelector(h *HealthTracker) ServerSelector {
+	return &roundRobinSelector{selector: newSelector(h)}
+}
+
+func (s *roundRobinSelector) Order(servers []*url.URL) []*url.URL {
+	if len(servers) == 0 {
+		return servers
+	}
+	s.mu.Lock()
+	start := s.next % len(servers)
+	s.next = start + 1
+	s.mu.Unlock()
+	ordered := append(append([]*url.URL{}, servers[start:]...), servers[:start]...)
+	return s.health.healthFirst(ordered)
+}
+
+type randomSelector struct {
+	selector
+	rand *lockedRand
+}
+
+// NewRandomSelector returns a ServerSelector which tries the servers in a
+// random order. A nil tracker means one with the default circuit breaker.
+func NewRandomSelector(h *HealthTracker) ServerSelector {
+	return &randomSelector{selector: newSelector(h), rand: newLockedRand()}
+}
+
+func (s *randomSelector) Order(servers []*url.URL) []*url.URL {
+	ordered := make([]*url.URL, len(servers))
+	for i, j := range s.rand.perm(len(servers)) {
+		ordered[i] = servers[j]
+	}
+	return s.health.healthFirst(ordered)
+}
+
+type weightedSelector struct {
+	selector
+	weights map[string]int
+	rand    *lockedRand
+}
+
+// NewWeightedSelector returns a ServerSelector which tries the servers in
+// a random order where a server is first in proportion to its weight. The
+// weights are keyed by the URL of the server, a missing weight is 1 and a
+// weight below 1 puts the server last. A nil tracker means one with the
+// default circuit breaker.
+func NewWeightedSelector(weights map[string]int, h *HealthTracker) ServerSelector {
+	return &weightedSelector{selector: newSelector(h), weights: weights, rand: newLockedRand()}
+}
+
+func (s *weightedSelector) Order(servers []*url.URL) []*url.URL {
+	remaining := append([]*url.URL{}, servers...)
+	ordered := make([]*url.URL, 0, len(servers))
+	for len(remaining) > 0 {
+		total := 0
+		for _, u := range remaining {
+			total += s.weight(u)
+		}
+		i := 0
+		if total > 0 {
+			for n := s.rand.intn(total); n >= s.weight(remaining[i]); i++ {
+				n -= s.weight(remaining[i])
+			}
+		}
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return s.health.healthFirst(ordered)
+}
+
+func (s *weightedSelector) weight(u *url.URL) int {
+	w, ok := s.weights[u.String()]
+	if !ok {
+		return 1
+	}
+	if w < 0 {
+		return 0
+	}
+	return w
+}
+
+type prioritySelector struct {
+	selector
+}
+
+// NewPrioritySelector returns a ServerSelector which tries the servers in
+// the order they were added, skipping past the ones with an open circuit
+// breaker. It fails back to a server of a higher priority once its breaker
+// closes, on the next attempt to connect. A nil tracker means one with the
+// default circuit breaker.
+func NewPrioritySelector(h *HealthTracker) ServerSelector {
+	return &prioritySelector{selector: newSelector(h)}
+}
+
+func (s *prioritySelector) Order(servers []*url.URL) []*url.URL {
+	return s.health.healthFirst(servers)
+}
+
+// orderServers returns the servers to try for an attempt to connect.
+func (c *client) orderServers(servers []*url.URL) []*url.URL {
+	if c.options.ServerSelector == nil {
+		return servers
+	}
+	return c.options.ServerSelector.Order(servers)
+}
+
+// serverResult will pass the outcome of connecting to the server to the
+// selector.
+func (c *client) serverResult(server *url.URL, rc byte, err error) {
+	if c.options.ServerSelector == nil {
+		return
+	}
+	c.options.ServerSelector.Result(server, err)
+}
+
+// versionRefused returns whether the server refused the protocol version
+// of the client.
+func versionRefused(rc byte) bool {
+	return rc == packets.ErrRefusedBadProtocolVersion || rc == packets.ReasonUnsupportedProtocolVersion
+}
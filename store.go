@@ -18,7 +18,7 @@ import (
 	"fmt"
 	"strconv"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 const (
@@ -110,7 +110,7 @@ func persistInbound(s Store, m packets.ControlPacket) {
 			// Received a puback. delete matching publish
 			// from obound
 			s.Del(outboundKeyFromMID(m.Details().MessageID))
-		case *packets.PublishPacket, *packets.PubrecPacket, *packets.PingrespPacket, *packets.ConnackPacket:
+		case *packets.PublishPacket, *packets.PubrecPacket, *packets.PingrespPacket, *packets.ConnackPacket, *packets.DisconnectPacket, *packets.AuthPacket:
 		default:
 			ERROR.Println(STR, "Asked to persist an invalid messages type")
 		}
@@ -0,0 +1,62 @@
+package mqtt
+
+import (
+	"errors"
+)
+
+// Retain handling values of SubscribeOptions, they control whether the
+// server sends the retained messages when the subscription is made.
+const (
+	RetainHandlingSend      byte = 0
+	RetainHandlingSendIfNew byte = 1
+	RetainHandlingDoNotSend byte = 2
+)
+
+// maxSubscriptionIdentifier is the largest value of a variable byte integer.
+const maxSubscriptionIdentifier = 268435455
+
+// ErrInvalidSubscribeOptions is the error returned when the retain handling
+// or the subscription identifier of SubscribeOptions is out of range.
+var ErrInvalidSubscribeOptions = errors.New("Invalid subscribe options")
+
+// SubscribeOptions holds the options of a subscription made with
+// SubscribeWithOptions. All but the QoS are MQTT 5 subscription options,
+// they are dropped when connected with an older protocol version.
+type SubscribeOptions struct {
+	QoS byte
+	// NoLocal stops the server from sending the messages published by this
+	// client back to it.
+	NoLocal bool
+	// RetainAsPublished keeps the retain flag of the messages as it was set
+	// by the publisher.
+	RetainAsPublished bool
+	// RetainHandling is one of the RetainHandling values.
+	RetainHandling byte
+	// SubscriptionIdentifier is sent back by the server with each message
+	// matching the subscription. Such a message is routed to the callbacks
+	// of the subscriptions with one of its identifiers, and to those of the
+	// subscriptions without an identifier which match its topic. It must be
+	// unique per subscription, zero means no identifier.
+	SubscriptionIdentifier int
+}
+
+// options will return the subscription options byte sent in the SUBSCRIBE
+// packet.
+func (o SubscribeOptions) options() byte {
+	b := o.QoS | o.RetainHandling<<4
+	if o.NoLocal {
+		b |= 0x04
+	}
+	if o.RetainAsPublished {
+		b |= 0x08
+	}
+	return b
+}
+
+func (o SubscribeOptions) validate() error {
+	if o.RetainHandling > RetainHandlingDoNotSend || o.SubscriptionIdentifier < 0 ||
+		o.SubscriptionIdentifier > maxSubscriptionIdentifier {
+		return ErrInvalidSubscribeOptions
+	}
+	return nil
+}
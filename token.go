@@ -13,10 +13,12 @@
 package mqtt
 
 import (
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 // PacketAndToken is a struct that contains both a ControlPacket and a
@@ -33,6 +35,9 @@ type PacketAndToken struct {
 type Token interface {
 	Wait() bool
 	WaitTimeout(time.Duration) bool
+	// Done returns a channel which is closed when the flow associated
+	// with the Token completes, for use in a select statement
+	Done() <-chan struct{}
 	Error() error
 }
 
@@ -50,6 +55,26 @@ type baseToken struct {
 	m        sync.RWMutex
 	complete chan struct{}
 	err      error
+	timing   TokenTiming
+	clock    Clock
+}
+
+// TokenTiming holds the times at which the message of a Token went through
+// the client, a zero time means the step has not happened (yet).
+type TokenTiming struct {
+	// Enqueued is the time the call was made
+	Enqueued time.Time
+	// Written is the time the packet was written to the connection
+	Written time.Time
+	// Acked is the time the acknowledgement was received, it stays zero
+	// for QoS 0 publishes as they are not acknowledged
+	Acked time.Time
+}
+
+// timedToken is implemented by the tokens which record their timing.
+type timedToken interface {
+	stampWritten()
+	stampAcked()
 }
 
 // Wait will wait indefinitely for the Token to complete, ie the Publish
@@ -64,19 +89,25 @@ func (b *baseToken) Wait() bool {
 // returns false if the timeout occurred. In the case of a timeout the Token
 // does not have an error set in case the caller wishes to wait again
 func (b *baseToken) WaitTimeout(d time.Duration) bool {
-	timer := time.NewTimer(d)
+	timer := clockOr(b.clock).NewTimer(d)
 	select {
 	case <-b.complete:
 		if !timer.Stop() {
-			<-timer.C
+			<-timer.C()
 		}
 		return true
-	case <-timer.C:
+	case <-timer.C():
 	}
 
 	return false
 }
 
+// Done returns a channel which is closed when the flow associated with
+// the Token completes
+func (b *baseToken) Done() <-chan struct{} {
+	return b.complete
+}
+
 func (b *baseToken) flowComplete() {
 	select {
 	case <-b.complete:
@@ -98,18 +129,53 @@ func (b *baseToken) setError(e error) {
 	b.m.Unlock()
 }
 
+func (b *baseToken) stampWritten() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.timing.Written = clockOr(b.clock).Now()
+}
+
+func (b *baseToken) stampAcked() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.timing.Acked = clockOr(b.clock).Now()
+}
+
+func (b *baseToken) getTiming() TokenTiming {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.timing
+}
+
 func newToken(tType byte) tokenCompletor {
+	return newClockToken(tType, nil)
+}
+
+func (b *baseToken) tokenClock() Clock {
+	return clockOr(b.clock)
+}
+
+// newClockToken returns a token whose timeout and timing use the clock, a
+// nil clock is the SystemClock.
+func newClockToken(tType byte, clock Clock) tokenCompletor {
+	clock = clockOr(clock)
 	switch tType {
 	case packets.Connect:
-		return &ConnectToken{baseToken: baseToken{complete: make(chan struct{})}}
+		return &ConnectToken{baseToken: baseToken{complete: make(chan struct{}), clock: clock}}
 	case packets.Subscribe:
-		return &SubscribeToken{baseToken: baseToken{complete: make(chan struct{})}, subResult: make(map[string]byte)}
+		t := &SubscribeToken{baseToken: baseToken{complete: make(chan struct{}), clock: clock}, subResult: make(map[string]byte)}
+		t.timing.Enqueued = clock.Now()
+		return t
 	case packets.Publish:
-		return &PublishToken{baseToken: baseToken{complete: make(chan struct{})}}
+		t := &PublishToken{baseToken: baseToken{complete: make(chan struct{}), clock: clock}}
+		t.timing.Enqueued = clock.Now()
+		return t
 	case packets.Unsubscribe:
-		return &UnsubscribeToken{baseToken: baseToken{complete: make(chan struct{})}}
+		return &UnsubscribeToken{baseToken: baseToken{complete: make(chan struct{}), clock: clock}}
 	case packets.Disconnect:
-		return &DisconnectToken{baseToken: baseToken{complete: make(chan struct{})}}
+		return &DisconnectToken{baseToken: baseToken{complete: make(chan struct{}), clock: clock}}
+	case packets.Auth:
+		return &AuthToken{baseToken: baseToken{complete: make(chan struct{}), clock: clock}}
 	}
 	return nil
 }
@@ -120,6 +186,7 @@ type ConnectToken struct {
 	baseToken
 	returnCode     byte
 	sessionPresent bool
+	properties     *packets.Properties
 }
 
 // ReturnCode returns the acknowledgement code in the connack sent
@@ -138,11 +205,21 @@ func (c *ConnectToken) SessionPresent() bool {
 	return c.sessionPresent
 }
 
+// Properties returns the properties of the connack sent in response to a
+// Connect(), it is nil unless the client has connected with MQTT 5
+func (c *ConnectToken) Properties() *packets.Properties {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.properties
+}
+
 // PublishToken is an extension of Token containing the extra fields
 // required to provide information about calls to Publish()
 type PublishToken struct {
 	baseToken
-	messageID uint16
+	messageID  uint16
+	reasonCode byte
+	properties *packets.Properties
 }
 
 // MessageID returns the MQTT message ID that was assigned to the
@@ -151,13 +228,44 @@ func (p *PublishToken) MessageID() uint16 {
 	return p.messageID
 }
 
+// ReasonCode returns the reason code of the acknowledgement sent by an
+// MQTT 5 broker in response to a Publish() with QoS > 0
+func (p *PublishToken) ReasonCode() byte {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.reasonCode
+}
+
+// Properties returns the properties of the acknowledgement sent by an
+// MQTT 5 broker in response to a Publish() with QoS > 0
+func (p *PublishToken) Properties() *packets.Properties {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.properties
+}
+
+// Timing returns the times at which the Publish() was enqueued, written to
+// the connection and acknowledged by the broker
+func (p *PublishToken) Timing() TokenTiming {
+	return p.getTiming()
+}
+
+// setAck will store the reason code and properties of an acknowledgement.
+func (p *PublishToken) setAck(reasonCode byte, properties *packets.Properties) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.reasonCode = reasonCode
+	p.properties = properties
+}
+
 // SubscribeToken is an extension of Token containing the extra fields
 // required to provide information about calls to Subscribe()
 type SubscribeToken struct {
 	baseToken
-	subs      []string
-	subResult map[string]byte
-	messageID uint16
+	subs       []string
+	subResult  map[string]byte
+	messageID  uint16
+	properties *packets.Properties
 }
 
 // Result returns a map of topics that were subscribed to along with
@@ -169,11 +277,43 @@ func (s *SubscribeToken) Result() map[string]byte {
 	return s.subResult
 }
 
+// Properties returns the properties of the suback sent by an MQTT 5 broker
+// in response to a Subscribe()
+func (s *SubscribeToken) Properties() *packets.Properties {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.properties
+}
+
+// Timing returns the times at which the Subscribe() was enqueued, written
+// to the connection and acknowledged by the broker
+func (s *SubscribeToken) Timing() TokenTiming {
+	return s.getTiming()
+}
+
 // UnsubscribeToken is an extension of Token containing the extra fields
 // required to provide information about calls to Unsubscribe()
 type UnsubscribeToken struct {
 	baseToken
-	messageID uint16
+	messageID   uint16
+	reasonCodes []byte
+	properties  *packets.Properties
+}
+
+// ReasonCodes returns the reason codes sent by an MQTT 5 broker for each of
+// the topics in an Unsubscribe(), in the same order as the topics
+func (u *UnsubscribeToken) ReasonCodes() []byte {
+	u.m.RLock()
+	defer u.m.RUnlock()
+	return u.reasonCodes
+}
+
+// Properties returns the properties of the unsuback sent by an MQTT 5
+// broker in response to an Unsubscribe()
+func (u *UnsubscribeToken) Properties() *packets.Properties {
+	u.m.RLock()
+	defer u.m.RUnlock()
+	return u.properties
 }
 
 // DisconnectToken is an extension of Token containing the extra fields
@@ -181,3 +321,92 @@ type UnsubscribeToken struct {
 type DisconnectToken struct {
 	baseToken
 }
+
+// AuthToken is an extension of Token returned from calls to
+// Reauthenticate(), it completes when the exchange with the server is
+// finished.
+type AuthToken struct {
+	baseToken
+}
+
+// TokenErrors is the error returned by WaitAll and WaitAllTimeout when some
+// of the tokens have failed, it holds the errors in the order of the tokens.
+type TokenErrors []error
+
+func (e TokenErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// WaitAll will wait for all of the tokens to complete, the errors of the
+// failed tokens are returned as TokenErrors, nil if none failed.
+func WaitAll(tokens ...Token) error {
+	for _, t := range tokens {
+		<-t.Done()
+	}
+	return tokenErrors(tokens)
+}
+
+// WaitAllTimeout will wait at most the duration for all of the tokens to
+// complete, it returns false if the timeout occurred. The errors of the
+// tokens which have completed and failed are returned as TokenErrors. The
+// timeout uses the Clock of the client of the tokens.
+func WaitAllTimeout(d time.Duration, tokens ...Token) (bool, error) {
+	timer := tokensClock(tokens).NewTimer(d)
+	defer timer.Stop()
+	for _, t := range tokens {
+		select {
+		case <-t.Done():
+		case <-timer.C():
+			return false, tokenErrors(tokens)
+		}
+	}
+	return true, tokenErrors(tokens)
+}
+
+// tokensClock returns the Clock of the first of the tokens which has one,
+// the SystemClock otherwise.
+func tokensClock(tokens []Token) Clock {
+	for _, t := range tokens {
+		if ct, ok := t.(interface{ tokenClock() Clock }); ok {
+			return ct.tokenClock()
+		}
+	}
+	return SystemClock
+}
+
+// WaitAny will wait for any of the tokens to complete and return its index,
+// -1 is returned if there are no tokens.
+func WaitAny(tokens ...Token) int {
+	if len(tokens) == 0 {
+		return -1
+	}
+	cases := make([]reflect.SelectCase, len(tokens))
+	for i, t := range tokens {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.Done())}
+	}
+	i, _, _ := reflect.Select(cases)
+	return i
+}
+
+// tokenErrors returns the errors of the completed tokens, nil if none of
+// them failed.
+func tokenErrors(tokens []Token) error {
+	var errs TokenErrors
+	for _, t := range tokens {
+		select {
+		case <-t.Done():
+			if err := t.Error(); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// topicAliases holds the MQTT 5 topic aliases of a single connection.
+// Outbound aliases are assigned to the most recently used topics, the least
+// recently used alias is reassigned once all of the aliases allowed by the
+// server are in use. Inbound aliases are assigned by the server.
+type topicAliases struct {
+	sync.Mutex
+	outMax uint16
+	out    map[string]*list.Element
+	lru    *list.List
+	inMax  uint16
+	in     map[uint16]string
+}
+
+type outboundAlias struct {
+	topic string
+	alias uint16
+}
+
+// newTopicAliases will create the topic aliases for a connection, the
+// outbound maximum is taken from the CONNACK properties.
+func newTopicAliases(connack *packets.Properties, inMax uint16) *topicAliases {
+	a := &topicAliases{
+		out:   make(map[string]*list.Element),
+		lru:   list.New(),
+		inMax: inMax,
+		in:    make(map[uint16]string),
+	}
+	if connack != nil && connack.TopicAliasMaximum != nil {
+		a.outMax = *connack.TopicAliasMaximum
+	}
+	return a
+}
+
+// outbound will return the packet to be written for the publish. When an
+// alias is used a copy of the packet is returned, so that the stored packet
+// keeps its topic for a resend after a reconnect.
+func (a *topicAliases) outbound(p *packets.PublishPacket) *packets.PublishPacket {
+	if a == nil || a.outMax == 0 || p.TopicName == "" || p.Properties == nil {
+		return p
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	cp := *p
+	cp.Properties = p.Properties.Copy()
+	if e, ok := a.out[p.TopicName]; ok {
+		// the server knows the alias, the topic can be omitted.
+		a.lru.MoveToFront(e)
+		alias := e.Value.(*outboundAlias).alias
+		cp.TopicName = ""
+		cp.Properties.TopicAlias = &alias
+		return &cp
+	}
+
+	var entry *outboundAlias
+	if a.lru.Len() < int(a.outMax) {
+		entry = &outboundAlias{alias: uint16(a.lru.Len() + 1)}
+	} else {
+		e := a.lru.Back()
+		entry = a.lru.Remove(e).(*outboundAlias)
+		delete(a.out, entry.topic)
+	}
+	entry.topic = p.TopicName
+	a.out[p.TopicName] = a.lru.PushFront(entry)
+
+	// sending both the topic and the alias sets the alias on the server.
+	alias := entry.alias
+	cp.Properties.TopicAlias = &alias
+	return &cp
+}
+
+// inbound will set the topic of a publish received with a topic alias. An
+// error with the Topic Alias invalid reason code is returned if the alias is
+// out of range or was not set by the server, the connection is then closed
+// with it.
+func (a *topicAliases) inbound(p *packets.PublishPacket) error {
+	if p.Properties == nil || p.Properties.TopicAlias == nil {
+		return nil
+	}
+
+	alias := *p.Properties.TopicAlias
+	if a == nil || alias == 0 || alias > a.inMax {
+		return &packets.ReasonCodeError{Code: packets.ReasonTopicAliasInvalid}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if p.TopicName != "" {
+		a.in[alias] = p.TopicName
+		return nil
+	}
+	topic, ok := a.in[alias]
+	if !ok {
+		return &packets.ReasonCodeError{Code: packets.ReasonTopicAliasInvalid, Reason: "unknown topic alias"}
+	}
+	p.TopicName = topic
+	return nil
+}
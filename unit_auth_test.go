@@ -0,0 +1,232 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// scramServer is a stand-in for the server side of a SCRAM exchange.
+type scramServer struct {
+	hash        func() hash.Hash
+	password    string
+	salt        []byte
+	iterations  int
+	clientFirst string
+	serverFirst string
+}
+
+// first will return the server-first-message for the client-first-message.
+func (s *scramServer) first(clientFirst []byte) []byte {
+	s.clientFirst = strings.TrimPrefix(string(clientFirst), "n,,")
+	s.serverFirst = "r=" + scramAttributes(s.clientFirst)["r"] + "server,s=" +
+		base64.StdEncoding.EncodeToString(s.salt) + ",i=4096"
+	return []byte(s.serverFirst)
+}
+
+// final will verify the client proof and return the server-final-message.
+func (s *scramServer) final(clientFinal []byte) ([]byte, bool) {
+	msg := string(clientFinal)
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, false
+	}
+	proof, _ := base64.StdEncoding.DecodeString(msg[i+3:])
+	authMessage := []byte(s.clientFirst + "," + s.serverFirst + "," + msg[:i])
+
+	saltedPassword := scramHi(s.hash, []byte(s.password), s.salt, 4096)
+	h := s.hash()
+	h.Write(scramHMAC(s.hash, saltedPassword, []byte("Client Key")))
+	storedKey := h.Sum(nil)
+	clientKey := scramHMAC(s.hash, storedKey, authMessage)
+	if len(proof) != len(clientKey) {
+		return nil, false
+	}
+	for j := range clientKey {
+		clientKey[j] ^= proof[j]
+	}
+	h = s.hash()
+	h.Write(clientKey)
+	if !hmac.Equal(h.Sum(nil), storedKey) {
+		return []byte("e=invalid-proof"), false
+	}
+
+	serverKey := scramHMAC(s.hash, saltedPassword, []byte("Server Key"))
+	signature := scramHMAC(s.hash, serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), true
+}
+
+// exchange will challenge the client and read its response, it returns the
+// server-final-message and whether the client was authenticated.
+func (s *scramServer) exchange(t *testing.T, conn net.Conn, clientFirst []byte) ([]byte, bool) {
+	newAuthPacket(packets.ReasonContinueAuthentication, "", s.first(clientFirst)).Write(conn)
+	cp, err := packets.ReadPacketWithVersion(conn, 5)
+	if err != nil {
+		t.Errorf("read of AUTH failed: %v", err)
+		return nil, false
+	}
+	ap, ok := cp.(*packets.AuthPacket)
+	if !ok || ap.ReasonCode != packets.ReasonContinueAuthentication {
+		t.Errorf("read %v, should be an AUTH response", cp)
+		return nil, false
+	}
+	return s.final(ap.Properties.AuthData)
+}
+
+func Test_ScramSHA256(t *testing.T) {
+	// the example exchange of RFC 7677
+	s := NewScramSHA256("user", "pencil").(*scram)
+	s.nonce = "rOprNGfwEbeRWgbNEkqO"
+	s.clientFirstBare = "n=user,r=" + s.nonce
+
+	res, err := s.Continue([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatalf("Continue returned error: %v", err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(res) != expected {
+		t.Errorf("client-final-message is %q, should be %q", res, expected)
+	}
+
+	if err := s.Complete([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Errorf("Complete returned error: %v", err)
+	}
+	if err := s.Complete([]byte("v=AAAA")); err == nil {
+		t.Errorf("Complete with an invalid signature did not return an error")
+	}
+	if _, err := s.Continue([]byte("r=other,s=AAAA,i=1")); err == nil {
+		t.Errorf("Continue with an invalid nonce did not return an error")
+	}
+}
+
+func Test_AuthConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(5)
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	ops.SetAuthenticator(NewScramSHA512("user", "secret"))
+	c := NewClient(ops).(*client)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv := &scramServer{hash: sha512.New, password: "secret", salt: []byte("salt")}
+		conn, connect := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		if connect.Properties.AuthMethod != "SCRAM-SHA-512" {
+			t.Errorf("CONNECT auth method is %q", connect.Properties.AuthMethod)
+		}
+
+		final, ok := srv.exchange(t, conn, connect.Properties.AuthData)
+		if !ok {
+			t.Errorf("client was not authenticated")
+			return
+		}
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.Properties = &packets.Properties{AuthMethod: "SCRAM-SHA-512", AuthData: final}
+		ca.Write(conn)
+
+		// re-authentication
+		cp, err := packets.ReadPacketWithVersion(conn, 5)
+		if err != nil {
+			t.Errorf("read of AUTH failed: %v", err)
+			return
+		}
+		ap, ok := cp.(*packets.AuthPacket)
+		if !ok || ap.ReasonCode != packets.ReasonReauthenticate {
+			t.Errorf("read %v, should be a re-authentication", cp)
+			return
+		}
+		if final, ok = srv.exchange(t, conn, ap.Properties.AuthData); !ok {
+			t.Errorf("client was not re-authenticated")
+			return
+		}
+		newAuthPacket(packets.ReasonSuccess, "SCRAM-SHA-512", final).Write(conn)
+		packets.ReadPacketWithVersion(conn, 5)
+	}()
+
+	ct := c.Connect()
+	if !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+
+	rt := c.Reauthenticate()
+	if !rt.WaitTimeout(5*time.Second) || rt.Error() != nil {
+		t.Errorf("re-authentication failed: %v", rt.Error())
+	}
+	c.Disconnect(10)
+	<-done
+}
+
+func Test_AuthConnectBadServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(5)
+	ops.SetAutoReconnect(false)
+	ops.SetAuthenticator(NewScramSHA256("user", "secret"))
+	c := NewClient(ops).(*client)
+
+	go func() {
+		// the server does not know the password, so the client refuses the
+		// server signature even though it was accepted.
+		srv := &scramServer{hash: sha256.New, password: "other", salt: []byte("salt")}
+		conn, connect := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		srv.exchange(t, conn, connect.Properties.AuthData)
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.Properties = &packets.Properties{AuthData: []byte("v=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))}
+		ca.Write(conn)
+	}()
+
+	ct := c.Connect()
+	if !ct.WaitTimeout(5 * time.Second) {
+		t.Fatalf("connect did not complete")
+	}
+	if e, ok := ct.Error().(*packets.ReasonCodeError); !ok || !strings.Contains(e.Reason, "server signature") {
+		t.Errorf("connect error is %v, should be an invalid server signature", ct.Error())
+	}
+}
+
+func Test_ReauthenticateConnectionLost(t *testing.T) {
+	ops := NewClientOptions().SetProtocolVersion(5)
+	ops.SetAuthenticator(NewScramSHA256("user", "secret"))
+	c := NewClient(ops).(*client)
+	c.oboundP = make(chan *PacketAndToken) // the outgoing routine has stopped
+	c.stop = make(chan struct{})
+	close(c.stop)
+	c.setConnected(reconnecting)
+
+	token := c.Reauthenticate()
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("re-authentication blocked after the connection was lost")
+	}
+	if token.Error() != ErrNotConnected {
+		t.Errorf("re-authentication returned %v, should be %v", token.Error(), ErrNotConnected)
+	}
+}
@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func Test_BackoffStrategies(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+
+	exp := NewExponentialBackoff(base, max)
+	for attempt, expected := range []time.Duration{base, 2 * base, 4 * base, 8 * base, max, max} {
+		if d := exp.Backoff(attempt+1, 0); d != expected {
+			t.Errorf("exponential backoff of attempt %d is %v, should be %v", attempt+1, d, expected)
+		}
+	}
+	if d := NewConstantBackoff(base).Backoff(10, max); d != base {
+		t.Errorf("constant backoff is %v, should be %v", d, base)
+	}
+
+	full := NewFullJitterBackoff(base, max)
+	decorrelated := NewDecorrelatedJitterBackoff(base, max)
+	previous := time.Duration(0)
+	for attempt := 1; attempt < 100; attempt++ {
+		if d := full.Backoff(attempt, 0); d < 0 || d > exp.Backoff(attempt, 0) {
+			t.Errorf("full jitter backoff of attempt %d is %v", attempt, d)
+		}
+		d := decorrelated.Backoff(attempt, previous)
+		if d < base || d > max || (previous >= base && d > 3*previous) {
+			t.Errorf("decorrelated jitter backoff of attempt %d after %v is %v", attempt, previous, d)
+		}
+		previous = d
+	}
+}
+
+func Test_BackoffJitterConcurrent(t *testing.T) {
+	full := NewFullJitterBackoff(time.Millisecond, time.Second)
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for attempt := 1; attempt < 100; attempt++ {
+				full.Backoff(attempt, 0)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	// the sources of two strategies are seeded separately.
+	a, b := newLockedRand(), newLockedRand()
+	same := true
+	for i := 0; i < 10; i++ {
+		if a.intn(1<<30) != b.intn(1<<30) {
+			same = false
+		}
+	}
+	if same {
+		t.Errorf("two random sources returned the same sequence")
+	}
+}
+
+func Test_BackoffMaxAttempts(t *testing.T) {
+	b := &backoffState{strategy: NewExponentialBackoff(time.Second, time.Minute), maxAttempts: 3}
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second} {
+		if d, ok := b.next(); !ok || d != expected {
+			t.Errorf("wait after attempt %d is %v %v, should be %v", i+1, d, ok, expected)
+		}
+	}
+	if _, ok := b.next(); ok {
+		t.Errorf("backoff did not give up after the maximum number of attempts")
+	}
+	b.reset()
+	if d, ok := b.next(); !ok || d != time.Second {
+		t.Errorf("wait after a reset is %v %v", d, ok)
+	}
+}
+
+func Test_ConnectRetryMaxAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ops := NewClientOptions().AddBroker("tcp://" + addr)
+	ops.SetConnectRetry(true)
+	ops.SetBackoffStrategy(NewConstantBackoff(10 * time.Millisecond))
+	ops.SetMaxConnectAttempts(3)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != ErrMaxConnectAttempts {
+		t.Errorf("connect returned %v, should be %v", ct.Error(), ErrMaxConnectAttempts)
+	}
+	if c.IsConnected() {
+		t.Errorf("client is connected")
+	}
+}
+
+func Test_ReconnectMaxAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go func() {
+		// the broker goes away after the first connection.
+		conn, _ := acceptOne(t, l)
+		l.Close()
+		if conn != nil {
+			packets.NewControlPacket(packets.Connack).Write(conn)
+			conn.Close()
+		}
+	}()
+
+	events := make(chan ConnectionEvent, 10)
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetKeepAlive(0)
+	ops.SetBackoffStrategy(NewConstantBackoff(10 * time.Millisecond))
+	ops.SetMaxConnectAttempts(2)
+	ops.SetConnectionStateListener(func(c Client, ev ConnectionEvent) {
+		if ev.To == StateDisconnected {
+			events <- ev
+		}
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+
+	select {
+	case ev := <-events:
+		if ev.From != StateReconnecting || ev.Cause != ErrMaxConnectAttempts || ev.Attempt != 2 {
+			t.Errorf("client gave up with %v -> %v attempt %d cause %v", ev.From, ev.To, ev.Attempt, ev.Cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client did not give up reconnecting")
+	}
+}
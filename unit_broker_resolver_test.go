@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+type stubResolver struct {
+	servers []*url.URL
+	err     error
+	calls   int
+}
+
+func (r *stubResolver) Resolve(ctx context.Context) ([]*url.URL, error) {
+	r.calls++
+	return r.servers, r.err
+}
+
+func Test_SRVResolver(t *testing.T) {
+	r := NewSRVResolver("example.com", true).(*srvResolver)
+	r.lookup = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if service != "secure-mqtt" || proto != "tcp" || name != "example.com" {
+			t.Errorf("looked up _%s._%s.%s", service, proto, name)
+		}
+		return "", []*net.SRV{
+			{Target: "a.example.com.", Port: 8883},
+			{Target: "b.example.com.", Port: 8884},
+		}, nil
+	}
+
+	servers, err := r.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	if len(servers) != 2 || servers[0].String() != "ssl://a.example.com:8883" || servers[1].String() != "ssl://b.example.com:8884" {
+		t.Errorf("resolved %v", servers)
+	}
+}
+
+func Test_FileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "brokers")
+	if err := ioutil.WriteFile(path, []byte("# brokers\ntcp://a:1883\n\ntcp://b:1883\n"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	r := NewFileResolver(path)
+	servers, err := r.Resolve(context.Background())
+	if err != nil || hostsOf(servers) != "ab" {
+		t.Errorf("resolved %v %v, should be a and b", servers, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("tcp://c:1883\n"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	servers, err = r.Resolve(context.Background())
+	if err != nil || hostsOf(servers) != "c" {
+		t.Errorf("resolved %v %v after the file changed, should be c", servers, err)
+	}
+
+	// the lines get the defaults of AddBroker.
+	if err := ioutil.WriteFile(path, []byte("host:1883\n:1884\n"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	servers, err = r.Resolve(context.Background())
+	if err != nil || len(servers) != 2 || servers[0].String() != "tcp://host:1883" || servers[1].String() != "tcp://127.0.0.1:1884" {
+		t.Errorf("resolved %v %v, should be tcp://host:1883 and tcp://127.0.0.1:1884", servers, err)
+	}
+}
+
+func Test_BrokerResolverConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, _ := acceptOne(t, l)
+		if conn != nil {
+			defer conn.Close()
+			packets.NewControlPacket(packets.Connack).Write(conn)
+			packets.ReadPacket(conn)
+		}
+	}()
+
+	u, _ := url.Parse("tcp://" + l.Addr().String())
+	r := &stubResolver{servers: []*url.URL{u}}
+	ops := NewClientOptions().SetBrokerResolver(r)
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect to resolved broker failed: %v", ct.Error())
+	}
+	c.Disconnect(10)
+	if r.calls != 1 {
+		t.Errorf("resolver was called %d times", r.calls)
+	}
+
+	// without a resolved broker the connect fails.
+	r.servers, r.err = nil, errors.New("no brokers")
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() == nil {
+		t.Errorf("connect without brokers succeeded")
+	}
+}
@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func Test_ConnectionStateListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		// the first connection is dropped, the first reconnect is refused
+		// and the second one is accepted.
+		for i, rc := range []byte{packets.Accepted, packets.ErrRefusedNotAuthorised, packets.Accepted} {
+			conn, _ := acceptOne(t, l)
+			if conn == nil {
+				return
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ReturnCode = rc
+			ca.SessionPresent = rc == packets.Accepted
+			ca.Write(conn)
+			if i == 2 {
+				packets.ReadPacket(conn)
+			}
+			conn.Close()
+		}
+	}()
+
+	events := make(chan ConnectionEvent, 10)
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(4)
+	ops.SetKeepAlive(0)
+	ops.SetConnectionStateListener(func(c Client, ev ConnectionEvent) {
+		events <- ev
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+
+	next := func() ConnectionEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection event")
+		}
+		return ConnectionEvent{}
+	}
+	expected := []struct {
+		from, to ConnectionState
+		attempt  int
+		rc       byte
+		cause    bool
+	}{
+		{StateDisconnected, StateConnecting, 0, 0, false},
+		{StateConnecting, StateConnected, 1, 0, false},
+		{StateConnected, StateReconnecting, 0, 0, true},
+		{StateReconnecting, StateReconnecting, 1, packets.ErrRefusedNotAuthorised, true},
+		{StateReconnecting, StateConnected, 2, 0, false},
+	}
+	for i, e := range expected {
+		ev := next()
+		if ev.From != e.from || ev.To != e.to || ev.Attempt != e.attempt || ev.ReturnCode != e.rc || (ev.Cause != nil) != e.cause {
+			t.Errorf("event %d is %v -> %v attempt %d rc %d cause %v, should be %v -> %v attempt %d rc %d",
+				i, ev.From, ev.To, ev.Attempt, ev.ReturnCode, ev.Cause, e.from, e.to, e.attempt, e.rc)
+		}
+		if e.to == StateConnected && (ev.Broker == nil || ev.Broker.Host != l.Addr().String() || !ev.SessionPresent) {
+			t.Errorf("event %d has broker %v and session present %v", i, ev.Broker, ev.SessionPresent)
+		}
+	}
+
+	c.Disconnect(10)
+	if ev := next(); ev.From != StateConnected || ev.To != StateDisconnected || ev.Cause != nil {
+		t.Errorf("disconnect event is %v -> %v cause %v", ev.From, ev.To, ev.Cause)
+	}
+}
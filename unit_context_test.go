@@ -0,0 +1,164 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func Test_ConnectContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		// the broker never answers the CONNECT.
+		conn, _ := acceptOne(t, l)
+		if conn != nil {
+			defer conn.Close()
+			packets.ReadPacket(conn)
+		}
+	}()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetAutoReconnect(false)
+	c := NewClient(ops)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.ConnectContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ConnectContext returned %v, should be %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("ConnectContext took %v after the deadline", d)
+	}
+	if c.IsConnected() {
+		t.Errorf("client is connected after the context was done")
+	}
+}
+
+func Test_PublishContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, _ := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+
+		// a single message may be in flight and it is never acknowledged.
+		rm := uint16(1)
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.Properties = &packets.Properties{ReceiveMaximum: &rm}
+		ca.Write(conn)
+		for {
+			if _, err := packets.ReadPacketWithVersion(conn, 5); err != nil {
+				return
+			}
+		}
+	}()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(5)
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	c := NewClient(ops).(*client)
+	if err := c.ConnectContext(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.PublishContext(ctx, "a/b", 1, false, "sent"); err != context.DeadlineExceeded {
+		t.Errorf("PublishContext of sent message returned %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.PublishContext(ctx, "a/b", 1, false, "queued"); err != context.DeadlineExceeded {
+		t.Errorf("PublishContext of queued message returned %v", err)
+	}
+
+	// only the message which was sent is kept.
+	if keys := c.persist.All(); len(keys) != 1 {
+		t.Errorf("store holds %v, should hold the sent message only", keys)
+	}
+	c.messageIds.RLock()
+	ids := len(c.messageIds.index)
+	c.messageIds.RUnlock()
+	if ids != 1 {
+		t.Errorf("%d message IDs are in use, should be 1", ids)
+	}
+
+	c.Disconnect(10)
+	<-done
+}
+
+func Test_SubscribeContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go serveLoopback(t, l)
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.ConnectContext(ctx); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Disconnect(10)
+
+	if err := c.SubscribeContext(ctx, "a/#", 1, nil); err != nil {
+		t.Errorf("SubscribeContext returned %v", err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.UnsubscribeContext(canceled, "a/#"); err != context.Canceled {
+		t.Errorf("UnsubscribeContext with a canceled context returned %v", err)
+	}
+}
+
+func Test_SubscribeContextCanceled(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	// the client has no outgoing routine, the subscribe is never sent.
+	c.setConnected(connected)
+
+	var handled string
+	c.msgRouter.addRoute("a/#", func(Client, Message) { handled = "earlier" })
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, topic := range []string{"a/#", "b"} {
+		err := c.SubscribeContext(canceled, topic, 0, func(Client, Message) { handled = "canceled" })
+		if err != context.Canceled {
+			t.Errorf("SubscribeContext of %q returned %v, should be canceled", topic, err)
+		}
+	}
+
+	// the handler of the earlier subscription is kept, no route is left for
+	// the new topic.
+	if n := c.msgRouter.routes.Len(); n != 1 {
+		t.Fatalf("%d routes after the canceled subscribes, should be 1", n)
+	}
+	c.msgRouter.routes.Front().Value.(*route).callback(c, nil)
+	if handled != "earlier" {
+		t.Errorf("%s handler called after the canceled subscribe", handled)
+	}
+}
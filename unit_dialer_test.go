@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// servePipe will answer the CONNECT on the broker end of a pipe and read
+// the packets until it is closed.
+func servePipe(conn net.Conn) {
+	defer conn.Close()
+	if _, err := packets.ReadPacket(conn); err != nil {
+		return
+	}
+	packets.NewControlPacket(packets.Connack).Write(conn)
+	for {
+		if _, err := packets.ReadPacket(conn); err != nil {
+			return
+		}
+	}
+}
+
+func Test_RegisterDialer(t *testing.T) {
+	RegisterDialer("pipe", func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+		client, broker := net.Pipe()
+		go servePipe(broker)
+		return client, nil
+	})
+	defer RegisterDialer("pipe", nil)
+
+	ops := NewClientOptions().AddBroker("pipe://broker")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over a registered dialer failed: %v", ct.Error())
+	}
+	c.Disconnect(10)
+
+	RegisterDialer("pipe", nil)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() == nil {
+		t.Errorf("connect over a removed dialer succeeded")
+	}
+}
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+func Test_CustomOpenConnectionFn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			servePipe(conn)
+		}
+	}()
+
+	var written int64
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetKeepAlive(0)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+		conn, err := DefaultOpenConnection(uri, options)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, written: &written}, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over a wrapped connection failed: %v", ct.Error())
+	}
+	defer c.Disconnect(10)
+	if pt := c.Publish("a/b", 0, false, "payload"); !pt.WaitTimeout(5*time.Second) || pt.Error() != nil {
+		t.Fatalf("publish failed: %v", pt.Error())
+	}
+	if atomic.LoadInt64(&written) == 0 {
+		t.Errorf("no bytes were counted by the wrapped connection")
+	}
+}
@@ -0,0 +1,171 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func Test_InflightWindow(t *testing.T) {
+	w := newInflightWindow()
+	w.reset(2)
+
+	pts := make([]*PacketAndToken, 4)
+	for i := range pts {
+		pts[i] = &PacketAndToken{}
+	}
+	for i, pt := range pts {
+		if sent := w.acquire(pt); sent != (i < 2) {
+			t.Errorf("acquire of publish %d returned %t", i, sent)
+		}
+	}
+
+	// the queued publishes are released in order.
+	if next := w.release(); next != pts[2] {
+		t.Errorf("first release returned %p, should be the third publish", next)
+	}
+	if next := w.release(); next != pts[3] {
+		t.Errorf("second release returned %p, should be the fourth publish", next)
+	}
+	if next := w.release(); next != nil {
+		t.Errorf("release with an empty queue returned %p", next)
+	}
+
+	w.reset(0)
+	for i := 0; i < 100; i++ {
+		if !w.acquire(&PacketAndToken{}) {
+			t.Fatalf("acquire without a limit queued the publish")
+		}
+	}
+}
+
+func Test_InflightMax(t *testing.T) {
+	rm := uint16(10)
+	tests := []struct {
+		max      uint16
+		connack  *packets.Properties
+		expected int
+	}{
+		{0, nil, 0},
+		{5, nil, 5},
+		{0, &packets.Properties{ReceiveMaximum: &rm}, 10},
+		{5, &packets.Properties{ReceiveMaximum: &rm}, 5},
+		{20, &packets.Properties{ReceiveMaximum: &rm}, 10},
+	}
+	for _, test := range tests {
+		o := NewClientOptions().SetMaxInflight(test.max)
+		if max := inflightMax(o, test.connack); max != test.expected {
+			t.Errorf("inflightMax(%d, %v) returned %d, should be %d", test.max, test.connack, max, test.expected)
+		}
+	}
+}
+
+func Test_MQTT5ReceiveMaximum(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(5)
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	c := NewClient(ops).(*client)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, _ := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+
+		rm := uint16(1)
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.Properties = &packets.Properties{ReceiveMaximum: &rm}
+		ca.Write(conn)
+
+		for _, payload := range []string{"1", "2", "3"} {
+			cp, err := packets.ReadPacketWithVersion(conn, 5)
+			if err != nil {
+				t.Errorf("read of PUBLISH failed: %v", err)
+				return
+			}
+			pub := cp.(*packets.PublishPacket)
+			if string(pub.Payload) != payload {
+				t.Errorf("PUBLISH payload is %q, should be %q", pub.Payload, payload)
+			}
+
+			// nothing else is sent until the publish is acknowledged.
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if cp, err := packets.ReadPacketWithVersion(conn, 5); err == nil {
+				t.Errorf("read %v while the in-flight window was full", cp)
+			}
+			conn.SetReadDeadline(time.Time{})
+
+			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			pa.MessageID = pub.MessageID
+			pa.Write(conn)
+		}
+		packets.ReadPacketWithVersion(conn, 5)
+	}()
+
+	ct := c.Connect()
+	if !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+
+	tokens := []Token{
+		c.Publish("a/b", 1, false, "1"),
+		c.Publish("a/b", 1, false, "2"),
+		c.Publish("a/b", 1, false, "3"),
+	}
+	for i, token := range tokens {
+		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Errorf("publish %d failed: %v", i, token.Error())
+		}
+	}
+	c.Disconnect(10)
+	<-done
+}
+
+func Test_InflightSendTimeout(t *testing.T) {
+	ops := NewClientOptions().SetMaxInflight(2).SetWriteTimeout(10 * time.Millisecond)
+	c := NewClient(ops).(*client)
+	c.obound = make(chan *PacketAndToken) // nothing reads the outgoing publishes
+	c.stop = make(chan struct{})
+	defer close(c.stop)
+	c.persist.Open()
+	c.inflight.reset(2)
+	c.setConnected(connected)
+
+	// every publish times out, the slots are freed so none of them is left
+	// waiting in the queue of the window.
+	for i := 0; i < 5; i++ {
+		token := c.Publish("test/inflight", 1, false, "payload")
+		if !token.WaitTimeout(time.Second) {
+			t.Fatalf("publish %d was queued in a full in-flight window", i)
+		}
+		if token.Error() == nil {
+			t.Errorf("publish %d did not time out", i)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			c.inflight.Lock()
+			count := c.inflight.count
+			c.inflight.Unlock()
+			if count == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("in-flight slot of publish %d was not released", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
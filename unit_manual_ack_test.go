@@ -0,0 +1,256 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/broker"
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// newAckTestClient returns a client to test the ack queue with, the acks
+// it sends are put on its oboundP.
+func newAckTestClient(o *ClientOptions) *client {
+	o.AutoAck = false
+	o.Clock = SystemClock
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{
+		options: *o,
+		persist: store,
+		oboundP: make(chan *PacketAndToken, 10),
+		stop:    make(chan struct{}),
+		errors:  make(chan error, 1),
+	}
+	c.acks = newAckQueue(&c.options)
+	return c
+}
+
+func newAckTestPublish(id uint16, qos byte) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName, p.MessageID, p.Qos = "a", id, qos
+	return p
+}
+
+// sentAcks returns the message IDs of the acks sent so far.
+func sentAcks(c *client) []uint16 {
+	var ids []uint16
+	for {
+		select {
+		case pt := <-c.oboundP:
+			ids = append(ids, pt.p.Details().MessageID)
+		default:
+			return ids
+		}
+	}
+}
+
+func Test_AckQueueOrder(t *testing.T) {
+	c := newAckTestClient(NewClientOptions())
+	ack1 := c.acks.add(c, newAckTestPublish(1, 1))
+	ack0 := c.acks.add(c, newAckTestPublish(0, 0))
+	ack2 := c.acks.add(c, newAckTestPublish(2, 2))
+	ack3 := c.acks.add(c, newAckTestPublish(3, 1))
+
+	ack3()
+	ack2()
+	ack0()
+	if ids := sentAcks(c); len(ids) != 0 {
+		t.Fatalf("acks %v sent before the first message was acked", ids)
+	}
+	ack1()
+	ids := sentAcks(c)
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Errorf("acks sent in the order %v, should be [1 2 3]", ids)
+	}
+}
+
+func Test_AckQueueMaxUnacked(t *testing.T) {
+	c := newAckTestClient(NewClientOptions().SetMaxUnacked(1))
+	ack1 := c.acks.add(c, newAckTestPublish(1, 1))
+
+	added := make(chan func())
+	go func() { added <- c.acks.add(c, newAckTestPublish(2, 1)) }()
+	select {
+	case <-added:
+		t.Fatalf("message delivered beyond MaxUnacked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ack1()
+	select {
+	case ack2 := <-added:
+		ack2()
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered after the ack")
+	}
+	if ids := sentAcks(c); len(ids) != 2 {
+		t.Errorf("acks %v sent, should be [1 2]", ids)
+	}
+}
+
+func Test_AckQueueReset(t *testing.T) {
+	c := newAckTestClient(NewClientOptions().SetMaxUnacked(1))
+	stale := c.acks.add(c, newAckTestPublish(1, 1))
+	c.acks.reset()
+	stale()
+	if ids := sentAcks(c); len(ids) != 0 {
+		t.Errorf("ack %v of a lost connection sent", ids)
+	}
+	// the slot of the stale message is free again.
+	c.acks.add(c, newAckTestPublish(1, 1))()
+	if ids := sentAcks(c); len(ids) != 1 {
+		t.Errorf("acks %v sent after the reset", ids)
+	}
+}
+
+func Test_AckQueueResetWhileWaiting(t *testing.T) {
+	c := newAckTestClient(NewClientOptions().SetMaxUnacked(1))
+	c.acks.add(c, newAckTestPublish(1, 1))
+	old := c.acks.slots
+
+	added := make(chan func())
+	go func() { added <- c.acks.add(c, newAckTestPublish(2, 1)) }()
+	time.Sleep(20 * time.Millisecond)
+	c.acks.reset()
+
+	// the waiting delivery gets a slot of the lost connection, it takes one
+	// of the new connection instead.
+	<-old
+	var ack2 func()
+	select {
+	case ack2 = <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered after the reset")
+	}
+	if n := len(c.acks.slots); n != 1 {
+		t.Fatalf("%d slots taken after the reset, should be 1", n)
+	}
+	ack2()
+	if ids := sentAcks(c); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("acks %v sent, should be [2]", ids)
+	}
+}
+
+func Test_AckQueueStalledSend(t *testing.T) {
+	c := newAckTestClient(NewClientOptions())
+	c.oboundP = make(chan *PacketAndToken) // the outgoing routine is stalled
+	ack1 := c.acks.add(c, newAckTestPublish(1, 1))
+	ack2 := c.acks.add(c, newAckTestPublish(2, 1))
+
+	sent := make(chan struct{})
+	go func() {
+		ack1()
+		close(sent)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// the queue is not locked while the ack waits to be sent.
+	done := make(chan struct{})
+	go func() {
+		ack2()
+		c.acks.add(c, newAckTestPublish(3, 1))
+		c.acks.oldest()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ack queue blocked while an ack was being sent")
+	}
+
+	var ids []uint16
+	for i := 0; i < 2; i++ {
+		select {
+		case pt := <-c.oboundP:
+			ids = append(ids, pt.p.Details().MessageID)
+		case <-time.After(time.Second):
+			t.Fatalf("acks %v sent, should be [1 2]", ids)
+		}
+	}
+	<-sent
+	if ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("acks sent in the order %v, should be [1 2]", ids)
+	}
+}
+
+func Test_AckTimeout(t *testing.T) {
+	c := newAckTestClient(NewClientOptions().SetAckTimeout(20*time.Millisecond, true))
+	c.acks.add(c, newAckTestPublish(1, 1))
+	c.workers.Add(1)
+	go ackWatch(c)
+	defer c.workers.Wait()
+
+	select {
+	case err := <-c.errors:
+		if err != ErrAckTimeout {
+			t.Errorf("connection ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		close(c.stop)
+		t.Fatalf("ack timeout did not end the connection")
+	}
+}
+
+// Test_ManualAck checks that a message which was not acked is sent again by
+// the broker on the next connection of a persistent session.
+func Test_ManualAck(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+	l, err := ListenMem("unit-manual-ack")
+	if err != nil {
+		t.Fatalf("ListenMem failed: %v", err)
+	}
+	go b.Serve(l)
+
+	received := make(chan Message, 10)
+	connect := func() Client {
+		ops := NewClientOptions().AddBroker("mem://unit-manual-ack").SetClientID("manual").
+			SetCleanSession(false).SetAutoAck(false).
+			SetDefaultPublishHandler(func(_ Client, m Message) { received <- m })
+		c := NewClient(ops)
+		if token := c.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatalf("Connect failed: %v", token.Error())
+		}
+		return c
+	}
+
+	c := connect()
+	if token := c.Subscribe("manual", 1, nil); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe failed: %v", token.Error())
+	}
+	pub := NewClient(NewClientOptions().AddBroker("mem://unit-manual-ack"))
+	if token := pub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect failed: %v", token.Error())
+	}
+	defer pub.Disconnect(0)
+	pub.Publish("manual", 1, false, "once")
+
+	next := func() Message {
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message not received")
+		}
+		return nil
+	}
+	next()
+	c.Disconnect(0)
+
+	c = connect()
+	m := next()
+	if string(m.Payload()) != "once" || !m.Duplicate() {
+		t.Errorf("message not sent again, received %q dup %v", m.Payload(), m.Duplicate())
+	}
+	// the ack is sent before the DISCONNECT.
+	m.Ack()
+	c.Disconnect(0)
+
+	c = connect()
+	defer c.Disconnect(0)
+	select {
+	case m := <-received:
+		t.Errorf("acked message %q received again", m.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,52 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/broker"
+)
+
+func Test_MemTransport(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+	l, err := ListenMem("unit-mem")
+	if err != nil {
+		t.Fatalf("ListenMem failed: %v", err)
+	}
+	go b.Serve(l)
+	if _, err := ListenMem("unit-mem"); err != ErrMemAddrInUse {
+		t.Errorf("second ListenMem returned %v", err)
+	}
+
+	ops := NewClientOptions().AddBroker("mem://unit-mem").SetClientID("mem")
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	received := make(chan Message, 1)
+	if token := c.Subscribe("mem/+", 2, func(_ Client, m Message) { received <- m }); token.Wait() && token.Error() != nil {
+		t.Fatalf("Subscribe failed: %v", token.Error())
+	}
+	if token := c.Publish("mem/test", 2, false, "payload"); token.Wait() && token.Error() != nil {
+		t.Fatalf("Publish failed: %v", token.Error())
+	}
+	select {
+	case m := <-received:
+		if m.Topic() != "mem/test" || string(m.Payload()) != "payload" || m.Qos() != 2 {
+			t.Errorf("received %s %q qos %d", m.Topic(), m.Payload(), m.Qos())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not received")
+	}
+}
+
+func Test_MemTransportNoListener(t *testing.T) {
+	ops := NewClientOptions().AddBroker("mem://unit-mem-missing").SetConnectTimeout(time.Second)
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() == nil {
+		t.Fatalf("Connect to a missing mem listener succeeded")
+	}
+}
@@ -0,0 +1,264 @@
+package mqtt
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// acceptOne will accept a single connection on the listener and read the
+// CONNECT packet sent by the client.
+func acceptOne(t *testing.T, l net.Listener) (net.Conn, *packets.ConnectPacket) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Errorf("accept failed: %v", err)
+		return nil, nil
+	}
+
+	cp, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Errorf("read of CONNECT failed: %v", err)
+		return nil, nil
+	}
+	return conn, cp.(*packets.ConnectPacket)
+}
+
+func Test_MQTT5Connect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	lost := make(chan error, 1)
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(5)
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c Client, err error) { lost <- err })
+	c := NewClient(ops).(*client)
+
+	go func() {
+		conn, connect := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		if connect.ProtocolVersion != 5 {
+			t.Errorf("CONNECT protocol version is %d, should be 5", connect.ProtocolVersion)
+		}
+
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		aliasMax := uint16(4)
+		ca.Properties = &packets.Properties{AssignedClientID: "assigned", TopicAliasMaximum: &aliasMax}
+		ca.Write(conn)
+
+		cp, err := packets.ReadPacketWithVersion(conn, 5)
+		if err != nil {
+			t.Errorf("read of PUBLISH failed: %v", err)
+			return
+		}
+		pub := cp.(*packets.PublishPacket)
+		if pub.Properties.ContentType != "text/plain" {
+			t.Errorf("PUBLISH content type is %q", pub.Properties.ContentType)
+		}
+		if ids := pub.Properties.SubscriptionIdentifier; ids != nil {
+			t.Errorf("PUBLISH sent with subscription identifiers %v", ids)
+		}
+		if pub.TopicName != "a/b" || pub.Properties.TopicAlias == nil || *pub.Properties.TopicAlias != 1 {
+			t.Errorf("PUBLISH to %q did not set topic alias 1", pub.TopicName)
+		}
+
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = pub.MessageID
+		pa.ReasonCode = packets.ReasonNotAuthorized
+		pa.Properties = &packets.Properties{ReasonString: "acl"}
+		pa.Write(conn)
+
+		d := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+		d.ReasonCode = packets.ReasonServerShuttingDown
+		d.Properties = &packets.Properties{}
+		d.Write(conn)
+	}()
+
+	ct := c.Connect()
+	if !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	if id := ct.(*ConnectToken).Properties().AssignedClientID; id != "assigned" {
+		t.Errorf("assigned client ID is %q, should be %q", id, "assigned")
+	}
+	if c.options.ClientID != "assigned" {
+		t.Errorf("client ID is %q, should be the assigned one", c.options.ClientID)
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.TopicName = "a/b"
+	pub.Payload = []byte("payload")
+	pub.Properties = &packets.Properties{ContentType: "text/plain", SubscriptionIdentifier: []int{7}}
+	pt := newToken(packets.Publish).(*PublishToken)
+	pub.MessageID = c.getID(pt)
+	pt.messageID = pub.MessageID
+	c.obound <- &PacketAndToken{p: pub, t: pt}
+
+	if !pt.WaitTimeout(5 * time.Second) {
+		t.Fatalf("publish was not acknowledged")
+	}
+	if e, ok := pt.Error().(*packets.ReasonCodeError); !ok || e.Code != packets.ReasonNotAuthorized || e.Reason != "acl" {
+		t.Errorf("publish error is %v, should be Not authorized", pt.Error())
+	}
+	if pt.ReasonCode() != packets.ReasonNotAuthorized {
+		t.Errorf("publish reason code is 0x%x", pt.ReasonCode())
+	}
+
+	select {
+	case err := <-lost:
+		if e, ok := err.(*packets.ReasonCodeError); !ok || e.Code != packets.ReasonServerShuttingDown {
+			t.Errorf("connection lost with %v, should be Server shutting down", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("connection was not lost after server DISCONNECT")
+	}
+}
+
+func Test_MQTT5Fallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(5)
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	c := NewClient(ops).(*client)
+
+	go func() {
+		// a 3.1.1 broker refuses the protocol version and closes.
+		conn, connect := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		if connect.ProtocolVersion != 5 {
+			t.Errorf("first CONNECT protocol version is %d, should be 5", connect.ProtocolVersion)
+		}
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.ReturnCode = packets.ErrRefusedBadProtocolVersion
+		ca.Write(conn)
+		conn.Close()
+
+		conn, connect = acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		if connect.ProtocolVersion != 4 {
+			t.Errorf("second CONNECT protocol version is %d, should be 4", connect.ProtocolVersion)
+		}
+		ca = packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ca.Write(conn)
+
+		// publish options are dropped on a 3.1.1 connection.
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			t.Errorf("read of PUBLISH failed: %v", err)
+			return
+		}
+		if pub, ok := cp.(*packets.PublishPacket); !ok || pub.TopicName != "a/b" || string(pub.Payload) != "payload" {
+			t.Errorf("read %v, should be the 3.1.1 PUBLISH", cp)
+		}
+		packets.ReadPacket(conn)
+	}()
+
+	ct := c.Connect()
+	if !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	if c.options.ProtocolVersion != 4 {
+		t.Errorf("protocol version is %d, should have fallen back to 4", c.options.ProtocolVersion)
+	}
+	if ct.(*ConnectToken).Properties() != nil {
+		t.Errorf("3.1.1 connection has CONNACK properties")
+	}
+	pt := c.PublishWithOptions("a/b", 0, false, "payload", PublishOptions{ContentType: "text/plain"})
+	if !pt.WaitTimeout(5*time.Second) || pt.Error() != nil {
+		t.Errorf("publish failed: %v", pt.Error())
+	}
+	c.Disconnect(10)
+}
+
+func Test_MQTT5PublishOptions(t *testing.T) {
+	opts := PublishOptions{
+		ContentType:     "application/json",
+		PayloadFormat:   PayloadFormatUTF8,
+		MessageExpiry:   1500 * time.Millisecond,
+		ResponseTopic:   "reply/to",
+		CorrelationData: []byte{0x01},
+		UserProperties:  []packets.UserProperty{{Key: "trace", Value: "abc"}},
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Properties = opts.properties()
+
+	buf := new(bytes.Buffer)
+	if err := pub.Write(buf); err != nil {
+		t.Fatalf("write of PUBLISH failed: %v", err)
+	}
+	cp, err := packets.ReadPacketWithVersion(buf, 5)
+	if err != nil {
+		t.Fatalf("read of PUBLISH failed: %v", err)
+	}
+
+	m := messageFromPublish(cp.(*packets.PublishPacket), func() {})
+	if m.ContentType() != opts.ContentType {
+		t.Errorf("content type is %q, should be %q", m.ContentType(), opts.ContentType)
+	}
+	if m.PayloadFormat() != PayloadFormatUTF8 {
+		t.Errorf("payload format is %d, should be %d", m.PayloadFormat(), PayloadFormatUTF8)
+	}
+	if m.MessageExpiry() != 2*time.Second {
+		t.Errorf("message expiry is %v, should be rounded up to 2s", m.MessageExpiry())
+	}
+	if m.ResponseTopic() != opts.ResponseTopic || !bytes.Equal(m.CorrelationData(), opts.CorrelationData) {
+		t.Errorf("response topic %q and correlation data %v were not kept", m.ResponseTopic(), m.CorrelationData())
+	}
+	if !reflect.DeepEqual(m.UserProperties(), opts.UserProperties) {
+		t.Errorf("user properties are %v, should be %v", m.UserProperties(), opts.UserProperties)
+	}
+
+	// a message received without properties has the zero values.
+	m = messageFromPublish(packets.NewControlPacket(packets.Publish).(*packets.PublishPacket), func() {})
+	if m.ContentType() != "" || m.PayloadFormat() != PayloadFormatBytes || m.MessageExpiry() != 0 || m.UserProperties() != nil {
+		t.Errorf("message without properties returned non-zero metadata")
+	}
+}
+
+func Test_SubscribeOptions(t *testing.T) {
+	tests := []struct {
+		opts    SubscribeOptions
+		options byte
+	}{
+		{SubscribeOptions{QoS: 1}, 0x01},
+		{SubscribeOptions{QoS: 2, NoLocal: true}, 0x06},
+		{SubscribeOptions{RetainAsPublished: true, RetainHandling: RetainHandlingDoNotSend}, 0x28},
+		{SubscribeOptions{QoS: 1, RetainHandling: RetainHandlingSendIfNew}, 0x11},
+	}
+	for _, test := range tests {
+		if options := test.opts.options(); options != test.options {
+			t.Errorf("options of %+v are 0x%02x, should be 0x%02x", test.opts, options, test.options)
+		}
+	}
+
+	for _, opts := range []SubscribeOptions{{RetainHandling: 3}, {SubscriptionIdentifier: -1}, {SubscriptionIdentifier: 268435456}} {
+		if opts.validate() == nil {
+			t.Errorf("validate of %+v did not return an error", opts)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func queuedPublish(q *offlineQueue, payload string) *PublishToken {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "a/b"
+	p.Payload = []byte(payload)
+	t := newToken(packets.Publish).(*PublishToken)
+	q.push(p, t)
+	return t
+}
+
+func Test_OfflineQueuePolicy(t *testing.T) {
+	for _, policy := range []OfflineQueuePolicy{DropOldest, DropNewest} {
+		q := newOfflineQueue(NewClientOptions().SetOfflineQueue(2, policy, 0))
+		tokens := []*PublishToken{queuedPublish(q, "a"), queuedPublish(q, "b"), queuedPublish(q, "c")}
+
+		dropped, expected := 0, []string{"b", "c"}
+		if policy == DropNewest {
+			dropped, expected = 2, []string{"a", "b"}
+		}
+		if !tokens[dropped].WaitTimeout(time.Second) || tokens[dropped].Error() != ErrOfflineQueueFull {
+			t.Errorf("policy %d: token %d returned %v, should be dropped", policy, dropped, tokens[dropped].Error())
+		}
+		for _, payload := range expected {
+			pt, _ := q.pop()
+			if pt == nil || string(pt.p.(*packets.PublishPacket).Payload) != payload {
+				t.Fatalf("policy %d: popped %v, should be %q", policy, pt, payload)
+			}
+		}
+		if pt, _ := q.pop(); pt != nil {
+			t.Errorf("policy %d: popped %v from an empty queue", policy, pt)
+		}
+	}
+}
+
+func Test_OfflineQueueTTL(t *testing.T) {
+	q := newOfflineQueue(NewClientOptions().SetOfflineQueue(10, DropOldest, 10*time.Millisecond))
+	expired := queuedPublish(q, "a")
+	time.Sleep(20 * time.Millisecond)
+	kept := queuedPublish(q, "b")
+
+	if !expired.WaitTimeout(time.Second) || expired.Error() != ErrOfflineMessageExpired {
+		t.Errorf("expired message returned %v", expired.Error())
+	}
+	if pt, _ := q.pop(); pt == nil || pt.t != kept {
+		t.Errorf("popped %v, should be the message which has not expired", pt)
+	}
+
+	queuedPublish(q, "c")
+	q.clear(ErrNotConnected)
+	if pt, _ := q.pop(); pt != nil {
+		t.Errorf("popped %v from a cleared queue", pt)
+	}
+}
+
+func Test_OfflineQueueRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offline")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ops := NewClientOptions().SetOfflineQueue(10, DropOldest, 0)
+
+	q := newOfflineQueue(ops.SetOfflineQueueStore(NewFileStore(dir)))
+	for _, payload := range []string{"a", "b", "c"} {
+		queuedPublish(q, payload)
+	}
+	pt, e := q.pop()
+	if pt == nil {
+		t.Fatalf("popped nothing from the queue")
+	}
+	q.sent(e)
+	q.store.Close()
+
+	// the messages left are loaded in order, new ones are queued behind them.
+	q = newOfflineQueue(ops.SetOfflineQueueStore(NewFileStore(dir)))
+	queuedPublish(q, "d")
+	for _, payload := range []string{"b", "c", "d"} {
+		pt, e := q.pop()
+		if pt == nil || string(pt.p.(*packets.PublishPacket).Payload) != payload {
+			t.Fatalf("popped %v after a restart, should be %q", pt, payload)
+		}
+		q.sent(e)
+	}
+	if pt, _ := q.pop(); pt != nil {
+		t.Errorf("popped %v from an empty queue", pt)
+	}
+	if keys := q.store.All(); len(keys) != 0 {
+		t.Errorf("store holds %v after the queue was sent", keys)
+	}
+}
+
+func Test_OfflineQueueDraining(t *testing.T) {
+	q := newOfflineQueue(NewClientOptions().SetOfflineQueue(10, DropOldest, 0))
+	queuedPublish(q, "a")
+
+	// a publish is queued behind the messages which were not sent yet.
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Payload = []byte("b")
+	if !q.pushIfDraining(p, newToken(packets.Publish).(*PublishToken)) {
+		t.Errorf("publish was not queued behind the offline messages")
+	}
+	for _, payload := range []string{"a", "b"} {
+		if pt, _ := q.pop(); pt == nil || string(pt.p.(*packets.PublishPacket).Payload) != payload {
+			t.Fatalf("popped %v, should be %q", pt, payload)
+		}
+	}
+	if pt, _ := q.pop(); pt != nil {
+		t.Errorf("popped %v from an empty queue", pt)
+	}
+	if q.pushIfDraining(p, newToken(packets.Publish).(*PublishToken)) {
+		t.Errorf("publish was queued after the queue was drained")
+	}
+}
+
+func Test_OfflineQueueFlush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	resume := make(chan struct{})
+	received := make(chan string, 10)
+	go func() {
+		// the first connection is dropped right after the CONNACK.
+		conn, _ := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		packets.NewControlPacket(packets.Connack).Write(conn)
+		conn.Close()
+
+		<-resume
+		conn, _ = acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		packets.NewControlPacket(packets.Connack).Write(conn)
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			if p, ok := cp.(*packets.PublishPacket); ok {
+				received <- string(p.Payload)
+			}
+		}
+	}()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetKeepAlive(0)
+	ops.SetOfflineQueue(2, DropOldest, 0)
+	c := NewClient(ops).(*client)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	defer c.Disconnect(10)
+
+	for c.connectionStatus() != reconnecting {
+		time.Sleep(time.Millisecond)
+	}
+	tokens := []Token{
+		c.Publish("a/b", 0, false, "a"),
+		c.Publish("a/b", 0, false, "b"),
+		c.Publish("a/b", 0, false, "c"),
+	}
+	close(resume)
+
+	if !tokens[0].WaitTimeout(5*time.Second) || tokens[0].Error() != ErrOfflineQueueFull {
+		t.Errorf("oldest message returned %v, should be dropped", tokens[0].Error())
+	}
+	if done, err := WaitAllTimeout(5*time.Second, tokens[1:]...); !done || err != nil {
+		t.Fatalf("queued messages were not sent: %v %v", done, err)
+	}
+	for _, expected := range []string{"b", "c"} {
+		select {
+		case payload := <-received:
+			if payload != expected {
+				t.Errorf("received %q, should be %q", payload, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not received", expected)
+		}
+	}
+}
+
+func Test_OfflineQueueDisabled(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	if c.offline != nil {
+		t.Fatalf("offline queue was created without a size")
+	}
+	c.setConnected(reconnecting)
+
+	// the message is discarded as before the offline queue existed.
+	token := c.Publish("a/b", 0, false, "a")
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Errorf("publish while reconnecting returned %v", token.Error())
+	}
+}
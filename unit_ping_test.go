@@ -18,7 +18,7 @@ import (
 	"bytes"
 	"testing"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 func Test_NewPingReqMessage(t *testing.T) {
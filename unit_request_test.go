@@ -0,0 +1,194 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+// serveLoopback will accept a single client and send its QoS 0 publishes
+// back to it when it has subscribed to their topic.
+func serveLoopback(t *testing.T, l net.Listener) {
+	conn, connect := acceptOne(t, l)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	version := connect.ProtocolVersion
+	ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if version == 5 {
+		packets.InitProperties(ca)
+	}
+	ca.Write(conn)
+
+	var subs []string
+	for {
+		cp, err := packets.ReadPacketWithVersion(conn, version)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.SubscribePacket:
+			subs = append(subs, p.Topics...)
+			sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			sa.MessageID = p.MessageID
+			sa.ReturnCodes = []byte{0}
+			if version == 5 {
+				packets.InitProperties(sa)
+			}
+			sa.Write(conn)
+		case *packets.PublishPacket:
+			for _, sub := range subs {
+				if routeIncludesTopic(sub, p.TopicName) {
+					p.Write(conn)
+					break
+				}
+			}
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func testRequestResponse(t *testing.T, version uint) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go serveLoopback(t, l)
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetClientID("requester")
+	ops.SetProtocolVersion(version)
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	defer c.Disconnect(10)
+
+	st := Respond(c, "rpc/echo", 0, func(c Client, m Message) []byte {
+		return append([]byte("echo "), m.Payload()...)
+	})
+	if !st.WaitTimeout(5*time.Second) || st.Error() != nil {
+		t.Fatalf("subscribe of responder failed: %v", st.Error())
+	}
+
+	r := NewRequester(c, "", 0)
+	tokens := []*RequestToken{
+		r.Request("rpc/echo", []byte("a"), 5*time.Second),
+		r.Request("rpc/echo", []byte("b"), 5*time.Second),
+	}
+	for i, expected := range []string{"echo a", "echo b"} {
+		if !tokens[i].WaitTimeout(5*time.Second) || tokens[i].Error() != nil {
+			t.Fatalf("request %d failed: %v", i, tokens[i].Error())
+		}
+		m := tokens[i].Response()
+		if string(m.Payload()) != expected {
+			t.Errorf("response %d is %q, should be %q", i, m.Payload(), expected)
+		}
+		if m.Topic() != "response/requester" {
+			t.Errorf("response %d was received on %q", i, m.Topic())
+		}
+	}
+
+	// nobody answers on this topic.
+	rt := r.Request("rpc/none", []byte("c"), 100*time.Millisecond)
+	if !rt.WaitTimeout(5*time.Second) || rt.Error() != ErrRequestTimeout {
+		t.Errorf("request without a responder returned %v, should time out", rt.Error())
+	}
+}
+
+func Test_RequestResponse(t *testing.T) {
+	testRequestResponse(t, 4)
+}
+
+func Test_MQTT5RequestResponse(t *testing.T) {
+	testRequestResponse(t, 5)
+}
+
+// requestClock is a Clock whose timers of the request timeout only fire
+// when the test fires them.
+type requestClock struct {
+	Clock
+	timeout time.Duration
+	timers  chan *requestTimer
+}
+
+func (c *requestClock) NewTimer(d time.Duration) ClockTimer {
+	if d != c.timeout {
+		return c.Clock.NewTimer(d)
+	}
+	t := &requestTimer{c: make(chan time.Time, 1), stopped: make(chan struct{}, 1)}
+	c.timers <- t
+	return t
+}
+
+type requestTimer struct {
+	c       chan time.Time
+	stopped chan struct{}
+}
+
+func (t *requestTimer) C() <-chan time.Time { return t.c }
+
+func (t *requestTimer) Stop() bool {
+	select {
+	case t.stopped <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (t *requestTimer) Reset(d time.Duration) bool { return true }
+
+func Test_RequestClock(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go serveLoopback(t, l)
+
+	clock := &requestClock{Clock: SystemClock, timeout: time.Hour, timers: make(chan *requestTimer, 2)}
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetClientID("requester")
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	ops.SetClock(clock)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	defer c.Disconnect(10)
+
+	st := Respond(c, "rpc/echo", 0, func(c Client, m Message) []byte { return m.Payload() })
+	if !st.WaitTimeout(5*time.Second) || st.Error() != nil {
+		t.Fatalf("subscribe of responder failed: %v", st.Error())
+	}
+	r := NewRequester(c, "", 0)
+
+	// the timer of an answered request is stopped.
+	token := r.Request("rpc/echo", []byte("a"), time.Hour)
+	timer := <-clock.timers
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("request failed: %v", token.Error())
+	}
+	select {
+	case <-timer.stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("timer of the answered request was not stopped")
+	}
+
+	// the request times out when the timer of the clock fires.
+	token = r.Request("rpc/none", []byte("b"), time.Hour)
+	timer = <-clock.timers
+	timer.c <- time.Now()
+	if !token.WaitTimeout(5*time.Second) || token.Error() != ErrRequestTimeout {
+		t.Errorf("request returned %v when the timer fired, should time out", token.Error())
+	}
+}
@@ -17,7 +17,7 @@ package mqtt
 import (
 	"testing"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/aretas77/paho.mqtt.golang/packets"
 )
 
 func Test_newRouter(t *testing.T) {
@@ -342,3 +342,105 @@ func Test_SharedSubscription_MatchAndDispatch(t *testing.T) {
 	}
 
 }
+
+func Test_SubscriptionIdentifier_MatchAndDispatch(t *testing.T) {
+	calledback := make(chan string, 10)
+	handler := func(name string) MessageHandler {
+		return func(c Client, m Message) {
+			calledback <- name
+		}
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Payload = []byte("foo")
+	pub.Properties = &packets.Properties{SubscriptionIdentifier: []int{2}}
+
+	msgs := make(chan *packets.PublishPacket)
+
+	router, stopper := newRouter()
+	router.addRouteWithID("a/#", 1, handler("wildcard"))
+	router.addRouteWithID("a/+", 2, handler("single"))
+	router.addRoute("a/b", handler("plain"))
+
+	router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+	msgs <- pub
+	stopper <- true
+
+	var called []string
+	for len(calledback) > 0 {
+		called = append(called, <-calledback)
+	}
+	if len(called) != 2 || called[0] != "single" || called[1] != "plain" {
+		t.Errorf("message was dispatched to %v, should be [single plain]", called)
+	}
+}
+
+func Test_SubscriptionIdentifier_Overlapping(t *testing.T) {
+	withID := &route{topic: "a/#", subID: 1}
+	plain := &route{topic: "a/b"}
+
+	tests := []struct {
+		topic  string
+		ids    []int
+		withID bool
+		plain  bool
+	}{
+		// both subscriptions matched on the server.
+		{"a/b", []int{1}, true, true},
+		// only the subscription with the identifier matched.
+		{"a/c", []int{1}, true, false},
+		// the identifier of another subscription.
+		{"a/b", []int{2}, false, true},
+		// no identifiers, such as from a server without MQTT 5.
+		{"a/b", nil, true, true},
+	}
+	for _, test := range tests {
+		props := &packets.Properties{SubscriptionIdentifier: test.ids}
+		if match := withID.matchProperties(test.topic, props); match != test.withID {
+			t.Errorf("route with identifier matched %s %v: %t", test.topic, test.ids, match)
+		}
+		if match := plain.matchProperties(test.topic, props); match != test.plain {
+			t.Errorf("route without identifier matched %s %v: %t", test.topic, test.ids, match)
+		}
+	}
+}
+
+func Test_RouterDispatch(t *testing.T) {
+	var called []string
+	handler := func(name string) MessageHandler {
+		return func(c Client, m Message) {
+			called = append(called, name)
+		}
+	}
+
+	r := NewRouter()
+	r.AddRoute("a/#", handler("wildcard"))
+	r.AddRoute("$share/group/a/+", handler("shared"))
+	r.AddRoute("b", handler("other"))
+	r.SetDefaultHandler(handler("default"))
+
+	acked := 0
+	m := &message{topic: "a/b", ack: func() { acked++ }}
+	if !r.Dispatch(nil, m) {
+		t.Fatalf("Dispatch returned false")
+	}
+	if len(called) != 2 || called[0] != "wildcard" || called[1] != "shared" {
+		t.Errorf("message was dispatched to %v, should be [wildcard shared]", called)
+	}
+	if acked != 1 {
+		t.Errorf("message was acked %d times", acked)
+	}
+
+	called = nil
+	r.DeleteRoute("b")
+	r.Dispatch(nil, &message{topic: "b", ack: func() {}})
+	if len(called) != 1 || called[0] != "default" {
+		t.Errorf("message was dispatched to %v, should be [default]", called)
+	}
+
+	r.SetDefaultHandler(nil)
+	if r.Dispatch(nil, &message{topic: "c", ack: func() {}}) {
+		t.Errorf("Dispatch without a matching route returned true")
+	}
+}
@@ -0,0 +1,202 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func testServers(t *testing.T, hosts ...string) []*url.URL {
+	servers := make([]*url.URL, len(hosts))
+	for i, h := range hosts {
+		u, err := url.Parse("tcp://" + h + ":1883")
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		servers[i] = u
+	}
+	return servers
+}
+
+func hostsOf(servers []*url.URL) string {
+	s := ""
+	for _, u := range servers {
+		s += u.Hostname()
+	}
+	return s
+}
+
+func Test_ServerSelectorOrder(t *testing.T) {
+	servers := testServers(t, "a", "b", "c")
+
+	rr := NewRoundRobinSelector(nil)
+	for _, expected := range []string{"abc", "bca", "cab", "abc"} {
+		if order := hostsOf(rr.Order(servers)); order != expected {
+			t.Errorf("round robin order is %s, should be %s", order, expected)
+		}
+	}
+
+	sticky := NewStickySelector(nil)
+	sticky.Result(servers[1], nil)
+	if order := hostsOf(sticky.Order(servers)); order != "bac" {
+		t.Errorf("sticky order is %s, should be bac", order)
+	}
+
+	weighted := NewWeightedSelector(map[string]int{servers[0].String(): 0, servers[2].String(): 100}, nil)
+	if order := hostsOf(weighted.Order(servers)); order[2] != 'a' {
+		t.Errorf("weighted order is %s, server without weight should be last", order)
+	}
+
+	if order := hostsOf(NewRandomSelector(nil).Order(servers)); len(order) != 3 {
+		t.Errorf("random order is %s", order)
+	}
+}
+
+func Test_ServerSelectorBreaker(t *testing.T) {
+	servers := testServers(t, "a", "b", "c")
+	h := NewHealthTracker(2, 50*time.Millisecond)
+	p := NewPrioritySelector(h)
+
+	failed := errors.New("failed")
+	p.Result(servers[0], failed)
+	if order := hostsOf(p.Order(servers)); order != "abc" {
+		t.Errorf("order after a failure is %s, should be abc", order)
+	}
+	p.Result(servers[0], failed)
+	if order := hostsOf(p.Order(servers)); order != "bca" {
+		t.Errorf("order with an open breaker is %s, should be bca", order)
+	}
+	if health := h.Health(servers[0]); health.Failures != 2 || health.Score >= 1 {
+		t.Errorf("health of failed server is %+v", health)
+	}
+
+	// the breaker closes after the cooldown and the server is tried first.
+	time.Sleep(60 * time.Millisecond)
+	if order := hostsOf(p.Order(servers)); order != "abc" {
+		t.Errorf("order after the cooldown is %s, should be abc", order)
+	}
+	p.Result(servers[0], nil)
+	if health := h.Health(servers[0]); health.Failures != 0 {
+		t.Errorf("health after a success is %+v", health)
+	}
+}
+
+func Test_ServerSelectorConnect(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	dead.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, _ := acceptOne(t, l)
+			if conn == nil {
+				return
+			}
+			packets.NewControlPacket(packets.Connack).Write(conn)
+			packets.ReadPacket(conn)
+			conn.Close()
+		}
+	}()
+
+	attempts := make(chan int, 10)
+	ops := NewClientOptions().AddBroker("tcp://" + dead.Addr().String()).AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(4)
+	ops.SetKeepAlive(0)
+	ops.SetServerSelector(NewStickySelector(nil))
+	ops.SetConnectionStateListener(func(c Client, ev ConnectionEvent) {
+		if ev.To == StateConnected {
+			attempts <- ev.Attempt
+		}
+	})
+	c := NewClient(ops)
+
+	// the second connection goes straight to the broker which accepted the
+	// first one.
+	for _, expected := range []int{2, 1} {
+		if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+			t.Fatalf("connect failed: %v", ct.Error())
+		}
+		select {
+		case attempt := <-attempts:
+			if attempt != expected {
+				t.Errorf("connected after %d attempts, should be %d", attempt, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection event")
+		}
+		c.Disconnect(10)
+	}
+}
+
+func Test_ServerSelectorVersionRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		// both MQTT 3.1.1 and the fallback to MQTT 3.1 are refused.
+		for i := 0; i < 2; i++ {
+			conn, _ := acceptOne(t, l)
+			if conn == nil {
+				return
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ReturnCode = packets.ErrRefusedBadProtocolVersion
+			ca.Write(conn)
+			conn.Close()
+		}
+	}()
+
+	h := NewHealthTracker(DefaultBreakerThreshold, DefaultBreakerCooldown)
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetKeepAlive(0)
+	ops.SetServerSelector(NewPrioritySelector(h))
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() == nil {
+		t.Fatalf("connect to a broker refusing every version returned %v", ct.Error())
+	}
+
+	// only the refusal of the lowest version is a failure of the server.
+	server, _ := url.Parse("tcp://" + l.Addr().String())
+	if failures := h.Health(server).Failures; failures != 1 {
+		t.Errorf("%d failures recorded, should be 1", failures)
+	}
+}
+
+// stoppedClock is a Clock whose time only moves when the test sets it.
+type stoppedClock struct {
+	Clock
+	now time.Time
+}
+
+func (c *stoppedClock) Now() time.Time { return c.now }
+
+func Test_ServerSelectorClock(t *testing.T) {
+	servers := testServers(t, "a", "b")
+	clock := &stoppedClock{Clock: SystemClock, now: time.Unix(1000, 0)}
+	h := NewHealthTracker(1, time.Minute)
+	NewClient(NewClientOptions().SetClock(clock).SetServerSelector(NewPrioritySelector(h)))
+
+	h.Result(servers[0], errors.New("failed"))
+	if health := h.Health(servers[0]); !health.OpenUntil.Equal(clock.now.Add(time.Minute)) {
+		t.Errorf("breaker is open until %v, should be a minute after %v", health.OpenUntil, clock.now)
+	}
+	if h.Available(servers[0]) {
+		t.Errorf("server is available with an open breaker")
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if !h.Available(servers[0]) {
+		t.Errorf("server is not available after the cooldown of the client clock")
+	}
+}
@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func Test_WaitAll(t *testing.T) {
+	a := newToken(packets.Publish)
+	b := newToken(packets.Publish)
+	go func() {
+		a.flowComplete()
+		b.setError(errors.New("failed"))
+	}()
+
+	err := WaitAll(a, b)
+	errs, ok := err.(TokenErrors)
+	if !ok || len(errs) != 1 || errs[0].Error() != "failed" {
+		t.Errorf("WaitAll returned %v, should be the error of b", err)
+	}
+	if err := WaitAll(a, &DummyToken{}); err != nil {
+		t.Errorf("WaitAll of successful tokens returned %v", err)
+	}
+}
+
+func Test_WaitAllTimeout(t *testing.T) {
+	a := newToken(packets.Publish)
+	b := newToken(packets.Publish)
+	a.setError(errors.New("failed"))
+
+	done, err := WaitAllTimeout(10*time.Millisecond, a, b)
+	if done {
+		t.Errorf("WaitAllTimeout returned true with a token which never completes")
+	}
+	if errs, ok := err.(TokenErrors); !ok || len(errs) != 1 {
+		t.Errorf("WaitAllTimeout returned %v, should be the error of a", err)
+	}
+
+	b.flowComplete()
+	if done, _ := WaitAllTimeout(time.Second, a, b); !done {
+		t.Errorf("WaitAllTimeout returned false with completed tokens")
+	}
+
+	// the errors of the tokens after the first pending one are returned.
+	pending := newToken(packets.Publish)
+	done, err = WaitAllTimeout(10*time.Millisecond, pending, a)
+	if errs, ok := err.(TokenErrors); done || !ok || len(errs) != 1 {
+		t.Errorf("WaitAllTimeout returned %v %v, should be the error of a", done, err)
+	}
+}
+
+// timerClock is a Clock which counts the timers it created.
+type timerClock struct {
+	Clock
+	timers int
+}
+
+func (c *timerClock) NewTimer(d time.Duration) ClockTimer {
+	c.timers++
+	return c.Clock.NewTimer(d)
+}
+
+func Test_WaitAllTimeoutClock(t *testing.T) {
+	clock := &timerClock{Clock: SystemClock}
+	token := newClockToken(packets.Publish, clock)
+	if done, _ := WaitAllTimeout(time.Millisecond, token); done {
+		t.Errorf("WaitAllTimeout returned true with a token which never completes")
+	}
+	if clock.timers != 1 {
+		t.Errorf("WaitAllTimeout created %d timers with the clock of the token", clock.timers)
+	}
+}
+
+func Test_WaitAny(t *testing.T) {
+	if i := WaitAny(); i != -1 {
+		t.Errorf("WaitAny without tokens returned %d", i)
+	}
+
+	a := newToken(packets.Publish)
+	b := newToken(packets.Publish)
+	b.flowComplete()
+	if i := WaitAny(a, b); i != 1 {
+		t.Errorf("WaitAny returned %d, should be 1", i)
+	}
+	select {
+	case <-a.Done():
+		t.Errorf("Done of an incomplete token is closed")
+	default:
+	}
+}
+
+func Test_TokenTiming(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, _ := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		packets.NewControlPacket(packets.Connack).Write(conn)
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			if p, ok := cp.(*packets.PublishPacket); ok && p.Qos == 1 {
+				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				pa.MessageID = p.MessageID
+				pa.Write(conn)
+			}
+		}
+	}()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	defer c.Disconnect(10)
+
+	tokens := []Token{
+		c.Publish("a/b", 0, false, "qos0"),
+		c.Publish("a/b", 1, false, "qos1"),
+	}
+	if done, err := WaitAllTimeout(5*time.Second, tokens...); !done || err != nil {
+		t.Fatalf("publishes failed: %v %v", done, err)
+	}
+
+	q0 := tokens[0].(*PublishToken).Timing()
+	if q0.Enqueued.IsZero() || q0.Written.Before(q0.Enqueued) || !q0.Acked.IsZero() {
+		t.Errorf("timing of QoS 0 publish is %+v", q0)
+	}
+	q1 := tokens[1].(*PublishToken).Timing()
+	if q1.Enqueued.IsZero() || q1.Written.Before(q1.Enqueued) || q1.Acked.Before(q1.Written) {
+		t.Errorf("timing of QoS 1 publish is %+v", q1)
+	}
+}
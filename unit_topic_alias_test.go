@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aretas77/paho.mqtt.golang/packets"
+)
+
+func newAliasPublish(topic string, alias uint16) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Properties = &packets.Properties{}
+	if alias != 0 {
+		p.Properties.TopicAlias = &alias
+	}
+	return p
+}
+
+func Test_TopicAliasesOutbound(t *testing.T) {
+	max := uint16(2)
+	a := newTopicAliases(&packets.Properties{TopicAliasMaximum: &max}, 0)
+
+	tests := []struct {
+		topic     string
+		sentTopic string
+		alias     uint16
+	}{
+		{"a", "a", 1},
+		{"a", "", 1},
+		{"b", "b", 2},
+		{"a", "", 1},
+		// "b" is the least recently used, its alias is reassigned.
+		{"c", "c", 2},
+		{"b", "b", 1},
+		{"c", "", 2},
+	}
+	for i, test := range tests {
+		p := newAliasPublish(test.topic, 0)
+		sent := a.outbound(p)
+		if sent.TopicName != test.sentTopic || sent.Properties.TopicAlias == nil || *sent.Properties.TopicAlias != test.alias {
+			t.Errorf("%d: publish to %q was sent as %q with alias %v, should be %q with %d", i, test.topic, sent.TopicName, sent.Properties.TopicAlias, test.sentTopic, test.alias)
+		}
+		if p.TopicName != test.topic || p.Properties.TopicAlias != nil {
+			t.Errorf("%d: stored publish was modified", i)
+		}
+	}
+
+	// without a maximum from the server no aliases are used.
+	a = newTopicAliases(&packets.Properties{}, 0)
+	if p := newAliasPublish("a", 0); a.outbound(p) != p {
+		t.Errorf("alias was used while the server does not allow them")
+	}
+}
+
+func Test_TopicAliasesInbound(t *testing.T) {
+	a := newTopicAliases(nil, 1)
+
+	p := newAliasPublish("", 1)
+	if err := a.inbound(p); err == nil {
+		t.Errorf("unknown alias did not return an error")
+	}
+
+	if err := a.inbound(newAliasPublish("a/b", 1)); err != nil {
+		t.Fatalf("setting alias returned error: %v", err)
+	}
+	if err := a.inbound(p); err != nil || p.TopicName != "a/b" {
+		t.Errorf("alias resolved to %q with error %v, should be %q", p.TopicName, err, "a/b")
+	}
+
+	if err := a.inbound(newAliasPublish("a/c", 2)); err == nil {
+		t.Errorf("alias above the maximum did not return an error")
+	}
+	if err := a.inbound(newAliasPublish("a/c", 0)); err != nil {
+		t.Errorf("publish without alias returned error: %v", err)
+	}
+
+	// a new connection starts without aliases.
+	a = newTopicAliases(nil, 1)
+	if err := a.inbound(newAliasPublish("", 1)); err == nil {
+		t.Errorf("alias of a previous connection was resolved")
+	}
+}
+
+func Test_TopicAliasInvalidDisconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	reason := make(chan byte, 1)
+	go func() {
+		conn, _ := acceptOne(t, l)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		packets.InitProperties(ca)
+		ca.Write(conn)
+
+		// the client allows no topic aliases.
+		newAliasPublish("a/b", 1).Write(conn)
+		cp, err := packets.ReadPacketWithVersion(conn, 5)
+		if err != nil {
+			t.Errorf("read of DISCONNECT failed: %v", err)
+			return
+		}
+		if d, ok := cp.(*packets.DisconnectPacket); ok {
+			reason <- d.ReasonCode
+		} else {
+			t.Errorf("received %v, should be DISCONNECT", cp)
+		}
+	}()
+
+	lost := make(chan error, 1)
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	ops.SetProtocolVersion(5)
+	ops.SetAutoReconnect(false)
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c Client, err error) { lost <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(5*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+
+	select {
+	case code := <-reason:
+		if code != packets.ReasonTopicAliasInvalid {
+			t.Errorf("DISCONNECT reason code is 0x%x, should be Topic Alias invalid", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no DISCONNECT sent for the invalid topic alias")
+	}
+	select {
+	case err := <-lost:
+		if e, ok := err.(*packets.ReasonCodeError); !ok || e.Code != packets.ReasonTopicAliasInvalid {
+			t.Errorf("connection lost with %v, should be Topic Alias invalid", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("connection was not lost after the invalid topic alias")
+	}
+}